@@ -475,6 +475,26 @@ setup_fs
 		})
 	})
 
+	Context("when wsh is signalled", func() {
+		It("forwards the signal to the process in the container", func() {
+			bash := exec.Command(
+				wsh,
+				"--socket", socketPath,
+				"/bin/bash", "-c", "trap 'echo terminated; exit 42' TERM; echo ready; while true; do sleep 0.1; done",
+			)
+
+			bashSession, err := Start(bash, GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(bashSession).Should(Say("ready\n"))
+
+			bashSession.Signal(syscall.SIGTERM)
+
+			Eventually(bashSession).Should(Say("terminated\n"))
+			Eventually(bashSession).Should(Exit(42))
+		})
+	})
+
 	Context("when in rsh compatibility mode", func() {
 		It("respects -l, discards -t [X], -46dn, skips the host, and runs the command", func() {
 			pwd := exec.Command(
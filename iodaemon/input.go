@@ -1,11 +1,16 @@
 package main
 
-import "encoding/gob"
+import (
+	"encoding/gob"
+	"sync"
+	"syscall"
+)
 
 type Input struct {
 	Data       []byte
 	EOF        bool
 	WindowSize *WindowSize
+	Signal     *syscall.Signal
 }
 
 type WindowSize struct {
@@ -15,10 +20,13 @@ type WindowSize struct {
 
 type inputWriter struct {
 	enc *gob.Encoder
+
+	// stdin, window sizes and signals are sent from separate goroutines
+	mutex sync.Mutex
 }
 
 func (w *inputWriter) Write(d []byte) (int, error) {
-	err := w.enc.Encode(Input{Data: d})
+	err := w.encode(Input{Data: d})
 	if err != nil {
 		return 0, err
 	}
@@ -27,14 +35,25 @@ func (w *inputWriter) Write(d []byte) (int, error) {
 }
 
 func (w *inputWriter) Close() error {
-	return w.enc.Encode(Input{EOF: true})
+	return w.encode(Input{EOF: true})
 }
 
 func (w *inputWriter) SetWindowSize(cols, rows int) error {
-	return w.enc.Encode(Input{
+	return w.encode(Input{
 		WindowSize: &WindowSize{
 			Columns: cols,
 			Rows:    rows,
 		},
 	})
 }
+
+func (w *inputWriter) Signal(signal syscall.Signal) error {
+	return w.encode(Input{Signal: &signal})
+}
+
+func (w *inputWriter) encode(input Input) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.enc.Encode(input)
+}
@@ -2,11 +2,15 @@ package main_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-incubator/warden-linux/ptyutil"
 	"github.com/kr/pty"
@@ -93,6 +97,347 @@ var _ = Describe("Iodaemon", func() {
 		Eventually(linkS).Should(gexec.Exit(42))
 	})
 
+	Describe("when the process exits", func() {
+		var spawnS *gexec.Session
+
+		BeforeEach(func() {
+			var err error
+
+			spawnS, err = gexec.Start(exec.Command(
+				iodaemon,
+				"spawn",
+				socketPath,
+				"bash", "-c", "exit 42",
+			), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+			linkS, err := gexec.Start(exec.Command(iodaemon, "link", socketPath), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(linkS).Should(gexec.Exit(42))
+			Eventually(spawnS, 5).Should(gexec.Exit(0))
+		})
+
+		It("records the exit status next to the socket, and removes the socket", func() {
+			status, err := ioutil.ReadFile(filepath.Join(tmpdir, "iodaemon.status"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(status)).Should(Equal("42\n"))
+
+			_, err = os.Stat(socketPath)
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		It("exits later links with the recorded status", func() {
+			linkS, err := gexec.Start(exec.Command(iodaemon, "link", socketPath), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(linkS).Should(gexec.Exit(42))
+		})
+	})
+
+	Context("when a status is left from an earlier process with the same socket", func() {
+		BeforeEach(func() {
+			err := ioutil.WriteFile(filepath.Join(tmpdir, "iodaemon.status"), []byte("42\n"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("removes it when spawning", func() {
+			spawnS, err := gexec.Start(exec.Command(
+				iodaemon,
+				"spawn",
+				socketPath,
+				"bash", "-c", "exit 0",
+			), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer spawnS.Kill()
+
+			Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+			_, err = os.Stat(filepath.Join(tmpdir, "iodaemon.status"))
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+		})
+	})
+
+	Describe("spawning with -logSize", func() {
+		type logEntry struct {
+			Time   time.Time
+			Source string
+			Data   []byte
+		}
+
+		readLog := func(name string) []logEntry {
+			file, err := os.Open(filepath.Join(tmpdir, name))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer file.Close()
+
+			entries := []logEntry{}
+
+			decoder := json.NewDecoder(file)
+
+			for {
+				var entry logEntry
+
+				err := decoder.Decode(&entry)
+				if err == io.EOF {
+					break
+				}
+
+				Ω(err).ShouldNot(HaveOccurred())
+
+				entries = append(entries, entry)
+			}
+
+			return entries
+		}
+
+		output := func(entries []logEntry, source string) string {
+			data := ""
+
+			for _, entry := range entries {
+				if entry.Source == source {
+					data += string(entry.Data)
+				}
+			}
+
+			return data
+		}
+
+		It("logs the output next to the socket, with timestamps, while still streaming it", func() {
+			spawnS, err := gexec.Start(exec.Command(
+				iodaemon,
+				"-logSize=1048576",
+				"spawn",
+				socketPath,
+				"bash", "-c", "echo hi out; echo hi err >&2; exit 42",
+			), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer spawnS.Kill()
+
+			Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+			before := time.Now()
+
+			linkS, err := gexec.Start(exec.Command(iodaemon, "link", socketPath), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(linkS).Should(gbytes.Say("hi out\n"))
+			Eventually(linkS.Err).Should(gbytes.Say("hi err\n"))
+			Eventually(linkS).Should(gexec.Exit(42))
+
+			entries := readLog("iodaemon.log")
+
+			Ω(output(entries, "stdout")).Should(Equal("hi out\n"))
+			Ω(output(entries, "stderr")).Should(Equal("hi err\n"))
+
+			for _, entry := range entries {
+				Ω(entry.Time).Should(BeTemporally(">=", before.Add(-time.Second)))
+				Ω(entry.Time).Should(BeTemporally("<=", time.Now()))
+			}
+		})
+
+		It("keeps logging once the link goes away", func() {
+			spawnS, err := gexec.Start(exec.Command(
+				iodaemon,
+				"-logSize=10485760",
+				"spawn",
+				socketPath,
+				"bash", "-c", "for i in $(seq 20000); do echo line $i; done; exit 42",
+			), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer spawnS.Kill()
+
+			Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+			// a link whose stdout is never read stops reading the process's
+			// output once the pipe fills up
+			stuckR, stuckW, err := os.Pipe()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer stuckR.Close()
+
+			link := exec.Command(iodaemon, "link", socketPath)
+			link.Stdout = stuckW
+
+			err = link.Start()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			stuckW.Close()
+
+			Eventually(spawnS).Should(gbytes.Say("pid:"))
+
+			err = link.Process.Kill()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			link.Wait()
+
+			Eventually(spawnS, 10).Should(gexec.Exit(0))
+
+			Ω(output(readLog("iodaemon.log"), "stdout")).Should(MatchRegexp(`^line 1\n(.|\n)*line 20000\n$`))
+		})
+
+		It("streams all of the output to a link that reads it slowly", func() {
+			spawnS, err := gexec.Start(exec.Command(
+				iodaemon,
+				"-logSize=10485760",
+				"spawn",
+				socketPath,
+				"bash", "-c", "for i in $(seq 20000); do echo line $i; done; exit 42",
+			), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer spawnS.Kill()
+
+			Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+			slowR, slowW, err := os.Pipe()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer slowR.Close()
+
+			link := exec.Command(iodaemon, "link", socketPath)
+			link.Stdout = slowW
+
+			err = link.Start()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer link.Process.Kill()
+
+			slowW.Close()
+
+			Eventually(spawnS).Should(gbytes.Say("pid:"))
+
+			// let the output back up behind the link
+			time.Sleep(time.Second)
+
+			streamed, err := ioutil.ReadAll(slowR)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			expected := ""
+			for i := 1; i <= 20000; i++ {
+				expected += fmt.Sprintf("line %d\n", i)
+			}
+
+			Ω(string(streamed)).Should(Equal(expected))
+
+			Ω(link.Wait()).Should(HaveOccurred())
+			Ω(link.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()).Should(Equal(42))
+		})
+
+		Context("when a log is left from an earlier process with the same socket", func() {
+			BeforeEach(func() {
+				for _, name := range []string{"iodaemon.log", "iodaemon.log.1"} {
+					err := ioutil.WriteFile(
+						filepath.Join(tmpdir, name),
+						[]byte(`{"Time":"2014-01-01T00:00:00Z","Source":"stdout","Data":"b2xkCg=="}`+"\n"),
+						0644,
+					)
+					Ω(err).ShouldNot(HaveOccurred())
+				}
+			})
+
+			It("replaces it and its rotated logs", func() {
+				spawnS, err := gexec.Start(exec.Command(
+					iodaemon,
+					"-logSize=1048576",
+					"spawn",
+					socketPath,
+					"bash", "-c", "echo new",
+				), GinkgoWriter, GinkgoWriter)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				defer spawnS.Kill()
+
+				Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+				linkS, err := gexec.Start(exec.Command(iodaemon, "link", socketPath), GinkgoWriter, GinkgoWriter)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Eventually(linkS, 5).Should(gexec.Exit(0))
+
+				Ω(output(readLog("iodaemon.log"), "stdout")).Should(Equal("new\n"))
+
+				_, err = os.Stat(filepath.Join(tmpdir, "iodaemon.log.1"))
+				Ω(os.IsNotExist(err)).Should(BeTrue())
+			})
+		})
+
+		It("rotates the log, keeping up to -logFiles old logs", func() {
+			spawnS, err := gexec.Start(exec.Command(
+				iodaemon,
+				"-logSize=200",
+				"-logFiles=2",
+				"spawn",
+				socketPath,
+				"bash", "-c", "for i in $(seq 10); do echo line $i; sleep 0.05; done",
+			), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer spawnS.Kill()
+
+			Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+			linkS, err := gexec.Start(exec.Command(iodaemon, "link", socketPath), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(linkS, 5).Should(gexec.Exit(0))
+
+			older := readLog("iodaemon.log.2")
+			old := readLog("iodaemon.log.1")
+			current := readLog("iodaemon.log")
+
+			Ω(output(older, "stdout") + output(old, "stdout") + output(current, "stdout")).Should(MatchRegexp(`line 9\nline 10\n$`))
+
+			_, err = os.Stat(filepath.Join(tmpdir, "iodaemon.log.3"))
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+
+			for _, name := range []string{"iodaemon.log.2", "iodaemon.log.1", "iodaemon.log"} {
+				info, err := os.Stat(filepath.Join(tmpdir, name))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(info.Size()).Should(BeNumerically("<=", 200))
+			}
+		})
+	})
+
+	Describe("linking with -signals", func() {
+		It("relays signals read from fd 3 to the process", func() {
+			spawnS, err := gexec.Start(exec.Command(
+				iodaemon,
+				"spawn",
+				socketPath,
+				"bash", "-c", "trap 'exit 42' TERM; echo trapping; while true; do sleep 0.1; done",
+			), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer spawnS.Kill()
+
+			Eventually(spawnS).Should(gbytes.Say("ready\n"))
+
+			signalsR, signalsW, err := os.Pipe()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			link := exec.Command(iodaemon, "-signals", "link", socketPath)
+			link.ExtraFiles = []*os.File{signalsR}
+
+			linkS, err := gexec.Start(link, GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			signalsR.Close()
+
+			Eventually(linkS).Should(gbytes.Say("trapping\n"))
+
+			_, err = fmt.Fprintf(signalsW, "%d\n", syscall.SIGTERM)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(linkS).Should(gexec.Exit(42))
+		})
+	})
+
 	Describe("spawning with -tty", func() {
 		It("transports stdin, stdout, and stderr", func() {
 			spawnS, err := gexec.Start(exec.Command(
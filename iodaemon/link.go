@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -14,10 +15,16 @@ import (
 	"github.com/kr/pty"
 )
 
-func link(socketPath string) {
+func link(socketPath string, relaySignals bool) {
+	var signals *os.File
+	if relaySignals {
+		signals = os.NewFile(3, "signals")
+	}
+
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
-		fatal(err)
+		// the process may have completed while no one was linked
+		exitWithRecordedStatus(socketPath, err)
 	}
 
 	var b [2048]byte
@@ -54,7 +61,7 @@ func link(socketPath string) {
 
 	streaming := &sync.WaitGroup{}
 
-	inputWriter := &inputWriter{gob.NewEncoder(conn)}
+	inputWriter := &inputWriter{enc: gob.NewEncoder(conn)}
 
 	resized := make(chan os.Signal, 10)
 
@@ -71,6 +78,10 @@ func link(socketPath string) {
 
 	signal.Notify(resized, syscall.SIGWINCH)
 
+	if signals != nil {
+		go relay(signals, inputWriter)
+	}
+
 	// do not add stdin to the waitgroup; it appears to cause things to hang.
 	// doesn't make much sense anyway; if stdout/stderr closed we probably
 	// can't write any more to stdin in the first place.
@@ -98,8 +109,34 @@ func link(socketPath string) {
 	var exitStatus int
 	_, err = fmt.Fscanf(status, "%d\n", &exitStatus)
 	if err != nil {
-		log.Fatalln("failed to read status:", err)
+		// another link may have already read the status
+		exitWithRecordedStatus(socketPath, err)
 	}
 
 	os.Exit(exitStatus)
 }
+
+func exitWithRecordedStatus(socketPath string, linkErr error) {
+	exitStatus, err := readStatus(statusPath(socketPath))
+	if err != nil {
+		fatal(linkErr)
+	}
+
+	os.Exit(exitStatus)
+}
+
+// relay sends each signal number read from the given file on to the process
+func relay(signals *os.File, inputWriter *inputWriter) {
+	reader := bufio.NewReader(signals)
+
+	for {
+		var number int
+
+		_, err := fmt.Fscanf(reader, "%d\n", &number)
+		if err != nil {
+			return
+		}
+
+		inputWriter.Signal(syscall.Signal(number))
+	}
+}
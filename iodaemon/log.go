@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logPath is where the output of the process served on the socket is
+// logged, e.g. processes/1.log for processes/1.sock. Rotated logs are
+// suffixed with .1, .2, and so on, .1 being the most recent.
+func logPath(socketPath string) string {
+	return strings.TrimSuffix(socketPath, filepath.Ext(socketPath)) + ".log"
+}
+
+type logEntry struct {
+	Time   time.Time
+	Source string
+	Data   []byte
+}
+
+// processLog records chunks of a process's output, one JSON entry per line,
+// rotating the log once it reaches maxSize and keeping up to files rotated
+// logs.
+type processLog struct {
+	path    string
+	maxSize int64
+	files   int
+
+	file *os.File
+	size int64
+
+	mutex sync.Mutex
+}
+
+// openLog starts a new log. Any log already at the path is from an earlier
+// process with the same ID, e.g. from before the server restarted, so it is
+// removed along with its rotated logs rather than appended to.
+func openLog(path string, maxSize int64, files int) (*processLog, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, old := range rotated {
+		err := os.Remove(old)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &processLog{
+		path:    path,
+		maxSize: maxSize,
+		files:   files,
+
+		file: file,
+	}, nil
+}
+
+func (l *processLog) Record(source string, data []byte) error {
+	line, err := json.Marshal(logEntry{
+		Time:   time.Now().UTC(),
+		Source: source,
+		Data:   data,
+	})
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+
+	return err
+}
+
+func (l *processLog) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if l.files > 0 {
+		for i := l.files - 1; i > 0; i-- {
+			err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		err := os.Rename(l.path, l.rotatedPath(1))
+		if err != nil {
+			return err
+		}
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.size = 0
+
+	return nil
+}
+
+func (l *processLog) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// how many chunks of output are held for when a link next connects, after
+// which further chunks are only logged
+const linkBacklog = 16
+
+// links tracks whether a link is connected, so that output is only ever
+// dropped when there is no link to read it
+type links struct {
+	// closed while no link is connected
+	unlinked chan struct{}
+
+	mutex sync.Mutex
+}
+
+func newLinks() *links {
+	unlinked := make(chan struct{})
+	close(unlinked)
+
+	return &links{unlinked: unlinked}
+}
+
+func (l *links) Linked() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.unlinked = make(chan struct{})
+}
+
+func (l *links) Unlinked() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	close(l.unlinked)
+}
+
+func (l *links) whenUnlinked() <-chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.unlinked
+}
+
+// teeToLog records the output read from the given file in the log as it is
+// passed on to the returned file, which links then read from instead.
+//
+// While a link is connected, output is passed on as fast as the link reads
+// it. Otherwise logging does not wait: output beyond the backlog is only
+// logged.
+func teeToLog(output *os.File, log *processLog, source string, links *links, teeing *sync.WaitGroup) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	forLinks := make(chan []byte, linkBacklog)
+
+	teeing.Add(1)
+
+	go func() {
+		defer teeing.Done()
+		defer close(forLinks)
+
+		buf := make([]byte, 32*1024)
+
+		for {
+			n, err := output.Read(buf)
+			if n > 0 {
+				log.Record(source, buf[:n])
+
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+
+				select {
+				case forLinks <- chunk:
+				case <-links.whenUnlinked():
+					select {
+					case forLinks <- chunk:
+					default:
+					}
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer w.Close()
+
+		for chunk := range forLinks {
+			_, err := w.Write(chunk)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
@@ -8,12 +8,16 @@ import (
 
 const USAGE = `usage:
 
-	iomux spawn [-timeout timeout] [-tty] <socket> <path> <args...>:
+	iomux spawn [-timeout timeout] [-tty] [-logSize bytes [-logFiles n]] <socket> <path> <args...>:
 		spawn a subprocess, making its stdio and exit status available via
-		the given socket
-
-	iomux link <socket>:
-		attach to a process via the given socket
+		the given socket; the exit status is also recorded next to the
+		socket, e.g. 1.status for 1.sock, as is its output with -logSize,
+		e.g. 1.log
+
+	iomux link [-signals] <socket>:
+		attach to a process via the given socket, exiting with its status;
+		with -signals, signal numbers read line by line from fd 3 are sent
+		to the process
 `
 
 // TODO actually do this
@@ -41,6 +45,24 @@ var windowRows = flag.Int(
 	"initial window rows for the process's tty",
 )
 
+var logSize = flag.Int64(
+	"logSize",
+	0,
+	"when spawning, also log the process's output next to the socket, rotating the log once it reaches this many bytes (0 disables logging)",
+)
+
+var logFiles = flag.Int(
+	"logFiles",
+	5,
+	"number of rotated logs to keep",
+)
+
+var signals = flag.Bool(
+	"signals",
+	false,
+	"when linking, relay signals to the process from fd 3",
+)
+
 func main() {
 	flag.Parse()
 
@@ -52,14 +74,14 @@ func main() {
 			usage()
 		}
 
-		spawn(args[1], args[2], args[2:], *timeout, *tty, *windowColumns, *windowRows)
+		spawn(args[1], args[2], args[2:], *timeout, *tty, *windowColumns, *windowRows, *logSize, *logFiles)
 
 	case "link":
 		if len(args) < 2 {
 			usage()
 		}
 
-		link(args[1])
+		link(args[1], *signals)
 
 	default:
 		usage()
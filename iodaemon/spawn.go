@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,12 +16,23 @@ import (
 	"github.com/kr/pty"
 )
 
-func spawn(socketPath string, path string, argv []string, timeout time.Duration, withTty bool, windowColumns int, windowRows int) {
+// how long to wait, once the process has exited, for its remaining output to
+// be logged
+const logDrainTimeout = time.Second
+
+func spawn(socketPath string, path string, argv []string, timeout time.Duration, withTty bool, windowColumns int, windowRows int, logSize int64, logFiles int) {
 	err := os.MkdirAll(filepath.Dir(socketPath), 0755)
 	if err != nil {
 		fatal(err)
 	}
 
+	// a status left from an earlier process with the same ID would be taken
+	// as this one's by links that fail to connect
+	err = os.Remove(statusPath(socketPath))
+	if err != nil && !os.IsNotExist(err) {
+		fatal(err)
+	}
+
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
 		fatal(err)
@@ -84,6 +96,29 @@ func spawn(socketPath string, path string, argv []string, timeout time.Duration,
 		fatal(err)
 	}
 
+	teeing := &sync.WaitGroup{}
+	links := newLinks()
+
+	if logSize > 0 {
+		outputLog, err := openLog(logPath(socketPath), logSize, logFiles)
+		if err != nil {
+			fatal(err)
+		}
+
+		stdoutR, err = teeToLog(stdoutR, outputLog, "stdout", links, teeing)
+		if err != nil {
+			fatal(err)
+		}
+
+		// with a tty, stderr is the same as stdout
+		if !withTty {
+			stderrR, err = teeToLog(stderrR, outputLog, "stderr", links, teeing)
+			if err != nil {
+				fatal(err)
+			}
+		}
+	}
+
 	fmt.Println("ready")
 
 	started := false
@@ -107,6 +142,8 @@ func spawn(socketPath string, path string, argv []string, timeout time.Duration,
 			break
 		}
 
+		links.Linked()
+
 		if !started {
 			err := cmd.Start()
 			if err != nil {
@@ -122,12 +159,34 @@ func spawn(socketPath string, path string, argv []string, timeout time.Duration,
 			go func() {
 				cmd.Wait()
 
+				logged := make(chan struct{})
+
+				go func() {
+					teeing.Wait()
+					close(logged)
+				}()
+
+				select {
+				case <-logged:
+				case <-time.After(logDrainTimeout):
+				}
+
+				exitStatus := 255
 				if cmd.ProcessState != nil {
-					fmt.Fprintf(statusW, "%d\n", cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus())
-				} else {
-					fmt.Fprintf(statusW, "255\n")
+					exitStatus = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+				}
+
+				// record the status for links made after we've exited, e.g. by a
+				// server that was down when the process completed
+				err := writeStatus(statusPath(socketPath), exitStatus)
+				if err != nil {
+					log.Println("failed to record exit status:", err)
 				}
 
+				os.Remove(socketPath)
+
+				fmt.Fprintf(statusW, "%d\n", exitStatus)
+
 				os.Exit(0)
 			}()
 
@@ -150,7 +209,11 @@ func spawn(socketPath string, path string, argv []string, timeout time.Duration,
 				break
 			}
 
-			if input.WindowSize != nil {
+			if input.Signal != nil {
+				// for containers, the command is wsh, which forwards the
+				// signal to the process it runs in the container
+				cmd.Process.Signal(*input.Signal)
+			} else if input.WindowSize != nil {
 				ptyutil.SetWinSize(stdinW, input.WindowSize.Columns, input.WindowSize.Rows)
 				cmd.Process.Signal(syscall.SIGWINCH)
 			} else if input.EOF {
@@ -167,6 +230,8 @@ func spawn(socketPath string, path string, argv []string, timeout time.Duration,
 				}
 			}
 		}
+
+		links.Unlinked()
 	}
 }
 
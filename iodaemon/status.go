@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// statusPath is where the exit status of the process served on the socket is
+// recorded, e.g. processes/1.status for processes/1.sock, so that it can
+// still be collected once iodaemon spawn has gone away.
+func statusPath(socketPath string) string {
+	return strings.TrimSuffix(socketPath, filepath.Ext(socketPath)) + ".status"
+}
+
+// writeStatus durably records the exit status; it is written to a temporary
+// file and renamed into place so that readers never see a partial status.
+func writeStatus(path string, exitStatus int) error {
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(tmp, "%d\n", exitStatus)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	tmp.Close()
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func readStatus(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	var exitStatus int
+
+	_, err = fmt.Fscanf(file, "%d\n", &exitStatus)
+	if err != nil {
+		return 0, err
+	}
+
+	return exitStatus, nil
+}
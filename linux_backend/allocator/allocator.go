@@ -0,0 +1,243 @@
+// Package allocator hands out indices into a fixed-size range of resources,
+// tracking which are free in a bitmap.
+//
+// Released indices can be held in quarantine for a period before they are
+// handed out again, so that state lingering on the host (e.g. conntrack
+// entries for an IP or port) does not leak to the next container to get it.
+package allocator
+
+import (
+	"sync"
+	"time"
+)
+
+type Allocator struct {
+	size uint32
+
+	free []uint64
+	next uint32
+
+	quarantine  time.Duration
+	quarantined []quarantinedIndex
+	held        []uint64
+
+	mutex sync.Mutex
+}
+
+type quarantinedIndex struct {
+	index      uint32
+	releasedAt time.Time
+}
+
+func New(size uint32, quarantine time.Duration) *Allocator {
+	free := make([]uint64, (uint64(size)+63)/64)
+
+	for i := range free {
+		free[i] = ^uint64(0)
+	}
+
+	if size%64 != 0 {
+		free[len(free)-1] = (uint64(1) << (size % 64)) - 1
+	}
+
+	return &Allocator{
+		size: size,
+
+		free: free,
+
+		quarantine: quarantine,
+		held:       make([]uint64, len(free)),
+	}
+}
+
+func (a *Allocator) Size() uint32 {
+	return a.size
+}
+
+// Acquire takes the next free index after the one most recently acquired,
+// wrapping around, so that released indices go to the back of the line.
+func (a *Allocator) Acquire() (uint32, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.endQuarantine()
+
+	index, found := a.firstFree(a.next, a.size)
+	if !found {
+		index, found = a.firstFree(0, a.next)
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	a.take(index)
+	a.next = index + 1
+
+	return index, true
+}
+
+// AcquireRun takes the lowest run of count consecutive free indices,
+// returning the first. Either all of them are taken or none are.
+func (a *Allocator) AcquireRun(count uint32) (uint32, bool) {
+	if count == 0 || count > a.size {
+		return 0, false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.endQuarantine()
+
+	for from := uint32(0); from+count <= a.size; {
+		first, found := a.firstFree(from, a.size-count+1)
+		if !found {
+			return 0, false
+		}
+
+		end := first + 1
+		for end < first+count && a.isFree(end) {
+			end++
+		}
+
+		if end == first+count {
+			for i := first; i < end; i++ {
+				a.take(i)
+			}
+
+			return first, true
+		}
+
+		from = end + 1
+	}
+
+	return 0, false
+}
+
+// Claim takes count specific consecutive indices starting at first. Either
+// all of them are free and taken, or none are.
+func (a *Allocator) Claim(first, count uint32) bool {
+	if uint64(first)+uint64(count) > uint64(a.size) {
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.endQuarantine()
+
+	for i := first; i < first+count; i++ {
+		if !a.isFree(i) {
+			return false
+		}
+	}
+
+	for i := first; i < first+count; i++ {
+		a.take(i)
+	}
+
+	return true
+}
+
+// Release returns an index, which becomes available again once the
+// quarantine period has passed. Indices out of range or not taken are
+// ignored.
+func (a *Allocator) Release(index uint32) {
+	if index >= a.size {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	word, bit := index/64, uint64(1)<<(index%64)
+
+	if a.free[word]&bit != 0 || a.held[word]&bit != 0 {
+		return
+	}
+
+	if a.quarantine == 0 {
+		a.free[word] |= bit
+		return
+	}
+
+	a.held[word] |= bit
+	a.quarantined = append(a.quarantined, quarantinedIndex{
+		index:      index,
+		releasedAt: time.Now(),
+	})
+}
+
+// endQuarantine frees the indices whose quarantine has passed. They are
+// queued in the order they were released, so only the front is checked.
+func (a *Allocator) endQuarantine() {
+	if len(a.quarantined) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	ended := 0
+	for _, q := range a.quarantined {
+		if now.Sub(q.releasedAt) < a.quarantine {
+			break
+		}
+
+		word, bit := q.index/64, uint64(1)<<(q.index%64)
+
+		a.held[word] &^= bit
+		a.free[word] |= bit
+
+		ended++
+	}
+
+	a.quarantined = a.quarantined[ended:]
+}
+
+// firstFree finds the lowest free index in [from, to), a word at a time
+func (a *Allocator) firstFree(from, to uint32) (uint32, bool) {
+	for from < to {
+		word := from / 64
+
+		free := a.free[word] &^ ((uint64(1) << (from % 64)) - 1)
+		if free != 0 {
+			index := word*64 + uint32(trailingZeros(free))
+			if index < to {
+				return index, true
+			}
+
+			return 0, false
+		}
+
+		from = (word + 1) * 64
+	}
+
+	return 0, false
+}
+
+// deBruijn64 is a de Bruijn sequence: each 6-bit window of it is unique, so
+// multiplying it by a single set bit puts that bit's position in the top 6
+// bits, which index the table below
+const deBruijn64 = 0x03f79d71b4ca8b09
+
+var deBruijn64Positions = [64]uint8{
+	0, 1, 56, 2, 57, 49, 28, 3, 61, 58, 42, 50, 38, 29, 17, 4,
+	62, 47, 59, 36, 45, 43, 51, 22, 53, 39, 33, 30, 24, 18, 12, 5,
+	63, 55, 48, 27, 60, 41, 37, 16, 46, 35, 44, 21, 52, 32, 23, 11,
+	54, 26, 40, 15, 34, 20, 31, 10, 25, 14, 19, 9, 13, 8, 7, 6,
+}
+
+// trailingZeros counts the zero bits below the lowest set bit of a non-zero
+// word
+func trailingZeros(word uint64) uint8 {
+	lowest := word & -word
+	return deBruijn64Positions[(lowest*deBruijn64)>>58]
+}
+
+func (a *Allocator) isFree(index uint32) bool {
+	return a.free[index/64]&(uint64(1)<<(index%64)) != 0
+}
+
+func (a *Allocator) take(index uint32) {
+	a.free[index/64] &^= uint64(1) << (index % 64)
+}
@@ -0,0 +1,139 @@
+package allocator_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/allocator"
+)
+
+var _ = Describe("Allocator", func() {
+	Describe("acquiring", func() {
+		It("hands out each index once, across bitmap words", func() {
+			alloc := allocator.New(130, 0)
+
+			for i := uint32(0); i < 130; i++ {
+				index, ok := alloc.Acquire()
+				Ω(ok).Should(BeTrue())
+				Ω(index).Should(Equal(i))
+			}
+
+			_, ok := alloc.Acquire()
+			Ω(ok).Should(BeFalse())
+		})
+
+		It("continues after the most recently acquired index", func() {
+			alloc := allocator.New(3, 0)
+
+			first, _ := alloc.Acquire()
+			alloc.Release(first)
+
+			index, _ := alloc.Acquire()
+			Ω(index).Should(Equal(uint32(1)))
+
+			index, _ = alloc.Acquire()
+			Ω(index).Should(Equal(uint32(2)))
+
+			index, _ = alloc.Acquire()
+			Ω(index).Should(Equal(first))
+		})
+	})
+
+	Describe("acquiring a run", func() {
+		It("takes the lowest run long enough", func() {
+			alloc := allocator.New(200, 0)
+
+			Ω(alloc.Claim(0, 60)).Should(BeTrue())
+			Ω(alloc.Claim(62, 1)).Should(BeTrue())
+			Ω(alloc.Claim(66, 1)).Should(BeTrue())
+
+			first, ok := alloc.AcquireRun(4)
+			Ω(ok).Should(BeTrue())
+			Ω(first).Should(Equal(uint32(67)))
+
+			first, ok = alloc.AcquireRun(3)
+			Ω(ok).Should(BeTrue())
+			Ω(first).Should(Equal(uint32(63)))
+
+			first, ok = alloc.AcquireRun(2)
+			Ω(ok).Should(BeTrue())
+			Ω(first).Should(Equal(uint32(60)))
+		})
+
+		Context("when no run is long enough", func() {
+			It("takes nothing", func() {
+				alloc := allocator.New(4, 0)
+
+				Ω(alloc.Claim(2, 1)).Should(BeTrue())
+
+				_, ok := alloc.AcquireRun(3)
+				Ω(ok).Should(BeFalse())
+
+				Ω(alloc.Claim(0, 2)).Should(BeTrue())
+				Ω(alloc.Claim(3, 1)).Should(BeTrue())
+			})
+		})
+	})
+
+	Describe("claiming", func() {
+		It("takes all of the indices or none of them", func() {
+			alloc := allocator.New(8, 0)
+
+			Ω(alloc.Claim(3, 1)).Should(BeTrue())
+			Ω(alloc.Claim(0, 4)).Should(BeFalse())
+			Ω(alloc.Claim(0, 3)).Should(BeTrue())
+		})
+
+		It("refuses indices out of range", func() {
+			alloc := allocator.New(8, 0)
+
+			Ω(alloc.Claim(6, 3)).Should(BeFalse())
+			Ω(alloc.Claim(6, 2)).Should(BeTrue())
+		})
+	})
+
+	Describe("releasing", func() {
+		It("ignores indices that are already free", func() {
+			alloc := allocator.New(1, 0)
+
+			alloc.Release(0)
+
+			_, ok := alloc.Acquire()
+			Ω(ok).Should(BeTrue())
+
+			_, ok = alloc.Acquire()
+			Ω(ok).Should(BeFalse())
+		})
+
+		Context("with a quarantine period", func() {
+			It("holds the index back until the period has passed", func() {
+				alloc := allocator.New(1, 100*time.Millisecond)
+
+				index, ok := alloc.Acquire()
+				Ω(ok).Should(BeTrue())
+
+				alloc.Release(index)
+
+				_, ok = alloc.Acquire()
+				Ω(ok).Should(BeFalse())
+
+				Ω(alloc.Claim(index, 1)).Should(BeFalse())
+
+				Eventually(func() bool {
+					_, ok := alloc.Acquire()
+					return ok
+				}).Should(BeTrue())
+			})
+
+			It("does not hold back indices that were never acquired", func() {
+				alloc := allocator.New(2, time.Hour)
+
+				alloc.Release(1)
+
+				Ω(alloc.Claim(1, 1)).Should(BeTrue())
+			})
+		})
+	})
+})
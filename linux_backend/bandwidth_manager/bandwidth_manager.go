@@ -14,35 +14,146 @@ import (
 
 var IN_RATE_PATTERN = regexp.MustCompile(`qdisc tbf [0-9a-f]+: root refcnt \d+ rate (\d+)([KMG]?)bit burst (\d+)([KMG]?)b`)
 var OUT_RATE_PATTERN = regexp.MustCompile(`police 0x[0-9a-f]+ rate (\d+)([KMG]?)bit burst (\d+)([KMG]?)b`)
+var CLASS_RATE_PATTERN = regexp.MustCompile(`class htb 1:[0-9a-f]+ .*rate (\d+)([KMG]?)bit ceil \d+[KMG]?bit burst (\d+)([KMG]?)b`)
+
+// class IDs are 16 bits, and 1:ffff is the uplink's default class
+const maxClassID = 0xfffe
 
 type BandwidthManager interface {
-	SetLimits(warden.BandwidthLimits) error
+	SetLimits(Limits) error
 	GetLimits() (warden.ContainerBandwidthStat, error)
 }
 
+// Limits shape a container's traffic to (ingress) and from (egress) it, in
+// bytes per second and bytes.
+type Limits struct {
+	IngressRate  uint64
+	IngressBurst uint64
+
+	EgressRate  uint64
+	EgressBurst uint64
+
+	// in HTB mode, EgressRate is guaranteed and egress may borrow up to
+	// EgressCeil from the uplink when it is idle; it defaults to the uplink's
+	// rate
+	EgressCeil uint64
+}
+
+// SymmetricLimits applies warden's limits in both directions.
+func SymmetricLimits(limits warden.BandwidthLimits) Limits {
+	return Limits{
+		IngressRate:  limits.RateInBytesPerSecond,
+		IngressBurst: limits.BurstRateInBytesPerSecond,
+
+		EgressRate:  limits.RateInBytesPerSecond,
+		EgressBurst: limits.BurstRateInBytesPerSecond,
+	}
+}
+
+type Mode string
+
+const (
+	// cap each direction with a token bucket filter on the container's veth
+	ModeTBF = Mode("tbf")
+
+	// shape egress in a class of a hierarchical token bucket on the uplink,
+	// which all containers share
+	ModeHTB = Mode("htb")
+)
+
+type Config struct {
+	Mode Mode
+
+	// in HTB mode, the interface and rate (in bytes per second) that
+	// containers' egress classes share
+	UplinkInterface string
+	UplinkRate      uint64
+}
+
+func (c Config) Validate() error {
+	switch c.Mode {
+	case ModeTBF:
+		return nil
+	case ModeHTB:
+		if c.UplinkInterface == "" || c.UplinkRate == 0 {
+			return fmt.Errorf("htb bandwidth mode requires an uplink interface and rate")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown bandwidth mode (must be tbf or htb): %s", c.Mode)
+	}
+}
+
+// Environ is the configuration for setup.sh, which creates the uplink's
+// classes in HTB mode.
+func (c Config) Environ() []string {
+	return []string{
+		"BANDWIDTH_MODE=" + string(c.Mode),
+		"UPLINK_IFACE=" + c.UplinkInterface,
+		fmt.Sprintf("UPLINK_RATE=%d", c.UplinkRate*8),
+	}
+}
+
 type ContainerBandwidthManager struct {
 	containerPath string
 	containerID   string
 
+	config  Config
+	classID uint32
+
 	runner command_runner.CommandRunner
 }
 
-func New(containerPath, containerID string, runner command_runner.CommandRunner) *ContainerBandwidthManager {
+// New creates a bandwidth manager for a container. In HTB mode, the
+// container's egress is classified on the uplink by classID, which must be
+// unique among containers.
+func New(containerPath, containerID string, config Config, classID uint32, runner command_runner.CommandRunner) *ContainerBandwidthManager {
 	return &ContainerBandwidthManager{
 		containerPath: containerPath,
 		containerID:   containerID,
 
+		config:  config,
+		classID: classID,
+
 		runner: runner,
 	}
 }
 
-func (m *ContainerBandwidthManager) SetLimits(limits warden.BandwidthLimits) error {
+func (m *ContainerBandwidthManager) SetLimits(limits Limits) error {
+	env := []string{
+		"MODE=" + string(m.config.Mode),
+		fmt.Sprintf("INGRESS_RATE=%d", limits.IngressRate*8),
+		fmt.Sprintf("INGRESS_BURST=%d", limits.IngressBurst),
+		fmt.Sprintf("EGRESS_RATE=%d", limits.EgressRate*8),
+		fmt.Sprintf("EGRESS_BURST=%d", limits.EgressBurst),
+	}
+
+	if m.config.Mode == ModeHTB {
+		if m.classID == 0 || m.classID > maxClassID {
+			return fmt.Errorf("cannot classify container on the uplink: class ID %d out of range", m.classID)
+		}
+
+		ceil := limits.EgressCeil
+		if ceil == 0 {
+			ceil = m.config.UplinkRate
+		}
+
+		if ceil < limits.EgressRate {
+			return fmt.Errorf("egress ceiling (%d) must not be less than egress rate (%d)", ceil, limits.EgressRate)
+		}
+
+		env = append(
+			env,
+			fmt.Sprintf("EGRESS_CEIL=%d", ceil*8),
+			"UPLINK_IFACE="+m.config.UplinkInterface,
+			fmt.Sprintf("CLASS_ID=%d", m.classID),
+		)
+	}
+
 	return m.runner.Run(&exec.Cmd{
 		Path: path.Join(m.containerPath, "net_rate.sh"),
-		Env: []string{
-			fmt.Sprintf("BURST=%d", limits.BurstRateInBytesPerSecond),
-			fmt.Sprintf("RATE=%d", limits.RateInBytesPerSecond*8),
-		},
+		Env:  env,
 	})
 }
 
@@ -81,8 +192,8 @@ func (m *ContainerBandwidthManager) GetLimits() (warden.ContainerBandwidthStat,
 		inRateUnit := matches[2]
 		inBurstUnit := matches[4]
 
-		limits.InRate = convertUnits(inRate, inRateUnit) / 8
-		limits.InBurst = convertUnits(inBurst, inBurstUnit)
+		limits.InRate = convertRate(inRate, inRateUnit) / 8
+		limits.InBurst = convertSize(inBurst, inBurstUnit)
 	}
 
 	ingressOut := new(bytes.Buffer)
@@ -98,12 +209,26 @@ func (m *ContainerBandwidthManager) GetLimits() (warden.ContainerBandwidthStat,
 		Stderr: ingressOut,
 	}
 
+	pattern := OUT_RATE_PATTERN
+
+	// in HTB mode egress is shaped by the container's class on the uplink
+	if m.config.Mode == ModeHTB {
+		ingress.Args = []string{"get_uplink_class_info"}
+		ingress.Env = append(
+			ingress.Env,
+			"UPLINK_IFACE="+m.config.UplinkInterface,
+			fmt.Sprintf("CLASS_ID=%d", m.classID),
+		)
+
+		pattern = CLASS_RATE_PATTERN
+	}
+
 	err = m.runner.Run(ingress)
 	if err != nil {
 		return limits, err
 	}
 
-	matches = OUT_RATE_PATTERN.FindStringSubmatch(string(ingressOut.Bytes()))
+	matches = pattern.FindStringSubmatch(string(ingressOut.Bytes()))
 	if matches != nil {
 		outRate, err := strconv.ParseUint(matches[1], 10, 0)
 		if err != nil {
@@ -118,22 +243,32 @@ func (m *ContainerBandwidthManager) GetLimits() (warden.ContainerBandwidthStat,
 		outRateUnit := matches[2]
 		outBurstUnit := matches[4]
 
-		limits.OutRate = convertUnits(outRate, outRateUnit) / 8
-		limits.OutBurst = convertUnits(outBurst, outBurstUnit)
+		limits.OutRate = convertRate(outRate, outRateUnit) / 8
+		limits.OutBurst = convertSize(outBurst, outBurstUnit)
 	}
 
 	return limits, err
 }
 
-func convertUnits(num uint64, unit string) uint64 {
+// tc prints rates in SI units of bits, e.g. 10Mbit
+func convertRate(num uint64, unit string) uint64 {
+	return num * unitMultiplier(1000, unit)
+}
+
+// tc prints sizes in binary units of bytes, e.g. 64Kb
+func convertSize(num uint64, unit string) uint64 {
+	return num * unitMultiplier(1024, unit)
+}
+
+func unitMultiplier(base uint64, unit string) uint64 {
 	switch unit {
 	case "K":
-		return num * 1024
+		return base
 	case "M":
-		return num * (1024 ^ 2)
+		return base * base
 	case "G":
-		return num * (1024 ^ 3)
+		return base * base * base
 	default:
-		return num
+		return 1
 	}
 }
@@ -18,30 +18,134 @@ var fakeRunner *fake_command_runner.FakeCommandRunner
 var bandwidthManager *bandwidth_manager.ContainerBandwidthManager
 
 var _ = Describe("setting rate limits", func() {
+	var config bandwidth_manager.Config
+
 	BeforeEach(func() {
 		fakeRunner = fake_command_runner.New()
-		bandwidthManager = bandwidth_manager.New("/depot/some-id", "some-id", fakeRunner)
+		config = bandwidth_manager.Config{Mode: bandwidth_manager.ModeTBF}
+	})
+
+	JustBeforeEach(func() {
+		bandwidthManager = bandwidth_manager.New("/depot/some-id", "some-id", config, 10000, fakeRunner)
 	})
 
 	It("executes net_rate.sh with the appropriate environment", func() {
-		limits := warden.BandwidthLimits{
+		err := bandwidthManager.SetLimits(bandwidth_manager.Limits{
+			IngressRate:  128,
+			IngressBurst: 256,
+			EgressRate:   64,
+			EgressBurst:  512,
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(fakeRunner).Should(HaveExecutedSerially(
+			fake_command_runner.CommandSpec{
+				Path: "/depot/some-id/net_rate.sh",
+				Env: []string{
+					"MODE=tbf",
+					fmt.Sprintf("INGRESS_RATE=%d", 128*8),
+					"INGRESS_BURST=256",
+					fmt.Sprintf("EGRESS_RATE=%d", 64*8),
+					"EGRESS_BURST=512",
+				},
+			},
+		))
+	})
+
+	It("applies warden's symmetric limits in both directions", func() {
+		err := bandwidthManager.SetLimits(bandwidth_manager.SymmetricLimits(warden.BandwidthLimits{
 			RateInBytesPerSecond:      128,
 			BurstRateInBytesPerSecond: 256,
-		}
-
-		err := bandwidthManager.SetLimits(limits)
+		}))
 		Ω(err).ShouldNot(HaveOccurred())
 
 		Ω(fakeRunner).Should(HaveExecutedSerially(
 			fake_command_runner.CommandSpec{
 				Path: "/depot/some-id/net_rate.sh",
 				Env: []string{
-					"BURST=256",
-					fmt.Sprintf("RATE=%d", 128*8),
+					"MODE=tbf",
+					fmt.Sprintf("INGRESS_RATE=%d", 128*8),
+					"INGRESS_BURST=256",
+					fmt.Sprintf("EGRESS_RATE=%d", 128*8),
+					"EGRESS_BURST=256",
 				},
 			},
 		))
+	})
+
+	Context("in htb mode", func() {
+		BeforeEach(func() {
+			config = bandwidth_manager.Config{
+				Mode:            bandwidth_manager.ModeHTB,
+				UplinkInterface: "eth0",
+				UplinkRate:      1000,
+			}
+		})
+
+		It("classifies the container's egress on the uplink", func() {
+			err := bandwidthManager.SetLimits(bandwidth_manager.Limits{
+				IngressRate:  128,
+				IngressBurst: 256,
+				EgressRate:   64,
+				EgressBurst:  512,
+				EgressCeil:   500,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "/depot/some-id/net_rate.sh",
+					Env: []string{
+						"MODE=htb",
+						fmt.Sprintf("INGRESS_RATE=%d", 128*8),
+						"INGRESS_BURST=256",
+						fmt.Sprintf("EGRESS_RATE=%d", 64*8),
+						"EGRESS_BURST=512",
+						fmt.Sprintf("EGRESS_CEIL=%d", 500*8),
+						"UPLINK_IFACE=eth0",
+						"CLASS_ID=10000",
+					},
+				},
+			))
+		})
 
+		It("lets egress borrow up to the uplink's rate by default", func() {
+			err := bandwidthManager.SetLimits(bandwidth_manager.Limits{
+				IngressRate:  128,
+				IngressBurst: 256,
+				EgressRate:   64,
+				EgressBurst:  512,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "/depot/some-id/net_rate.sh",
+					Env: []string{
+						"MODE=htb",
+						fmt.Sprintf("INGRESS_RATE=%d", 128*8),
+						"INGRESS_BURST=256",
+						fmt.Sprintf("EGRESS_RATE=%d", 64*8),
+						"EGRESS_BURST=512",
+						fmt.Sprintf("EGRESS_CEIL=%d", 1000*8),
+						"UPLINK_IFACE=eth0",
+						"CLASS_ID=10000",
+					},
+				},
+			))
+		})
+
+		Context("when the ceiling is below the guaranteed rate", func() {
+			It("returns an error and does not execute net_rate.sh", func() {
+				err := bandwidthManager.SetLimits(bandwidth_manager.Limits{
+					EgressRate: 64,
+					EgressCeil: 32,
+				})
+				Ω(err).Should(HaveOccurred())
+
+				Ω(fakeRunner.ExecutedCommands()).Should(BeEmpty())
+			})
+		})
 	})
 
 	Context("when net_rate.sh fails", func() {
@@ -58,19 +162,35 @@ var _ = Describe("setting rate limits", func() {
 		})
 
 		It("returns the error", func() {
-			err := bandwidthManager.SetLimits(warden.BandwidthLimits{
-				RateInBytesPerSecond:      128,
-				BurstRateInBytesPerSecond: 256,
+			err := bandwidthManager.SetLimits(bandwidth_manager.Limits{
+				IngressRate:  128,
+				IngressBurst: 256,
 			})
 			Ω(err).Should(Equal(nastyError))
 		})
 	})
 })
 
+var _ = Describe("bandwidth configuration", func() {
+	It("requires an uplink in htb mode", func() {
+		Ω(bandwidth_manager.Config{Mode: bandwidth_manager.ModeTBF}.Validate()).ShouldNot(HaveOccurred())
+		Ω(bandwidth_manager.Config{Mode: bandwidth_manager.ModeHTB}.Validate()).Should(HaveOccurred())
+		Ω(bandwidth_manager.Config{
+			Mode:            bandwidth_manager.ModeHTB,
+			UplinkInterface: "eth0",
+			UplinkRate:      1000,
+		}.Validate()).ShouldNot(HaveOccurred())
+	})
+
+	It("rejects unknown modes", func() {
+		Ω(bandwidth_manager.Config{Mode: "cbq"}.Validate()).Should(HaveOccurred())
+	})
+})
+
 var _ = Describe("getting bandwidth limits", func() {
 	BeforeEach(func() {
 		fakeRunner = fake_command_runner.New()
-		bandwidthManager = bandwidth_manager.New("/depot/some-id", "some-id", fakeRunner)
+		bandwidthManager = bandwidth_manager.New("/depot/some-id", "some-id", bandwidth_manager.Config{Mode: bandwidth_manager.ModeTBF}, 10000, fakeRunner)
 	})
 
 	It("executes net.sh get_egress_info and get_ingress_info", func() {
@@ -110,6 +230,84 @@ ref 1 bind 1
 		Ω(usage.OutBurst).Should(Equal(uint64(65536)))
 	})
 
+	It("converts tc's SI rates and binary sizes", func() {
+		fakeRunner.WhenRunning(fake_command_runner.CommandSpec{
+			Path: "/depot/some-id/net.sh",
+			Args: []string{"get_egress_info"},
+			Env:  []string{"ID=some-id"},
+		}, func(cmd *exec.Cmd) error {
+			cmd.Stdout.Write([]byte(`qdisc tbf 8010: root refcnt 2 rate 10Mbit burst 2Mb lat 24.4ms
+`))
+			return nil
+		})
+
+		fakeRunner.WhenRunning(fake_command_runner.CommandSpec{
+			Path: "/depot/some-id/net.sh",
+			Args: []string{"get_ingress_info"},
+			Env:  []string{"ID=some-id"},
+		}, func(cmd *exec.Cmd) error {
+			cmd.Stdout.Write([]byte(` police 0x10 rate 2Gbit burst 1Gb mtu 2Kb action drop overhead 0b
+`))
+			return nil
+		})
+
+		usage, err := bandwidthManager.GetLimits()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(usage.InRate).Should(Equal(uint64(1250000)))
+		Ω(usage.InBurst).Should(Equal(uint64(2 * 1024 * 1024)))
+
+		Ω(usage.OutRate).Should(Equal(uint64(250000000)))
+		Ω(usage.OutBurst).Should(Equal(uint64(1024 * 1024 * 1024)))
+	})
+
+	Context("in htb mode", func() {
+		BeforeEach(func() {
+			bandwidthManager = bandwidth_manager.New(
+				"/depot/some-id",
+				"some-id",
+				bandwidth_manager.Config{
+					Mode:            bandwidth_manager.ModeHTB,
+					UplinkInterface: "eth0",
+					UplinkRate:      1000,
+				},
+				10000,
+				fakeRunner,
+			)
+		})
+
+		It("reports egress from the container's class on the uplink", func() {
+			fakeRunner.WhenRunning(fake_command_runner.CommandSpec{
+				Path: "/depot/some-id/net.sh",
+				Args: []string{"get_egress_info"},
+				Env:  []string{"ID=some-id"},
+			}, func(cmd *exec.Cmd) error {
+				cmd.Stdout.Write([]byte(`qdisc tbf 8010: root refcnt 2 rate 8192bit burst 64Kb lat 24.4ms
+`))
+				return nil
+			})
+
+			fakeRunner.WhenRunning(fake_command_runner.CommandSpec{
+				Path: "/depot/some-id/net.sh",
+				Args: []string{"get_uplink_class_info"},
+				Env:  []string{"ID=some-id", "UPLINK_IFACE=eth0", "CLASS_ID=10000"},
+			}, func(cmd *exec.Cmd) error {
+				cmd.Stdout.Write([]byte(`class htb 1:2710 parent 1:1 prio 0 rate 4096bit ceil 8000bit burst 1600b cburst 1600b
+`))
+				return nil
+			})
+
+			usage, err := bandwidthManager.GetLimits()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(usage.InRate).Should(Equal(uint64(1024)))
+			Ω(usage.InBurst).Should(Equal(uint64(65536)))
+
+			Ω(usage.OutRate).Should(Equal(uint64(512)))
+			Ω(usage.OutBurst).Should(Equal(uint64(1600)))
+		})
+	})
+
 	Context("when net.sh get_egress_info fails", func() {
 		disaster := errors.New("oh no!")
 
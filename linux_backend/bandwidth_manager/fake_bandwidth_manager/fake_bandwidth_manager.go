@@ -2,11 +2,13 @@ package fake_bandwidth_manager
 
 import (
 	"github.com/cloudfoundry-incubator/garden/warden"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
 )
 
 type FakeBandwidthManager struct {
 	SetLimitsError error
-	EnforcedLimits []warden.BandwidthLimits
+	EnforcedLimits []bandwidth_manager.Limits
 
 	GetLimitsError  error
 	GetLimitsResult warden.ContainerBandwidthStat
@@ -16,7 +18,7 @@ func New() *FakeBandwidthManager {
 	return &FakeBandwidthManager{}
 }
 
-func (m *FakeBandwidthManager) SetLimits(limits warden.BandwidthLimits) error {
+func (m *FakeBandwidthManager) SetLimits(limits bandwidth_manager.Limits) error {
 	if m.SetLimitsError != nil {
 		return m.SetLimitsError
 	}
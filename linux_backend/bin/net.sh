@@ -8,20 +8,39 @@ shopt -s nullglob
 filter_forward_chain="${WARDEN_IPTABLES_FILTER_FORWARD_CHAIN}"
 filter_default_chain="${WARDEN_IPTABLES_FILTER_DEFAULT_CHAIN}"
 filter_instance_prefix="${WARDEN_IPTABLES_FILTER_INSTANCE_PREFIX}"
+filter_group_prefix="${WARDEN_IPTABLES_FILTER_GROUP_PREFIX}"
+filter_accounting_prefix="${WARDEN_IPTABLES_FILTER_ACCOUNTING_PREFIX}"
 nat_prerouting_chain="${WARDEN_IPTABLES_NAT_PREROUTING_CHAIN}"
 nat_postrouting_chain="${WARDEN_IPTABLES_NAT_POSTROUTING_CHAIN}"
 nat_instance_prefix="${WARDEN_IPTABLES_NAT_INSTANCE_PREFIX}"
 interface_name_prefix="${WARDEN_NETWORK_INTERFACE_PREFIX}"
 
-# Default ALLOW_NETWORKS/DENY_NETWORKS to empty
+# Default ALLOW_NETWORKS/DENY_NETWORKS/POOL_NETWORK_IPV6 to empty
 ALLOW_NETWORKS=${ALLOW_NETWORKS:-}
 DENY_NETWORKS=${DENY_NETWORKS:-}
+POOL_NETWORK_IPV6=${POOL_NETWORK_IPV6:-}
+
+# Default DENY_ACTION to drop
+DENY_ACTION=${DENY_ACTION:-drop}
+
+# Default BANDWIDTH_MODE to tbf
+BANDWIDTH_MODE=${BANDWIDTH_MODE:-tbf}
 
 function external_ip() {
   # The ';tx;d;:x' trick deletes non-matching lines
   ip route get 8.8.8.8 | sed 's/.*src\s\(.*\)\s/\1/;tx;d;:x'
 }
 
+# Whether the given network belongs to the address family handled by the
+# given iptables binary
+function same_family() {
+  if [ "${1}" == "ip6tables" ]; then
+    [[ "${2}" == *:* ]]
+  else
+    [[ "${2}" != *:* ]]
+  fi
+}
+
 function teardown_deprecated_rules() {
   # Remove jump to warden-dispatch from INPUT
   iptables -w -S INPUT 2> /dev/null |
@@ -43,48 +62,78 @@ function teardown_deprecated_rules() {
 }
 
 function teardown_filter() {
-  teardown_deprecated_rules
+  local iptables=${1}
+
+  if [ "${iptables}" == "iptables" ]; then
+    teardown_deprecated_rules
+  fi
 
   # Prune warden-forward chain
-  iptables -w -S ${filter_forward_chain} 2> /dev/null |
-    grep "\-g ${filter_instance_prefix}" |
+  ${iptables} -w -S ${filter_forward_chain} 2> /dev/null |
+    grep -e "\-g ${filter_instance_prefix}" -e "\-j ${filter_accounting_prefix}" |
     sed -e "s/-A/-D/" -e "s/\s\+\$//" |
-    xargs --no-run-if-empty --max-lines=1 iptables -w
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
 
   # Prune per-instance chains
-  iptables -w -S 2> /dev/null |
+  ${iptables} -w -S 2> /dev/null |
     grep "^-A ${filter_instance_prefix}" |
     sed -e "s/-A/-D/" -e "s/\s\+\$//" |
-    xargs --no-run-if-empty --max-lines=1 iptables -w
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
 
   # Delete per-instance chains
-  iptables -w -S 2> /dev/null |
+  ${iptables} -w -S 2> /dev/null |
     grep "^-N ${filter_instance_prefix}" |
     sed -e "s/-N/-X/" -e "s/\s\+\$//" |
-    xargs --no-run-if-empty --max-lines=1 iptables -w
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
+
+  # Prune per-group chains
+  ${iptables} -w -S 2> /dev/null |
+    grep "^-A ${filter_group_prefix}" |
+    sed -e "s/-A/-D/" -e "s/\s\+\$//" |
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
+
+  # Delete per-group chains
+  ${iptables} -w -S 2> /dev/null |
+    grep "^-N ${filter_group_prefix}" |
+    sed -e "s/-N/-X/" -e "s/\s\+\$//" |
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
+
+  # Prune per-instance accounting chains
+  ${iptables} -w -S 2> /dev/null |
+    grep "^-A ${filter_accounting_prefix}" |
+    sed -e "s/-A/-D/" -e "s/\s\+\$//" |
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
+
+  # Delete per-instance accounting chains
+  ${iptables} -w -S 2> /dev/null |
+    grep "^-N ${filter_accounting_prefix}" |
+    sed -e "s/-N/-X/" -e "s/\s\+\$//" |
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
 
   # Remove jump to warden-forward from FORWARD
-  iptables -w -S FORWARD 2> /dev/null |
+  ${iptables} -w -S FORWARD 2> /dev/null |
     grep " -j ${filter_forward_chain}" |
     sed -e "s/-A/-D/" -e "s/\s\+\$//" |
-    xargs --no-run-if-empty --max-lines=1 iptables -w
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w
 
-  iptables -w -F ${filter_forward_chain} 2> /dev/null || true
-  iptables -w -F ${filter_default_chain} 2> /dev/null || true
+  ${iptables} -w -F ${filter_forward_chain} 2> /dev/null || true
+  ${iptables} -w -F ${filter_default_chain} 2> /dev/null || true
 }
 
 function setup_filter() {
-  teardown_filter
+  local iptables=${1}
+
+  teardown_filter ${iptables}
 
   # Create or flush forward chain
-  iptables -w -N ${filter_forward_chain} 2> /dev/null || iptables -w -F ${filter_forward_chain}
-  iptables -w -A ${filter_forward_chain} -j DROP
+  ${iptables} -w -N ${filter_forward_chain} 2> /dev/null || ${iptables} -w -F ${filter_forward_chain}
+  ${iptables} -w -A ${filter_forward_chain} -j DROP
 
   # Create or flush default chain
-  iptables -w -N ${filter_default_chain} 2> /dev/null || iptables -w -F ${filter_default_chain}
+  ${iptables} -w -N ${filter_default_chain} 2> /dev/null || ${iptables} -w -F ${filter_default_chain}
 
   # Always allow established connections to warden containers
-  iptables -w -A ${filter_default_chain} -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+  ${iptables} -w -A ${filter_default_chain} -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
 
   for n in ${ALLOW_NETWORKS}; do
     if [ "$n" == "" ]
@@ -92,7 +141,12 @@ function setup_filter() {
       break
     fi
 
-    iptables -w -A ${filter_default_chain} --destination "$n" --jump RETURN
+    if ! same_family ${iptables} "$n"
+    then
+      continue
+    fi
+
+    ${iptables} -w -A ${filter_default_chain} --destination "$n" --jump RETURN
   done
 
   for n in ${DENY_NETWORKS}; do
@@ -101,87 +155,157 @@ function setup_filter() {
       break
     fi
 
-    iptables -w -A ${filter_default_chain} --destination "$n" --jump DROP
+    if ! same_family ${iptables} "$n"
+    then
+      continue
+    fi
+
+    if [ "${DENY_ACTION}" == "reject" ]; then
+      if [ "${iptables}" == "ip6tables" ]; then
+        unreachable=icmp6-port-unreachable
+      else
+        unreachable=icmp-port-unreachable
+      fi
+
+      ${iptables} -w -A ${filter_default_chain} --destination "$n" --protocol tcp --jump REJECT --reject-with tcp-reset
+      ${iptables} -w -A ${filter_default_chain} --destination "$n" --jump REJECT --reject-with ${unreachable}
+    else
+      ${iptables} -w -A ${filter_default_chain} --destination "$n" --jump DROP
+    fi
   done
 
   # Forward outbound traffic via ${filter_forward_chain}
-  iptables -w -A FORWARD -i ${WARDEN_NETWORK_INTERFACE_PREFIX}+ --jump ${filter_forward_chain}
+  ${iptables} -w -A FORWARD -i ${WARDEN_NETWORK_INTERFACE_PREFIX}+ --jump ${filter_forward_chain}
 
   # Forward inbound traffic immediately
-  default_interface=$(ip route show | grep default | cut -d' ' -f5 | head -1)
-  iptables -w -I ${filter_forward_chain} -i $default_interface --jump ACCEPT
+  if [ "${iptables}" == "ip6tables" ]; then
+    default_interface=$(ip -6 route show | grep default | cut -d' ' -f5 | head -1)
+  else
+    default_interface=$(ip route show | grep default | cut -d' ' -f5 | head -1)
+  fi
+
+  ${iptables} -w -I ${filter_forward_chain} -i $default_interface --jump ACCEPT
 }
 
 function teardown_nat() {
+  local iptables=${1}
+
   # Prune prerouting chain
-  iptables -w -t nat -S ${nat_prerouting_chain} 2> /dev/null |
+  ${iptables} -w -t nat -S ${nat_prerouting_chain} 2> /dev/null |
     grep "\-j ${nat_instance_prefix}" |
     sed -e "s/-A/-D/" -e "s/\s\+\$//" |
-    xargs --no-run-if-empty --max-lines=1 iptables -w -t nat
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w -t nat
 
   # Prune per-instance chains
-  iptables -w -t nat -S 2> /dev/null |
+  ${iptables} -w -t nat -S 2> /dev/null |
     grep "^-A ${nat_instance_prefix}" |
     sed -e "s/-A/-D/" -e "s/\s\+\$//" |
-    xargs --no-run-if-empty --max-lines=1 iptables -w -t nat
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w -t nat
 
   # Delete per-instance chains
-  iptables -w -t nat -S 2> /dev/null |
+  ${iptables} -w -t nat -S 2> /dev/null |
     grep "^-N ${nat_instance_prefix}" |
     sed -e "s/-N/-X/" -e "s/\s\+\$//" |
-    xargs --no-run-if-empty --max-lines=1 iptables -w -t nat
+    xargs --no-run-if-empty --max-lines=1 ${iptables} -w -t nat
 
   # Flush prerouting chain
-  iptables -w -t nat -F ${nat_prerouting_chain} 2> /dev/null || true
+  ${iptables} -w -t nat -F ${nat_prerouting_chain} 2> /dev/null || true
 
   # Flush postrouting chain
-  iptables -w -t nat -F ${nat_postrouting_chain} 2> /dev/null || true
+  ${iptables} -w -t nat -F ${nat_postrouting_chain} 2> /dev/null || true
 }
 
 function setup_nat() {
-  teardown_nat
+  local iptables=${1}
+
+  teardown_nat ${iptables}
 
   # Create prerouting chain
-  iptables -w -t nat -N ${nat_prerouting_chain} 2> /dev/null || true
+  ${iptables} -w -t nat -N ${nat_prerouting_chain} 2> /dev/null || true
 
   # Bind chain to PREROUTING
-  (iptables -w -t nat -S PREROUTING | grep -q "\-j ${nat_prerouting_chain}\b") ||
-    iptables -w -t nat -A PREROUTING \
+  (${iptables} -w -t nat -S PREROUTING | grep -q "\-j ${nat_prerouting_chain}\b") ||
+    ${iptables} -w -t nat -A PREROUTING \
       --jump ${nat_prerouting_chain}
 
   # Bind chain to OUTPUT (for traffic originating from same host)
-  (iptables -w -t nat -S OUTPUT | grep -q "\-j ${nat_prerouting_chain}\b") ||
-    iptables -w -t nat -A OUTPUT \
+  (${iptables} -w -t nat -S OUTPUT | grep -q "\-j ${nat_prerouting_chain}\b") ||
+    ${iptables} -w -t nat -A OUTPUT \
       --out-interface "lo" \
       --jump ${nat_prerouting_chain}
 
   # Create postrouting chain
-  iptables -w -t nat -N ${nat_postrouting_chain} 2> /dev/null || true
+  ${iptables} -w -t nat -N ${nat_postrouting_chain} 2> /dev/null || true
 
   # Bind chain to POSTROUTING
-  (iptables -w -t nat -S POSTROUTING | grep -q "\-j ${nat_postrouting_chain}\b") ||
-    iptables -w -t nat -A POSTROUTING \
+  (${iptables} -w -t nat -S POSTROUTING | grep -q "\-j ${nat_postrouting_chain}\b") ||
+    ${iptables} -w -t nat -A POSTROUTING \
       --jump ${nat_postrouting_chain}
 
   # Enable NAT for traffic coming from containers
-  (iptables -w -t nat -S ${nat_postrouting_chain} | grep -q "\-j SNAT\b") ||
-    iptables -w -t nat -A ${nat_postrouting_chain} \
-      --source ${POOL_NETWORK} \
-      --jump SNAT \
-      --to $(external_ip)
+  if [ "${iptables}" == "ip6tables" ]; then
+    (${iptables} -w -t nat -S ${nat_postrouting_chain} | grep -q "\-j MASQUERADE\b") ||
+      ${iptables} -w -t nat -A ${nat_postrouting_chain} \
+        --source ${POOL_NETWORK_IPV6} \
+        --jump MASQUERADE
+  else
+    local snat_ip=${EXTERNAL_IP:-$(external_ip)}
+
+    # Without an external IP, e.g. with no default route, use the address of
+    # whichever interface the traffic leaves from
+    if [ -z "${snat_ip}" ]; then
+      (${iptables} -w -t nat -S ${nat_postrouting_chain} | grep -q "\-j \(SNAT\|MASQUERADE\)\b") ||
+        ${iptables} -w -t nat -A ${nat_postrouting_chain} \
+          --source ${POOL_NETWORK} \
+          --jump MASQUERADE
+    else
+      (${iptables} -w -t nat -S ${nat_postrouting_chain} | grep -q "\-j \(SNAT\|MASQUERADE\)\b") ||
+        ${iptables} -w -t nat -A ${nat_postrouting_chain} \
+          --source ${POOL_NETWORK} \
+          --jump SNAT \
+          --to ${snat_ip}
+    fi
+  fi
+}
+
+# In htb mode, containers' egress is shaped in classes of the uplink's root
+# class, so that each gets a guaranteed rate and may borrow what the others
+# do not use
+function setup_uplink() {
+  tc qdisc replace dev ${UPLINK_IFACE} root handle 1: htb default ffff
+  tc class replace dev ${UPLINK_IFACE} parent 1: classid 1:1 htb rate ${UPLINK_RATE}bit
+
+  # unclassified traffic, i.e. the host's own, is guaranteed a tenth
+  tc class replace dev ${UPLINK_IFACE} parent 1:1 classid 1:ffff htb rate $((UPLINK_RATE / 10))bit ceil ${UPLINK_RATE}bit
 }
 
 case "${1}" in
   setup)
-    setup_filter
-    setup_nat
+    setup_filter iptables
+    setup_nat iptables
 
     # Enable forwarding
     echo 1 > /proc/sys/net/ipv4/ip_forward
+
+    if [ -n "${POOL_NETWORK_IPV6}" ]; then
+      setup_filter ip6tables
+      setup_nat ip6tables
+
+      echo 1 > /proc/sys/net/ipv6/conf/all/forwarding
+    fi
+
+    if [ "${BANDWIDTH_MODE}" == "htb" ]; then
+      setup_uplink
+    fi
     ;;
   teardown)
-    teardown_filter
-    teardown_nat
+    teardown_filter iptables
+    teardown_nat iptables
+
+    if [ -n "${POOL_NETWORK_IPV6}" ]; then
+      teardown_filter ip6tables
+      teardown_nat ip6tables
+    fi
     ;;
   *)
     echo "Unknown command: ${1}" 1>&2
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
@@ -22,6 +23,8 @@ import (
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/cgroups_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/container_pool/rootfs_provider"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/quota_manager"
@@ -31,6 +34,43 @@ import (
 
 var ErrUnknownRootFSProvider = errors.New("unknown rootfs provider")
 
+// setting this property to "true" logs the container's connections that are
+// denied by -denyNetworks, and reports them as events
+const LogDeniedEgressProperty = "network.log_denied_egress"
+
+// setting this property to "drop" or "reject" overrides the server's action
+// for the container's new connections to -denyNetworks
+const DenyActionProperty = "network.deny_action"
+
+// containers with the same value for this property can reach each other
+// directly on their container IPs
+const NetworkGroupProperty = "network.group"
+
+// these properties override the server's DNS configuration for a container;
+// each is a comma-separated list, with extra hosts given as hostname:ip
+const (
+	DNSServersProperty = "network.dns_servers"
+	DNSSearchProperty  = "network.dns_search"
+	ExtraHostsProperty = "network.extra_hosts"
+)
+
+// this property overrides the server's MTU for a container's interfaces
+const MTUProperty = "network.mtu"
+
+// the accounting buckets that traffic is counted in when none are configured
+const (
+	AllowedBucket = "allowed"
+	DeniedBucket  = "denied"
+)
+
+type InvalidNetworkSpecError struct {
+	Spec string
+}
+
+func (e InvalidNetworkSpecError) Error() string {
+	return fmt.Sprintf("invalid network (must be a subnet or a container IP): %s", e.Spec)
+}
+
 type LinuxContainerPool struct {
 	binPath   string
 	depotPath string
@@ -39,14 +79,29 @@ type LinuxContainerPool struct {
 
 	denyNetworks  []string
 	allowNetworks []string
+	denyAction    network_manager.DenyAction
+
+	externalIP net.IP
+
+	dnsConfig linux_backend.DNSConfig
+	mtu       uint32
+
+	bandwidthConfig bandwidth_manager.Config
+
+	accountingBuckets []network_manager.AccountingBucket
+
+	processConfig process_tracker.Config
 
 	rootfsProviders map[string]rootfs_provider.RootFSProvider
 
-	uidPool     uid_pool.UIDPool
-	networkPool network_pool.NetworkPool
-	portPool    linux_backend.PortPool
+	uidPool         uid_pool.UIDPool
+	networkPool     network_pool.NetworkPool
+	ipv6NetworkPool network_pool.NetworkPool
+	portPool        linux_backend.PortPool
 
 	runner command_runner.CommandRunner
+	links  network_manager.Links
+	groups *network_manager.NetworkGroups
 
 	quotaManager quota_manager.QuotaManager
 
@@ -59,9 +114,18 @@ func New(
 	rootfsProviders map[string]rootfs_provider.RootFSProvider,
 	uidPool uid_pool.UIDPool,
 	networkPool network_pool.NetworkPool,
+	ipv6NetworkPool network_pool.NetworkPool,
 	portPool linux_backend.PortPool,
 	denyNetworks, allowNetworks []string,
+	denyAction network_manager.DenyAction,
+	externalIP net.IP,
+	dnsConfig linux_backend.DNSConfig,
+	mtu uint32,
+	bandwidthConfig bandwidth_manager.Config,
+	accountingBuckets []network_manager.AccountingBucket,
+	processConfig process_tracker.Config,
 	runner command_runner.CommandRunner,
+	links network_manager.Links,
 	quotaManager quota_manager.QuotaManager,
 ) *LinuxContainerPool {
 	pool := &LinuxContainerPool{
@@ -74,12 +138,27 @@ func New(
 
 		allowNetworks: allowNetworks,
 		denyNetworks:  denyNetworks,
+		denyAction:    denyAction,
+
+		externalIP: externalIP,
+
+		dnsConfig: dnsConfig,
+		mtu:       mtu,
 
-		uidPool:     uidPool,
-		networkPool: networkPool,
-		portPool:    portPool,
+		bandwidthConfig: bandwidthConfig,
+
+		accountingBuckets: accountingBuckets,
+
+		processConfig: processConfig,
+
+		uidPool:         uidPool,
+		networkPool:     networkPool,
+		ipv6NetworkPool: ipv6NetworkPool,
+		portPool:        portPool,
 
 		runner: runner,
+		links:  links,
+		groups: network_manager.NewGroups(sysconfig, ipv6NetworkPool != nil, runner),
 
 		quotaManager: quotaManager,
 
@@ -94,6 +173,9 @@ func New(
 func (p *LinuxContainerPool) MaxContainers() int {
 	maxNet := p.networkPool.InitialSize()
 	maxUid := p.uidPool.InitialSize()
+	if p.ipv6NetworkPool != nil && p.ipv6NetworkPool.InitialSize() < maxNet {
+		maxNet = p.ipv6NetworkPool.InitialSize()
+	}
 	if maxNet < maxUid {
 		return maxNet
 	}
@@ -101,19 +183,35 @@ func (p *LinuxContainerPool) MaxContainers() int {
 }
 
 func (p *LinuxContainerPool) Setup() error {
+	ipv6PoolNetwork := ""
+	if p.ipv6NetworkPool != nil {
+		ipv6PoolNetwork = p.ipv6NetworkPool.Network().String()
+	}
+
+	// net.sh determines it itself if it can
+	externalIP := ""
+	if p.externalIP != nil {
+		externalIP = p.externalIP.String()
+	}
+
 	setup := &exec.Cmd{
 		Path: path.Join(p.binPath, "setup.sh"),
 		Env: []string{
 			"POOL_NETWORK=" + p.networkPool.Network().String(),
+			"POOL_NETWORK_IPV6=" + ipv6PoolNetwork,
 			"DENY_NETWORKS=" + formatNetworks(p.denyNetworks),
 			"ALLOW_NETWORKS=" + formatNetworks(p.allowNetworks),
+			"DENY_ACTION=" + string(p.denyAction),
+			"EXTERNAL_IP=" + externalIP,
 			"CONTAINER_DEPOT_PATH=" + p.depotPath,
 			"CONTAINER_DEPOT_MOUNT_POINT_PATH=" + p.quotaManager.MountPoint(),
 			fmt.Sprintf("DISK_QUOTA_ENABLED=%v", p.quotaManager.IsEnabled()),
-			"PATH=" + os.Getenv("PATH"),
 		},
 	}
 
+	setup.Env = append(setup.Env, p.bandwidthConfig.Environ()...)
+	setup.Env = append(setup.Env, "PATH="+os.Getenv("PATH"))
+
 	err := p.runner.Run(setup)
 	if err != nil {
 		return err
@@ -134,7 +232,7 @@ func (p *LinuxContainerPool) Prune(keep map[string]bool) error {
 
 	for _, entry := range entries {
 		id := entry.Name()
-		if id == "tmp" {
+		if id == "tmp" || !entry.IsDir() {
 			continue
 		}
 
@@ -155,24 +253,67 @@ func (p *LinuxContainerPool) Prune(keep map[string]bool) error {
 }
 
 func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Container, error) {
+	if action, found := spec.Properties[DenyActionProperty]; found {
+		err := network_manager.DenyAction(action).Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dnsConfig, err := p.containerDNSConfig(spec.Properties)
+	if err != nil {
+		return nil, err
+	}
+
+	mtu, err := p.containerMTU(spec.Properties)
+	if err != nil {
+		return nil, err
+	}
+
 	uid, err := p.uidPool.Acquire()
 	if err != nil {
 		return nil, err
 	}
 
-	network, err := p.networkPool.Acquire()
+	var ipv6Network *network.Network
+
+	network, err := p.acquireNetwork(spec.Network)
 	if err != nil {
 		p.uidPool.Release(uid)
 		return nil, err
 	}
 
+	if p.ipv6NetworkPool != nil {
+		ipv6Network, err = p.ipv6NetworkPool.Acquire()
+		if err != nil {
+			p.uidPool.Release(uid)
+			p.networkPool.Release(network)
+			return nil, err
+		}
+	}
+
 	id := <-p.containerIDs
 
 	containerPath := path.Join(p.depotPath, id)
 
 	cgroupsManager := cgroups_manager.New(p.sysconfig.CgroupPath, id)
 
-	bandwidthManager := bandwidth_manager.New(containerPath, id, p.runner)
+	// UIDs are unique among containers, so they double as uplink class IDs
+	bandwidthManager := bandwidth_manager.New(containerPath, id, p.bandwidthConfig, uid, p.runner)
+
+	networkManager := network_manager.New(
+		p.sysconfig,
+		id,
+		network,
+		ipv6Network,
+		p.externalIP,
+		p.networkPolicy(spec.Properties),
+		p.groups,
+		p.links,
+		p.runner,
+	)
+
+	hostIface, containerIface := network_manager.InterfaceNames(p.sysconfig.NetworkInterfacePrefix, id)
 
 	handle := id
 	if spec.Handle != "" {
@@ -200,13 +341,16 @@ func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Co
 		containerPath,
 		spec.Properties,
 		spec.GraceTime,
-		linux_backend.NewResources(uid, network, []uint32{}),
+		dnsConfig,
+		mtu,
+		linux_backend.NewResources(uid, network, ipv6Network, []uint32{}),
 		p.portPool,
 		p.runner,
 		cgroupsManager,
 		p.quotaManager,
 		bandwidthManager,
-		process_tracker.New(containerPath, p.runner),
+		networkManager,
+		process_tracker.New(containerPath, p.runner, p.processConfig),
 	)
 
 	create := &exec.Cmd{
@@ -216,17 +360,32 @@ func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Co
 			"id=" + container.ID(),
 			"rootfs_path=" + rootfsPath,
 			fmt.Sprintf("user_uid=%d", uid),
+			"network_host_iface=" + hostIface,
+			"network_container_iface=" + containerIface,
 			fmt.Sprintf("network_host_ip=%s", network.HostIP()),
 			fmt.Sprintf("network_container_ip=%s", network.ContainerIP()),
-
-			"PATH=" + os.Getenv("PATH"),
+			fmt.Sprintf("network_prefix_length=%d", network.PrefixLength()),
 		},
 	}
 
+	if ipv6Network != nil {
+		create.Env = append(
+			create.Env,
+			fmt.Sprintf("network_host_ipv6=%s", ipv6Network.HostIP()),
+			fmt.Sprintf("network_container_ipv6=%s", ipv6Network.ContainerIP()),
+			fmt.Sprintf("network_ipv6_prefix_length=%d", ipv6Network.PrefixLength()),
+		)
+	}
+
+	create.Env = append(create.Env, dnsConfig.Environ()...)
+
+	create.Env = append(create.Env, "PATH="+os.Getenv("PATH"))
+
 	err = p.runner.Run(create)
 	if err != nil {
 		p.uidPool.Release(uid)
 		p.networkPool.Release(network)
+		p.releaseIPv6Network(ipv6Network)
 		return nil, err
 	}
 
@@ -255,6 +414,11 @@ func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Containe
 
 	log.Println("restoring", id)
 
+	// snapshots from before the MTU was configurable have none
+	if containerSnapshot.MTU == 0 {
+		containerSnapshot.MTU = p.mtu
+	}
+
 	resources := containerSnapshot.Resources
 
 	err = p.uidPool.Remove(resources.UID)
@@ -268,11 +432,21 @@ func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Containe
 		return nil, err
 	}
 
+	if resources.IPv6Network != nil && p.ipv6NetworkPool != nil {
+		err = p.ipv6NetworkPool.Remove(resources.IPv6Network)
+		if err != nil {
+			p.uidPool.Release(resources.UID)
+			p.networkPool.Release(resources.Network)
+			return nil, err
+		}
+	}
+
 	for _, port := range resources.Ports {
 		err = p.portPool.Remove(port)
 		if err != nil {
 			p.uidPool.Release(resources.UID)
 			p.networkPool.Release(resources.Network)
+			p.releaseIPv6Network(resources.IPv6Network)
 
 			for _, port := range resources.Ports {
 				p.portPool.Release(port)
@@ -286,7 +460,19 @@ func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Containe
 
 	cgroupsManager := cgroups_manager.New(p.sysconfig.CgroupPath, id)
 
-	bandwidthManager := bandwidth_manager.New(containerPath, id, p.runner)
+	bandwidthManager := bandwidth_manager.New(containerPath, id, p.bandwidthConfig, resources.UID, p.runner)
+
+	networkManager := network_manager.New(
+		p.sysconfig,
+		id,
+		resources.Network,
+		resources.IPv6Network,
+		p.externalIP,
+		p.networkPolicy(containerSnapshot.Properties),
+		p.groups,
+		p.links,
+		p.runner,
+	)
 
 	container := linux_backend.NewLinuxContainer(
 		id,
@@ -294,9 +480,12 @@ func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Containe
 		containerPath,
 		containerSnapshot.Properties,
 		containerSnapshot.GraceTime,
+		containerSnapshot.DNS,
+		containerSnapshot.MTU,
 		linux_backend.NewResources(
 			resources.UID,
 			resources.Network,
+			resources.IPv6Network,
 			resources.Ports,
 		),
 		p.portPool,
@@ -304,7 +493,8 @@ func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Containe
 		cgroupsManager,
 		p.quotaManager,
 		bandwidthManager,
-		process_tracker.New(containerPath, p.runner),
+		networkManager,
+		process_tracker.New(containerPath, p.runner, p.processConfig),
 	)
 
 	err = container.Restore(containerSnapshot)
@@ -323,6 +513,8 @@ func (p *LinuxContainerPool) Destroy(container linux_backend.Container) error {
 
 	linuxContainer := container.(*linux_backend.LinuxContainer)
 
+	linuxContainer.Cleanup()
+
 	resources := linuxContainer.Resources()
 
 	for _, port := range resources.Ports {
@@ -333,9 +525,101 @@ func (p *LinuxContainerPool) Destroy(container linux_backend.Container) error {
 
 	p.networkPool.Release(resources.Network)
 
+	p.releaseIPv6Network(resources.IPv6Network)
+
 	return nil
 }
 
+func (p *LinuxContainerPool) networkPolicy(properties warden.Properties) network_manager.Policy {
+	return network_manager.Policy{
+		AllowNetworks: p.allowNetworks,
+		DenyNetworks:  p.denyNetworks,
+
+		LogDenied:  properties[LogDeniedEgressProperty] == "true",
+		DenyAction: network_manager.DenyAction(properties[DenyActionProperty]),
+
+		Group: properties[NetworkGroupProperty],
+
+		Buckets: p.buckets(),
+	}
+}
+
+// buckets are the configured accounting buckets, or else the allowed and
+// denied networks
+func (p *LinuxContainerPool) buckets() []network_manager.AccountingBucket {
+	if len(p.accountingBuckets) > 0 {
+		return p.accountingBuckets
+	}
+
+	buckets := []network_manager.AccountingBucket{}
+
+	defaults := []network_manager.AccountingBucket{
+		{Name: AllowedBucket, Networks: p.allowNetworks},
+		{Name: DeniedBucket, Networks: p.denyNetworks},
+	}
+
+	for _, bucket := range defaults {
+		networks := []string{}
+		for _, network := range bucket.Networks {
+			if network != "" {
+				networks = append(networks, network)
+			}
+		}
+
+		if len(networks) > 0 {
+			buckets = append(buckets, network_manager.AccountingBucket{Name: bucket.Name, Networks: networks})
+		}
+	}
+
+	return buckets
+}
+
+// containerDNSConfig is the server's DNS configuration, with any of its
+// settings that the container's properties override replaced
+func (p *LinuxContainerPool) containerDNSConfig(properties warden.Properties) (linux_backend.DNSConfig, error) {
+	dnsConfig := p.dnsConfig
+
+	if servers, found := properties[DNSServersProperty]; found {
+		dnsConfig.Nameservers = linux_backend.SplitList(servers)
+	}
+
+	if search, found := properties[DNSSearchProperty]; found {
+		dnsConfig.Search = linux_backend.SplitList(search)
+	}
+
+	if hosts, found := properties[ExtraHostsProperty]; found {
+		extraHosts, err := linux_backend.ParseHostEntries(linux_backend.SplitList(hosts))
+		if err != nil {
+			return linux_backend.DNSConfig{}, err
+		}
+
+		dnsConfig.ExtraHosts = extraHosts
+	}
+
+	return dnsConfig, dnsConfig.Validate()
+}
+
+func (p *LinuxContainerPool) containerMTU(properties warden.Properties) (uint32, error) {
+	value, found := properties[MTUProperty]
+	if !found {
+		return p.mtu, nil
+	}
+
+	// 68 is the minimum MTU for IPv4
+	mtu, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || mtu < 68 || mtu > 65535 {
+		return 0, fmt.Errorf("invalid MTU (must be between 68 and 65535): %s", value)
+	}
+
+	return uint32(mtu), nil
+}
+
+func (p *LinuxContainerPool) releaseIPv6Network(ipv6Network *network.Network) {
+	if ipv6Network != nil && p.ipv6NetworkPool != nil {
+		p.ipv6NetworkPool.Release(ipv6Network)
+	}
+}
+
 func (p *LinuxContainerPool) destroy(id string) error {
 	rootfsProvider, err := ioutil.ReadFile(path.Join(p.depotPath, id, "rootfs-provider"))
 	if err != nil {
@@ -347,6 +631,25 @@ func (p *LinuxContainerPool) destroy(id string) error {
 		return ErrUnknownRootFSProvider
 	}
 
+	// the container's networks are not needed to find its chains and
+	// interfaces by its ID
+	networkManager := network_manager.New(
+		p.sysconfig,
+		id,
+		nil,
+		nil,
+		p.externalIP,
+		network_manager.Policy{},
+		p.groups,
+		p.links,
+		p.runner,
+	)
+
+	err = networkManager.Destroy()
+	if err != nil {
+		return err
+	}
+
 	destroy := &exec.Cmd{
 		Path: path.Join(p.binPath, "destroy.sh"),
 		Args: []string{path.Join(p.depotPath, id)},
@@ -360,6 +663,60 @@ func (p *LinuxContainerPool) destroy(id string) error {
 	return provider.CleanupRootFS(id)
 }
 
+func (p *LinuxContainerPool) acquireNetwork(spec string) (*network.Network, error) {
+	if spec == "" {
+		return p.networkPool.Acquire()
+	}
+
+	ipNet, err := parseNetworkSpec(spec, p.networkPool.SubnetPrefixLength())
+	if err != nil {
+		return nil, err
+	}
+
+	requested := network.New(ipNet)
+
+	err = p.networkPool.Remove(requested)
+	if err != nil {
+		return nil, err
+	}
+
+	return requested, nil
+}
+
+// a network spec is either a subnet (10.254.0.4/30), which may be larger than
+// the pool's subnet size, or the container IP within one (10.254.0.6)
+func parseNetworkSpec(spec string, subnetPrefix int) (*net.IPNet, error) {
+	if strings.Contains(spec, "/") {
+		_, ipNet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, InvalidNetworkSpecError{spec}
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		if ones > subnetPrefix || bits != 32 {
+			return nil, InvalidNetworkSpecError{spec}
+		}
+
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(spec)
+	if ip == nil || ip.To4() == nil {
+		return nil, InvalidNetworkSpecError{spec}
+	}
+
+	ipNet := &net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(subnetPrefix, 32)),
+		Mask: net.CIDRMask(subnetPrefix, 32),
+	}
+
+	if !network.New(ipNet).ContainerIP().Equal(ip) {
+		return nil, InvalidNetworkSpecError{spec}
+	}
+
+	return ipNet, nil
+}
+
 func (p *LinuxContainerPool) generateContainerIDs() string {
 	for containerNum := time.Now().UnixNano(); ; containerNum++ {
 		containerID := []byte{}
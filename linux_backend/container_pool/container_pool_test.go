@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -18,12 +19,16 @@ import (
 
 	"github.com/cloudfoundry-incubator/garden/warden"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/container_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/container_pool/rootfs_provider"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/container_pool/rootfs_provider/fake_rootfs_provider"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager/fake_links"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_pool/fake_network_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/port_pool/fake_port_pool"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/quota_manager/fake_quota_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/uid_pool/fake_uid_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/sysconfig"
@@ -38,6 +43,7 @@ var _ = Describe("Container pool", func() {
 	var fakeNetworkPool *fake_network_pool.FakeNetworkPool
 	var fakeQuotaManager *fake_quota_manager.FakeQuotaManager
 	var fakePortPool *fake_port_pool.FakePortPool
+	var fakeLinks *fake_links.FakeLinks
 	var defaultFakeRootFSProvider *fake_rootfs_provider.FakeRootFSProvider
 	var fakeRootFSProvider *fake_rootfs_provider.FakeRootFSProvider
 	var pool *container_pool.LinuxContainerPool
@@ -51,6 +57,7 @@ var _ = Describe("Container pool", func() {
 		fakeRunner = fake_command_runner.New()
 		fakeQuotaManager = fake_quota_manager.New()
 		fakePortPool = fake_port_pool.New(1000)
+		fakeLinks = fake_links.New()
 		defaultFakeRootFSProvider = fake_rootfs_provider.New()
 		fakeRootFSProvider = fake_rootfs_provider.New()
 
@@ -69,10 +76,26 @@ var _ = Describe("Container pool", func() {
 			},
 			fakeUIDPool,
 			fakeNetworkPool,
+			nil,
 			fakePortPool,
 			[]string{"1.1.0.0/16", "2.2.0.0/16"},
 			[]string{"1.1.1.1/32", "2.2.2.2/32"},
+			network_manager.DenyActionDrop,
+			net.ParseIP("1.2.3.4"),
+			linux_backend.DNSConfig{
+				Nameservers: []string{"8.8.8.8"},
+				Search:      []string{"example.com"},
+			},
+			1500,
+			bandwidth_manager.Config{
+				Mode:            bandwidth_manager.ModeHTB,
+				UplinkInterface: "eth0",
+				UplinkRate:      125000000,
+			},
+			nil,
+			process_tracker.Config{},
 			fakeRunner,
+			fakeLinks,
 			fakeQuotaManager,
 		)
 	})
@@ -117,11 +140,17 @@ var _ = Describe("Container pool", func() {
 					Path: "/root/path/setup.sh",
 					Env: []string{
 						"POOL_NETWORK=1.2.0.0/20",
+						"POOL_NETWORK_IPV6=",
 						"DENY_NETWORKS=1.1.0.0/16 2.2.0.0/16",
 						"ALLOW_NETWORKS=1.1.1.1/32 2.2.2.2/32",
+						"DENY_ACTION=drop",
+						"EXTERNAL_IP=1.2.3.4",
 						"CONTAINER_DEPOT_PATH=" + depotPath,
 						"CONTAINER_DEPOT_MOUNT_POINT_PATH=/depot/mount/point",
 						"DISK_QUOTA_ENABLED=true",
+						"BANDWIDTH_MODE=htb",
+						"UPLINK_IFACE=eth0",
+						"UPLINK_RATE=1000000000",
 
 						"PATH=" + os.Getenv("PATH"),
 					},
@@ -183,6 +212,156 @@ var _ = Describe("Container pool", func() {
 			Ω(container.Properties()).Should(Equal(properties))
 		})
 
+		Context("when the container's denied egress is to be logged", func() {
+			var originalKernelLogPath string
+
+			BeforeEach(func() {
+				kernelLog, err := ioutil.TempFile("", "kmsg")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				kernelLog.Close()
+
+				originalKernelLogPath = network_manager.KernelLogPath
+				network_manager.KernelLogPath = kernelLog.Name()
+			})
+
+			AfterEach(func() {
+				os.Remove(network_manager.KernelLogPath)
+				network_manager.KernelLogPath = originalKernelLogPath
+			})
+
+			It("logs connections to the denied networks when the container starts", func() {
+				container, err := pool.Create(warden.ContainerSpec{
+					Properties: warden.Properties{
+						container_pool.LogDeniedEgressProperty: "true",
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.Start()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				instanceChain := "w-0-instance-" + container.ID()
+				accountingChain := "w-0-acct-" + container.ID()
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: strings.Join([]string{
+							"*filter",
+							":" + accountingChain + " - [0:0]",
+							"-A " + accountingChain + " --destination 1.1.1.1/32 --jump RETURN",
+							"-A " + accountingChain + " --destination 2.2.2.2/32 --jump RETURN",
+							"-A " + accountingChain + " --destination 1.1.0.0/16 --jump RETURN",
+							"-A " + accountingChain + " --destination 2.2.0.0/16 --jump RETURN",
+							"-A " + accountingChain + " --jump RETURN",
+							":" + instanceChain + " - [0:0]",
+							"-A " + instanceChain + " --destination 1.1.1.1/32 --goto w-0-default",
+							"-A " + instanceChain + " --destination 2.2.2.2/32 --goto w-0-default",
+							"-A " + instanceChain + ` --destination 1.1.0.0/16 --match conntrack ! --ctstate ESTABLISHED,RELATED --match limit --limit 6/minute --limit-burst 5 --jump LOG --log-prefix "` + hostIface(container.ID()) + ` denied: "`,
+							"-A " + instanceChain + ` --destination 2.2.0.0/16 --match conntrack ! --ctstate ESTABLISHED,RELATED --match limit --limit 6/minute --limit-burst 5 --jump LOG --log-prefix "` + hostIface(container.ID()) + ` denied: "`,
+							"-A " + instanceChain + " --goto w-0-default",
+							"-I w-0-forward 2 --in-interface " + hostIface(container.ID()) + " --goto " + instanceChain,
+							"-I w-0-forward 2 --in-interface " + hostIface(container.ID()) + " --jump " + accountingChain,
+							"COMMIT",
+							"*nat",
+							":" + instanceChain + " - [0:0]",
+							"-A w-0-prerouting --jump " + instanceChain,
+							"COMMIT",
+						}, "\n") + "\n",
+					},
+				))
+			})
+		})
+
+		Context("when the container overrides the deny action", func() {
+			It("denies new connections to the denied networks itself when the container starts", func() {
+				container, err := pool.Create(warden.ContainerSpec{
+					Properties: warden.Properties{
+						container_pool.DenyActionProperty: "reject",
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.Start()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				instanceChain := "w-0-instance-" + container.ID()
+				accountingChain := "w-0-acct-" + container.ID()
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: strings.Join([]string{
+							"*filter",
+							":" + accountingChain + " - [0:0]",
+							"-A " + accountingChain + " --destination 1.1.1.1/32 --jump RETURN",
+							"-A " + accountingChain + " --destination 2.2.2.2/32 --jump RETURN",
+							"-A " + accountingChain + " --destination 1.1.0.0/16 --jump RETURN",
+							"-A " + accountingChain + " --destination 2.2.0.0/16 --jump RETURN",
+							"-A " + accountingChain + " --jump RETURN",
+							":" + instanceChain + " - [0:0]",
+							"-A " + instanceChain + " --destination 1.1.1.1/32 --goto w-0-default",
+							"-A " + instanceChain + " --destination 2.2.2.2/32 --goto w-0-default",
+							"-A " + instanceChain + " --destination 1.1.0.0/16 --match conntrack ! --ctstate ESTABLISHED,RELATED --protocol tcp --jump REJECT --reject-with tcp-reset",
+							"-A " + instanceChain + " --destination 1.1.0.0/16 --match conntrack ! --ctstate ESTABLISHED,RELATED --jump REJECT --reject-with icmp-port-unreachable",
+							"-A " + instanceChain + " --destination 2.2.0.0/16 --match conntrack ! --ctstate ESTABLISHED,RELATED --protocol tcp --jump REJECT --reject-with tcp-reset",
+							"-A " + instanceChain + " --destination 2.2.0.0/16 --match conntrack ! --ctstate ESTABLISHED,RELATED --jump REJECT --reject-with icmp-port-unreachable",
+							"-A " + instanceChain + " --goto w-0-default",
+							"-I w-0-forward 2 --in-interface " + hostIface(container.ID()) + " --goto " + instanceChain,
+							"-I w-0-forward 2 --in-interface " + hostIface(container.ID()) + " --jump " + accountingChain,
+							"COMMIT",
+							"*nat",
+							":" + instanceChain + " - [0:0]",
+							"-A w-0-prerouting --jump " + instanceChain,
+							"COMMIT",
+						}, "\n") + "\n",
+					},
+				))
+			})
+
+			Context("with an unknown action", func() {
+				It("returns an error and does not acquire any resources", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						Properties: warden.Properties{
+							container_pool.DenyActionProperty: "explode",
+						},
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeUIDPool.Acquired).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the container is in a network group", func() {
+			It("lets the group's members reach it when it starts", func() {
+				container, err := pool.Create(warden.ContainerSpec{
+					Properties: warden.Properties{
+						container_pool.NetworkGroupProperty: "some-group",
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.Start()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				containerIP := container.(*linux_backend.LinuxContainer).Resources().Network.ContainerIP()
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: strings.Join([]string{
+							"*filter",
+							":w-0-group-92b6f927 - [0:0]",
+							"-A w-0-group-92b6f927 --destination " + containerIP.String() + " --jump ACCEPT",
+							"COMMIT",
+						}, "\n") + "\n",
+					},
+				))
+			})
+		})
+
 		It("executes create.sh with the correct args and environment", func() {
 			container, err := pool.Create(warden.ContainerSpec{})
 			Ω(err).ShouldNot(HaveOccurred())
@@ -195,8 +374,14 @@ var _ = Describe("Container pool", func() {
 						"id=" + container.ID(),
 						"rootfs_path=/provided/rootfs/path",
 						"user_uid=10000",
+						"network_host_iface=" + hostIface(container.ID()),
+						"network_container_iface=" + containerIface(container.ID()),
 						"network_host_ip=1.2.0.1",
 						"network_container_ip=1.2.0.2",
+						"network_prefix_length=30",
+						"dns_nameservers=8.8.8.8",
+						"dns_search=example.com",
+						"dns_hosts=",
 
 						"PATH=" + os.Getenv("PATH"),
 					},
@@ -205,6 +390,127 @@ var _ = Describe("Container pool", func() {
 
 		})
 
+		It("creates containers with the server's MTU", func() {
+			container, err := pool.Create(warden.ContainerSpec{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(container.(*linux_backend.LinuxContainer).MTU()).Should(Equal(uint32(1500)))
+		})
+
+		Context("when the container overrides the MTU", func() {
+			It("creates the container with its MTU", func() {
+				container, err := pool.Create(warden.ContainerSpec{
+					Properties: warden.Properties{
+						container_pool.MTUProperty: "1400",
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(container.(*linux_backend.LinuxContainer).MTU()).Should(Equal(uint32(1400)))
+			})
+
+			Context("with an invalid MTU", func() {
+				It("returns an error and does not acquire any resources", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						Properties: warden.Properties{
+							container_pool.MTUProperty: "42",
+						},
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeUIDPool.Acquired).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the container overrides the DNS configuration", func() {
+			It("passes the overridden configuration to create.sh and keeps it", func() {
+				container, err := pool.Create(warden.ContainerSpec{
+					Properties: warden.Properties{
+						container_pool.DNSServersProperty: "10.0.0.53, 10.0.0.54",
+						container_pool.ExtraHostsProperty: "db.internal:10.0.0.5,fd.internal:fd00::5",
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/root/path/create.sh",
+						Env: []string{
+							"id=" + container.ID(),
+							"rootfs_path=/provided/rootfs/path",
+							"user_uid=10000",
+							"network_host_iface=" + hostIface(container.ID()),
+							"network_container_iface=" + containerIface(container.ID()),
+							"network_host_ip=1.2.0.1",
+							"network_container_ip=1.2.0.2",
+							"network_prefix_length=30",
+							"dns_nameservers=10.0.0.53 10.0.0.54",
+							"dns_search=example.com",
+							"dns_hosts=10.0.0.5 db.internal\nfd00::5 fd.internal",
+
+							"PATH=" + os.Getenv("PATH"),
+						},
+					},
+				))
+
+				Ω(container.(*linux_backend.LinuxContainer).DNSConfig()).Should(Equal(linux_backend.DNSConfig{
+					Nameservers: []string{"10.0.0.53", "10.0.0.54"},
+					Search:      []string{"example.com"},
+					ExtraHosts: []linux_backend.HostEntry{
+						{Hostname: "db.internal", IP: "10.0.0.5"},
+						{Hostname: "fd.internal", IP: "fd00::5"},
+					},
+				}))
+			})
+
+			Context("with an invalid nameserver", func() {
+				It("returns an error and does not acquire any resources", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						Properties: warden.Properties{
+							container_pool.DNSServersProperty: "dns.example.com",
+						},
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeUIDPool.Acquired).Should(BeEmpty())
+				})
+			})
+
+			Context("with an invalid host entry", func() {
+				It("returns an error and does not acquire any resources", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						Properties: warden.Properties{
+							container_pool.ExtraHostsProperty: "db.internal",
+						},
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeUIDPool.Acquired).Should(BeEmpty())
+				})
+			})
+
+			Context("with a host entry whose hostname is not valid", func() {
+				It("returns an error and does not acquire any resources", func() {
+					for _, hosts := range []string{
+						"db.internal\n10.0.0.6 evil.internal:10.0.0.5",
+						"db internal:10.0.0.5",
+						"-db.internal:10.0.0.5",
+						"db..internal:10.0.0.5",
+					} {
+						_, err := pool.Create(warden.ContainerSpec{
+							Properties: warden.Properties{
+								container_pool.ExtraHostsProperty: hosts,
+							},
+						})
+						Ω(err).Should(HaveOccurred())
+					}
+
+					Ω(fakeUIDPool.Acquired).Should(BeEmpty())
+				})
+			})
+		})
+
 		It("saves the determined rootfs provider to the depot", func() {
 			container, err := pool.Create(warden.ContainerSpec{})
 			Ω(err).ShouldNot(HaveOccurred())
@@ -249,8 +555,14 @@ var _ = Describe("Container pool", func() {
 							"id=" + container.ID(),
 							"rootfs_path=/var/some/mount/point",
 							"user_uid=10000",
+							"network_host_iface=" + hostIface(container.ID()),
+							"network_container_iface=" + containerIface(container.ID()),
 							"network_host_ip=1.2.0.1",
 							"network_container_ip=1.2.0.2",
+							"network_prefix_length=30",
+							"dns_nameservers=8.8.8.8",
+							"dns_search=example.com",
+							"dns_hosts=",
 
 							"PATH=" + os.Getenv("PATH"),
 						},
@@ -460,6 +772,133 @@ var _ = Describe("Container pool", func() {
 			})
 		})
 
+		Context("when a network is specified", func() {
+			It("removes the subnet from the pool and passes its IPs to create.sh", func() {
+				container, err := pool.Create(warden.ContainerSpec{
+					Network: "1.2.0.8/30",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkPool.Removed).Should(ContainElement("1.2.0.8/30"))
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/root/path/create.sh",
+						Args: []string{path.Join(depotPath, container.ID())},
+						Env: []string{
+							"id=" + container.ID(),
+							"rootfs_path=/provided/rootfs/path",
+							"user_uid=10000",
+							"network_host_iface=" + hostIface(container.ID()),
+							"network_container_iface=" + containerIface(container.ID()),
+							"network_host_ip=1.2.0.9",
+							"network_container_ip=1.2.0.10",
+							"network_prefix_length=30",
+							"dns_nameservers=8.8.8.8",
+							"dns_search=example.com",
+							"dns_hosts=",
+
+							"PATH=" + os.Getenv("PATH"),
+						},
+					},
+				))
+			})
+
+			Context("as a container IP", func() {
+				It("removes the subnet containing it from the pool", func() {
+					container, err := pool.Create(warden.ContainerSpec{
+						Network: "1.2.0.10",
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeNetworkPool.Removed).Should(ContainElement("1.2.0.8/30"))
+
+					linuxContainer := container.(*linux_backend.LinuxContainer)
+					Ω(linuxContainer.Resources().Network.ContainerIP().String()).Should(Equal("1.2.0.10"))
+				})
+
+				Context("but it is not the container IP of its subnet", func() {
+					It("returns an InvalidNetworkSpecError and releases the uid", func() {
+						_, err := pool.Create(warden.ContainerSpec{
+							Network: "1.2.0.9",
+						})
+						Ω(err).Should(Equal(container_pool.InvalidNetworkSpecError{"1.2.0.9"}))
+
+						Ω(fakeNetworkPool.Removed).Should(BeEmpty())
+						Ω(fakeUIDPool.Released).Should(ContainElement(uint32(10000)))
+					})
+				})
+			})
+
+			Context("and it is larger than the pool's subnet size", func() {
+				It("removes the whole block from the pool and passes its prefix length to create.sh", func() {
+					container, err := pool.Create(warden.ContainerSpec{
+						Network: "1.2.0.16/28",
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeNetworkPool.Removed).Should(ContainElement("1.2.0.16/28"))
+
+					Ω(fakeRunner).Should(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "/root/path/create.sh",
+							Args: []string{path.Join(depotPath, container.ID())},
+							Env: []string{
+								"id=" + container.ID(),
+								"rootfs_path=/provided/rootfs/path",
+								"user_uid=10000",
+								"network_host_iface=" + hostIface(container.ID()),
+								"network_container_iface=" + containerIface(container.ID()),
+								"network_host_ip=1.2.0.17",
+								"network_container_ip=1.2.0.18",
+								"network_prefix_length=28",
+								"dns_nameservers=8.8.8.8",
+								"dns_search=example.com",
+								"dns_hosts=",
+
+								"PATH=" + os.Getenv("PATH"),
+							},
+						},
+					))
+				})
+			})
+
+			Context("and it is smaller than the pool's subnet size", func() {
+				It("returns an InvalidNetworkSpecError", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						Network: "1.2.0.8/31",
+					})
+					Ω(err).Should(Equal(container_pool.InvalidNetworkSpecError{"1.2.0.8/31"}))
+				})
+			})
+
+			Context("and it is malformed", func() {
+				It("returns an InvalidNetworkSpecError", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						Network: "banana",
+					})
+					Ω(err).Should(Equal(container_pool.InvalidNetworkSpecError{"banana"}))
+				})
+			})
+
+			Context("and removing it from the pool fails", func() {
+				nastyError := errors.New("oh no!")
+
+				JustBeforeEach(func() {
+					fakeNetworkPool.RemoveError = nastyError
+				})
+
+				It("returns the error and releases the uid", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						Network: "1.2.0.8/30",
+					})
+					Ω(err).Should(Equal(nastyError))
+
+					Ω(fakeUIDPool.Released).Should(ContainElement(uint32(10000)))
+				})
+			})
+		})
+
 		Context("when acquiring a UID fails", func() {
 			nastyError := errors.New("oh no!")
 
@@ -533,6 +972,11 @@ var _ = Describe("Container pool", func() {
 
 					GraceTime: 1 * time.Second,
 
+					DNS: linux_backend.DNSConfig{
+						Nameservers: []string{"10.0.0.53"},
+					},
+					MTU: 1400,
+
 					State: "some-restored-state",
 					Events: []string{
 						"some-restored-event",
@@ -566,6 +1010,11 @@ var _ = Describe("Container pool", func() {
 
 			linuxContainer := container.(*linux_backend.LinuxContainer)
 
+			Ω(linuxContainer.DNSConfig()).Should(Equal(linux_backend.DNSConfig{
+				Nameservers: []string{"10.0.0.53"},
+			}))
+			Ω(linuxContainer.MTU()).Should(Equal(uint32(1400)))
+
 			Ω(linuxContainer.State()).Should(Equal(linux_backend.State("some-restored-state")))
 			Ω(linuxContainer.Events()).Should(Equal([]string{
 				"some-restored-event",
@@ -574,6 +1023,34 @@ var _ = Describe("Container pool", func() {
 
 		})
 
+		Context("when the snapshot has no MTU", func() {
+			BeforeEach(func() {
+				buf := new(bytes.Buffer)
+
+				snapshot = buf
+
+				err := json.NewEncoder(buf).Encode(
+					linux_backend.ContainerSnapshot{
+						ID:     "some-restored-id",
+						Handle: "some-restored-handle",
+
+						Resources: linux_backend.ResourcesSnapshot{
+							UID:     10000,
+							Network: restoredNetwork,
+						},
+					},
+				)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("restores the container with the server's MTU", func() {
+				container, err := pool.Restore(snapshot)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(container.(*linux_backend.LinuxContainer).MTU()).Should(Equal(uint32(1500)))
+			})
+		})
+
 		It("removes its UID from the pool", func() {
 			_, err := pool.Restore(snapshot)
 			Ω(err).ShouldNot(HaveOccurred())
@@ -772,6 +1249,28 @@ var _ = Describe("Container pool", func() {
 				})
 			})
 
+			Context("when the depot contains files", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(path.Join(depotPath, "state.journal"), []byte{}, 0644)
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+
+				It("leaves them alone", func() {
+					err := pool.Prune(map[string]bool{})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "/root/path/destroy.sh",
+							Args: []string{path.Join(depotPath, "state.journal")},
+						},
+					))
+
+					_, err = os.Stat(path.Join(depotPath, "state.journal"))
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			})
+
 			Context("when a container to exclude is specified", func() {
 				It("is not destroyed", func() {
 					err := pool.Prune(map[string]bool{"container-2": true})
@@ -848,6 +1347,42 @@ var _ = Describe("Container pool", func() {
 
 		})
 
+		It("tears down the container's network before executing destroy.sh", func() {
+			err := pool.Destroy(createdContainer)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables",
+					Args: []string{"-w", "-t", "filter", "-S"},
+				},
+				fake_command_runner.CommandSpec{
+					Path: "/root/path/destroy.sh",
+				},
+			))
+
+			Ω(fakeLinks.Deleted).Should(ContainElement(hostIface(createdContainer.ID())))
+		})
+
+		Context("when tearing down the network fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeLinks.DeleteError = disaster
+			})
+
+			It("returns the error and does not execute destroy.sh", func() {
+				err := pool.Destroy(createdContainer)
+				Ω(err).Should(Equal(disaster))
+
+				Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/root/path/destroy.sh",
+					},
+				))
+			})
+		})
+
 		It("releases the container's ports, uid, and network", func() {
 			err := pool.Destroy(createdContainer)
 			Ω(err).ShouldNot(HaveOccurred())
@@ -930,4 +1465,209 @@ var _ = Describe("Container pool", func() {
 			})
 		})
 	})
+
+	Context("with an IPv6 network pool", func() {
+		var fakeIPv6NetworkPool *fake_network_pool.FakeNetworkPool
+
+		BeforeEach(func() {
+			_, ipv6Net, err := net.ParseCIDR("fd00:1:2::/112")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fakeIPv6NetworkPool = fake_network_pool.New(ipv6Net)
+			fakeIPv6NetworkPool.SubnetPrefix = 126
+
+			pool = container_pool.New(
+				"/root/path",
+				depotPath,
+				sysconfig.NewConfig("0"),
+				map[string]rootfs_provider.RootFSProvider{
+					"": defaultFakeRootFSProvider,
+				},
+				fakeUIDPool,
+				fakeNetworkPool,
+				fakeIPv6NetworkPool,
+				fakePortPool,
+				[]string{},
+				[]string{},
+				network_manager.DenyActionDrop,
+				net.ParseIP("1.2.3.4"),
+				linux_backend.DNSConfig{},
+				1500,
+				bandwidth_manager.Config{Mode: bandwidth_manager.ModeTBF},
+				[]network_manager.AccountingBucket{
+					{Name: "internal", Networks: []string{"10.0.0.0/8"}},
+				},
+				process_tracker.Config{},
+				fakeRunner,
+				fakeLinks,
+				fakeQuotaManager,
+			)
+		})
+
+		It("is constrained by the IPv6 network pool size", func() {
+			fakeNetworkPool.InitialPoolSize = 666
+			fakeIPv6NetworkPool.InitialPoolSize = 5
+			fakeUIDPool.InitialPoolSize = 3000
+
+			Ω(pool.MaxContainers()).Should(Equal(5))
+		})
+
+		It("passes the IPv6 pool network to setup.sh", func() {
+			err := pool.Setup()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner.ExecutedCommands()[0].Env).Should(ContainElement("POOL_NETWORK_IPV6=fd00:1:2::/112"))
+		})
+
+		Describe("creating", func() {
+			It("passes an IPv6 network to create.sh", func() {
+				container, err := pool.Create(warden.ContainerSpec{})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/root/path/create.sh",
+						Args: []string{path.Join(depotPath, container.ID())},
+						Env: []string{
+							"id=" + container.ID(),
+							"rootfs_path=/provided/rootfs/path",
+							"user_uid=10000",
+							"network_host_iface=" + hostIface(container.ID()),
+							"network_container_iface=" + containerIface(container.ID()),
+							"network_host_ip=1.2.0.1",
+							"network_container_ip=1.2.0.2",
+							"network_prefix_length=30",
+							"network_host_ipv6=fd00:1:2::1",
+							"network_container_ipv6=fd00:1:2::2",
+							"network_ipv6_prefix_length=126",
+							"dns_nameservers=",
+							"dns_search=",
+							"dns_hosts=",
+
+							"PATH=" + os.Getenv("PATH"),
+						},
+					},
+				))
+
+				linuxContainer := container.(*linux_backend.LinuxContainer)
+				Ω(linuxContainer.Resources().IPv6Network.String()).Should(Equal("fd00:1:2::/126"))
+			})
+
+			Context("when acquiring an IPv6 network fails", func() {
+				nastyError := errors.New("oh no!")
+
+				JustBeforeEach(func() {
+					fakeIPv6NetworkPool.AcquireError = nastyError
+				})
+
+				It("returns the error and releases the uid and network", func() {
+					_, err := pool.Create(warden.ContainerSpec{})
+					Ω(err).Should(Equal(nastyError))
+
+					Ω(fakeUIDPool.Released).Should(ContainElement(uint32(10000)))
+					Ω(fakeNetworkPool.Released).Should(ContainElement("1.2.0.0/30"))
+				})
+			})
+
+			Context("when executing create.sh fails", func() {
+				BeforeEach(func() {
+					fakeRunner.WhenRunning(
+						fake_command_runner.CommandSpec{
+							Path: "/root/path/create.sh",
+						}, func(*exec.Cmd) error {
+							return errors.New("oh no!")
+						},
+					)
+				})
+
+				It("releases the IPv6 network", func() {
+					_, err := pool.Create(warden.ContainerSpec{})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeIPv6NetworkPool.Released).Should(ContainElement("fd00:1:2::/126"))
+				})
+			})
+		})
+
+		Describe("restoring", func() {
+			var snapshot io.Reader
+			var restoredIPv6Network *network.Network
+
+			BeforeEach(func() {
+				buf := new(bytes.Buffer)
+
+				snapshot = buf
+
+				_, ipNet, err := net.ParseCIDR("10.244.0.0/30")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, ipv6Net, err := net.ParseCIDR("fd00:1:2::4/126")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				restoredIPv6Network = network.New(ipv6Net)
+
+				err = json.NewEncoder(buf).Encode(
+					linux_backend.ContainerSnapshot{
+						ID:     "some-restored-id",
+						Handle: "some-restored-handle",
+
+						Resources: linux_backend.ResourcesSnapshot{
+							UID:         10000,
+							Network:     network.New(ipNet),
+							IPv6Network: restoredIPv6Network,
+						},
+					},
+				)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("removes its IPv6 network from the pool", func() {
+				container, err := pool.Restore(snapshot)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeIPv6NetworkPool.Removed).Should(ContainElement(restoredIPv6Network.String()))
+
+				linuxContainer := container.(*linux_backend.LinuxContainer)
+				Ω(linuxContainer.Resources().IPv6Network.String()).Should(Equal("fd00:1:2::4/126"))
+			})
+
+			Context("when removing the IPv6 network from the pool fails", func() {
+				disaster := errors.New("oh no!")
+
+				JustBeforeEach(func() {
+					fakeIPv6NetworkPool.RemoveError = disaster
+				})
+
+				It("returns the error and releases the uid and network", func() {
+					_, err := pool.Restore(snapshot)
+					Ω(err).Should(Equal(disaster))
+
+					Ω(fakeUIDPool.Released).Should(ContainElement(uint32(10000)))
+					Ω(fakeNetworkPool.Released).Should(ContainElement("10.244.0.0/30"))
+				})
+			})
+		})
+
+		Describe("destroying", func() {
+			It("releases the container's IPv6 network", func() {
+				container, err := pool.Create(warden.ContainerSpec{})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = pool.Destroy(container)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeIPv6NetworkPool.Released).Should(ContainElement("fd00:1:2::/126"))
+			})
+		})
+	})
 })
+
+func hostIface(id string) string {
+	hostIface, _ := network_manager.InterfaceNames("w0", id)
+	return hostIface
+}
+
+func containerIface(id string) string {
+	_, containerIface := network_manager.InterfaceNames("w0", id)
+	return containerIface
+}
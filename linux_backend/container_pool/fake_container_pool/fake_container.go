@@ -1,6 +1,7 @@
 package fake_container_pool
 
 import (
+	"encoding/json"
 	"io"
 	"sync"
 	"time"
@@ -9,6 +10,11 @@ import (
 	"github.com/cloudfoundry-incubator/garden/warden/fakes"
 )
 
+type fakeSnapshot struct {
+	Handle     string
+	Properties warden.Properties `json:",omitempty"`
+}
+
 type FakeContainer struct {
 	*fakes.FakeContainer
 
@@ -22,6 +28,8 @@ type FakeContainer struct {
 	Started    bool
 
 	CleanedUp bool
+
+	ChangeCallback func()
 }
 
 func NewFakeContainer(spec warden.ContainerSpec) *FakeContainer {
@@ -69,5 +77,12 @@ func (c *FakeContainer) Snapshot(snapshot io.Writer) error {
 
 	c.SavedSnapshots = append(c.SavedSnapshots, snapshot)
 
-	return nil
+	return json.NewEncoder(snapshot).Encode(fakeSnapshot{
+		Handle:     c.Spec.Handle,
+		Properties: c.Spec.Properties,
+	})
+}
+
+func (c *FakeContainer) OnChange(callback func()) {
+	c.ChangeCallback = callback
 }
@@ -1,8 +1,10 @@
 package fake_container_pool
 
 import (
-	"fmt"
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"strings"
 
 	"github.com/cloudfoundry-incubator/garden/warden"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
@@ -86,16 +88,23 @@ func (p *FakeContainerPool) Restore(snapshot io.Reader) (linux_backend.Container
 		return nil, p.RestoreError
 	}
 
-	var handle string
-
-	_, err := fmt.Fscanf(snapshot, "%s", &handle)
-	if err != nil && err != io.EOF {
+	content, err := ioutil.ReadAll(snapshot)
+	if err != nil {
 		return nil, err
 	}
 
+	// snapshots taken by FakeContainer, or just the handle
+	var restored fakeSnapshot
+
+	err = json.Unmarshal(content, &restored)
+	if err != nil {
+		restored = fakeSnapshot{Handle: strings.TrimSpace(string(content))}
+	}
+
 	container := NewFakeContainer(
 		warden.ContainerSpec{
-			Handle: handle,
+			Handle:     restored.Handle,
+			Properties: restored.Properties,
 		},
 	)
 
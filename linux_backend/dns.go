@@ -0,0 +1,104 @@
+package linux_backend
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// DNSConfig is written to a container's /etc/resolv.conf and /etc/hosts when
+// it is created. With no nameservers, the host's resolv.conf is inherited.
+type DNSConfig struct {
+	Nameservers []string
+	Search      []string
+	ExtraHosts  []HostEntry
+}
+
+// HostEntry is an extra line in a container's /etc/hosts.
+type HostEntry struct {
+	Hostname string
+	IP       string
+}
+
+// hostnameLabel is a label of an RFC 1123 hostname
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// ParseHostEntries parses entries of the form hostname:ip. The IP may be an
+// IPv6 address, as a hostname cannot contain a colon.
+//
+// Hostnames must be valid RFC 1123 hostnames, as they are written verbatim
+// to the container's /etc/hosts.
+func ParseHostEntries(entries []string) ([]HostEntry, error) {
+	hosts := []HostEntry{}
+
+	for _, entry := range entries {
+		segs := strings.SplitN(entry, ":", 2)
+		if len(segs) != 2 || !validHostname(segs[0]) || net.ParseIP(segs[1]) == nil {
+			return nil, fmt.Errorf("invalid host entry (must be hostname:ip): %q", entry)
+		}
+
+		hosts = append(hosts, HostEntry{Hostname: segs[0], IP: segs[1]})
+	}
+
+	return hosts, nil
+}
+
+func validHostname(hostname string) bool {
+	if len(hostname) == 0 || len(hostname) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SplitList splits a comma-separated list, e.g. of nameservers, dropping
+// surrounding whitespace and empty items.
+func SplitList(list string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func (c DNSConfig) Validate() error {
+	for _, nameserver := range c.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("invalid nameserver (must be an IP): %s", nameserver)
+		}
+	}
+
+	for _, domain := range c.Search {
+		if strings.ContainsAny(domain, " \t\n") {
+			return fmt.Errorf("invalid search domain: %q", domain)
+		}
+	}
+
+	return nil
+}
+
+// Environ is the configuration for create.sh.
+func (c DNSConfig) Environ() []string {
+	hosts := []string{}
+	for _, host := range c.ExtraHosts {
+		hosts = append(hosts, host.IP+" "+host.Hostname)
+	}
+
+	return []string{
+		"dns_nameservers=" + strings.Join(c.Nameservers, " "),
+		"dns_search=" + strings.Join(c.Search, " "),
+		"dns_hosts=" + strings.Join(hosts, "\n"),
+	}
+}
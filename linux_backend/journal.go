@@ -0,0 +1,303 @@
+package linux_backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"sync"
+)
+
+// Journal durably records the state of each container, i.e. its snapshot,
+// whenever it changes, so that containers can be recovered even if the
+// server is killed before it can save snapshots.
+//
+// Only what changed is appended to the journal file and synced: the
+// snapshot's fields that differ from those last recorded, e.g. the container's
+// ports and net-ins after a net-in. The journal is rewritten with each
+// container's full state once enough changes have accumulated.
+type Journal struct {
+	path string
+
+	file    *os.File
+	entries int
+
+	// each container's snapshot, by field
+	containers map[string]map[string]json.RawMessage
+
+	mutex sync.Mutex
+}
+
+type journalEntry struct {
+	ID string
+
+	// the fields of the container's snapshot that changed
+	Changes map[string]json.RawMessage `json:",omitempty"`
+
+	Destroyed bool `json:",omitempty"`
+}
+
+// compaction happens once the journal holds this many entries more than
+// there are containers
+const journalSlack = 128
+
+// OpenJournal loads the container states recorded in the journal at the
+// given path, creating it if it does not exist.
+func OpenJournal(path string) (*Journal, error) {
+	journal := &Journal{
+		path: path,
+
+		containers: make(map[string]map[string]json.RawMessage),
+	}
+
+	err := journal.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = journal.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+// Snapshots returns the latest snapshot recorded for each container, by ID.
+func (j *Journal) Snapshots() map[string][]byte {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	snapshots := make(map[string][]byte, len(j.containers))
+
+	for id, fields := range j.containers {
+		snapshot, err := json.Marshal(fields)
+		if err != nil {
+			log.Println("failed to assemble journaled snapshot of", id, err)
+			continue
+		}
+
+		snapshots[id] = snapshot
+	}
+
+	return snapshots
+}
+
+// Record appends the fields of the container's snapshot that changed since it
+// was last recorded. The snapshot must be a JSON object.
+func (j *Journal) Record(id string, snapshot []byte) error {
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal(snapshot, &fields)
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	recorded := j.containers[id]
+
+	changes := make(map[string]json.RawMessage)
+
+	for field, value := range fields {
+		if !bytes.Equal(recorded[field], value) {
+			changes[field] = value
+		}
+	}
+
+	for field := range recorded {
+		if _, found := fields[field]; !found {
+			changes[field] = json.RawMessage("null")
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return j.append(journalEntry{ID: id, Changes: changes})
+}
+
+// Forget records that the container was destroyed.
+func (j *Journal) Forget(id string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.append(journalEntry{ID: id, Destroyed: true})
+}
+
+// Reset rewrites the journal with only the given snapshots, by container ID.
+func (j *Journal) Reset(snapshots map[string][]byte) error {
+	current := make(map[string]map[string]json.RawMessage, len(snapshots))
+
+	for id, snapshot := range snapshots {
+		var fields map[string]json.RawMessage
+
+		err := json.Unmarshal(snapshot, &fields)
+		if err != nil {
+			return err
+		}
+
+		current[id] = fields
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.containers = current
+
+	return j.compact()
+}
+
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.file.Close()
+}
+
+// append must be called with the mutex held
+func (j *Journal) append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.apply(entry)
+
+	if j.entries >= len(j.containers)+journalSlack {
+		return j.compact()
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	j.entries++
+
+	return j.file.Sync()
+}
+
+func (j *Journal) apply(entry journalEntry) {
+	if entry.Destroyed {
+		delete(j.containers, entry.ID)
+		return
+	}
+
+	fields, found := j.containers[entry.ID]
+	if !found {
+		fields = make(map[string]json.RawMessage)
+		j.containers[entry.ID] = fields
+	}
+
+	for field, value := range entry.Changes {
+		fields[field] = value
+	}
+}
+
+// load replays the journal's entries. An incomplete entry at the end, e.g.
+// from the server being killed mid-write, is ignored.
+func (j *Journal) load() error {
+	file, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if len(line) > 0 {
+				log.Println("ignoring incomplete journal entry in", j.path)
+			}
+
+			break
+		}
+
+		var entry journalEntry
+
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			log.Println("ignoring invalid journal entry in", j.path, err)
+			continue
+		}
+
+		j.apply(entry)
+	}
+
+	return nil
+}
+
+// compact writes the current containers' entries to a new journal, which
+// replaces the old one atomically, and continues appending to it.
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	for id, fields := range j.containers {
+		err := encoder.Encode(journalEntry{ID: id, Changes: fields})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, j.path)
+	}
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = syncDir(path.Dir(j.path))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+
+	j.file = file
+	j.entries = len(j.containers)
+
+	return nil
+}
+
+// syncDir makes a rename within the directory durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return file.Sync()
+}
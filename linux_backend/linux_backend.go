@@ -1,12 +1,14 @@
 package linux_backend
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,6 +26,8 @@ type Container interface {
 	Snapshot(io.Writer) error
 	Cleanup()
 
+	OnChange(func())
+
 	warden.Container
 }
 
@@ -40,6 +44,10 @@ type LinuxBackend struct {
 	containerPool ContainerPool
 	systemInfo    system_info.Provider
 	snapshotsPath string
+	journalPath   string
+
+	journal      *Journal
+	persistMutex sync.Mutex
 
 	containers      map[string]Container
 	containersMutex *sync.RWMutex
@@ -61,11 +69,12 @@ func (e FailedToSnapshotError) Error() string {
 	return fmt.Sprintf("failed to save snapshot: %s", e.OriginalError)
 }
 
-func New(containerPool ContainerPool, systemInfo system_info.Provider, snapshotsPath string) *LinuxBackend {
+func New(containerPool ContainerPool, systemInfo system_info.Provider, snapshotsPath, journalPath string) *LinuxBackend {
 	return &LinuxBackend{
 		containerPool: containerPool,
 		systemInfo:    systemInfo,
 		snapshotsPath: snapshotsPath,
+		journalPath:   journalPath,
 
 		containers:      make(map[string]Container),
 		containersMutex: new(sync.RWMutex),
@@ -77,17 +86,26 @@ func (b *LinuxBackend) Setup() error {
 }
 
 func (b *LinuxBackend) Start() error {
-	if b.snapshotsPath != "" {
-		_, err := os.Stat(b.snapshotsPath)
-		if err == nil {
-			b.restoreSnapshots()
-			os.RemoveAll(b.snapshotsPath)
+	if b.journalPath != "" {
+		journal, err := OpenJournal(b.journalPath)
+		if err != nil {
+			return err
 		}
 
-		err = os.MkdirAll(b.snapshotsPath, 0755)
+		b.journal = journal
+	}
+
+	if b.snapshotsPath != "" {
+		err := os.MkdirAll(b.snapshotsPath, 0755)
 		if err != nil {
 			return err
 		}
+
+		b.restoreSnapshots()
+	}
+
+	if b.journal != nil {
+		b.recoverJournaledContainers()
 	}
 
 	keep := map[string]bool{}
@@ -96,11 +114,42 @@ func (b *LinuxBackend) Start() error {
 	containers := b.containers
 	b.containersMutex.RUnlock()
 
+	snapshots := map[string][]byte{}
+
 	for _, container := range containers {
 		keep[container.ID()] = true
+
+		snapshot, err := b.snapshot(container)
+		if err != nil {
+			log.Println(err)
+		} else {
+			snapshots[container.ID()] = snapshot
+
+			// replace the snapshot the container was restored from
+			err := b.saveSnapshot(container.ID(), snapshot)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		container.OnChange(b.persistChangesTo(container))
 	}
 
-	return b.containerPool.Prune(keep)
+	if b.journal != nil {
+		err := b.journal.Reset(snapshots)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := b.containerPool.Prune(keep)
+	if err != nil {
+		return err
+	}
+
+	b.removeStaleSnapshots(keep)
+
+	return nil
 }
 
 func (b *LinuxBackend) Ping() error {
@@ -140,6 +189,10 @@ func (b *LinuxBackend) Create(spec warden.ContainerSpec) (warden.Container, erro
 	b.containers[container.Handle()] = container
 	b.containersMutex.Unlock()
 
+	b.persist(container)
+
+	container.OnChange(b.persistChangesTo(container))
+
 	return container, nil
 }
 
@@ -161,6 +214,23 @@ func (b *LinuxBackend) Destroy(handle string) error {
 	delete(b.containers, container.Handle())
 	b.containersMutex.Unlock()
 
+	b.persistMutex.Lock()
+	defer b.persistMutex.Unlock()
+
+	if b.journal != nil {
+		err := b.journal.Forget(container.ID())
+		if err != nil {
+			log.Println("failed to journal destruction of", container.ID(), err)
+		}
+	}
+
+	if b.snapshotsPath != "" {
+		err := os.Remove(path.Join(b.snapshotsPath, container.ID()))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("failed to remove snapshot of", container.ID(), err)
+		}
+	}
+
 	return nil
 }
 
@@ -199,13 +269,86 @@ func (b *LinuxBackend) Stop() {
 
 	for _, container := range b.containers {
 		container.Cleanup()
-		err := b.saveSnapshot(container)
+		b.persist(container)
+	}
+
+	if b.journal != nil {
+		b.journal.Close()
+	}
+}
+
+// recoverJournaledContainers restores the containers that were journaled but
+// had no snapshot saved, e.g. because the server was killed
+func (b *LinuxBackend) recoverJournaledContainers() {
+	restored := map[string]bool{}
+
+	b.containersMutex.RLock()
+	for _, container := range b.containers {
+		restored[container.ID()] = true
+	}
+	b.containersMutex.RUnlock()
+
+	for id, snapshot := range b.journal.Snapshots() {
+		if restored[id] {
+			continue
+		}
+
+		log.Println("recovering", id, "from journal")
+
+		_, err := b.restore(bytes.NewReader(snapshot))
 		if err != nil {
-			log.Println(err)
+			log.Println("failed to recover", id, err)
 		}
 	}
 }
 
+func (b *LinuxBackend) persistChangesTo(container Container) func() {
+	return func() {
+		b.persist(container)
+	}
+}
+
+// persist journals and saves a snapshot of the container's current state,
+// taking one snapshot for both. This is serialized so that an older state can
+// never replace a newer one.
+func (b *LinuxBackend) persist(container Container) {
+	if b.journal == nil && b.snapshotsPath == "" {
+		return
+	}
+
+	b.persistMutex.Lock()
+	defer b.persistMutex.Unlock()
+
+	snapshot, err := b.snapshot(container)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if b.journal != nil {
+		err := b.journal.Record(container.ID(), snapshot)
+		if err != nil {
+			log.Println("failed to journal", container.ID(), err)
+		}
+	}
+
+	err = b.saveSnapshot(container.ID(), snapshot)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (b *LinuxBackend) snapshot(container Container) ([]byte, error) {
+	snapshot := new(bytes.Buffer)
+
+	err := container.Snapshot(snapshot)
+	if err != nil {
+		return nil, &FailedToSnapshotError{err}
+	}
+
+	return snapshot.Bytes(), nil
+}
+
 func (b *LinuxBackend) restoreSnapshots() {
 	entries, err := ioutil.ReadDir(b.snapshotsPath)
 	if err != nil {
@@ -213,6 +356,10 @@ func (b *LinuxBackend) restoreSnapshots() {
 	}
 
 	for _, entry := range entries {
+		if isTemporarySnapshot(entry.Name()) {
+			continue
+		}
+
 		snapshot := path.Join(b.snapshotsPath, entry.Name())
 
 		log.Println("loading snapshot for", entry.Name())
@@ -220,35 +367,88 @@ func (b *LinuxBackend) restoreSnapshots() {
 		file, err := os.Open(snapshot)
 		if err != nil {
 			log.Println("failed to open", entry.Name(), err)
+			continue
 		}
 
 		_, err = b.restore(file)
+		file.Close()
+
 		if err != nil {
 			log.Println("failed to restore", entry.Name(), err)
 		}
 	}
 }
 
-func (b *LinuxBackend) saveSnapshot(container Container) error {
+// removeStaleSnapshots removes the snapshots of containers that no longer
+// exist, and any left half-written
+func (b *LinuxBackend) removeStaleSnapshots(keep map[string]bool) {
+	if b.snapshotsPath == "" {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(b.snapshotsPath)
+	if err != nil {
+		log.Println("failed to read snapshots", b.snapshotsPath, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+
+		log.Println("removing stale snapshot", entry.Name())
+
+		err := os.Remove(path.Join(b.snapshotsPath, entry.Name()))
+		if err != nil {
+			log.Println("failed to remove", entry.Name(), err)
+		}
+	}
+}
+
+// saveSnapshot writes the container's snapshot to a temporary file which then
+// replaces its previous snapshot, so that a crash never leaves it partially
+// written
+func (b *LinuxBackend) saveSnapshot(id string, snapshot []byte) error {
 	if b.snapshotsPath == "" {
 		return nil
 	}
 
-	log.Println("saving snapshot for", container.ID())
+	log.Println("saving snapshot for", id)
 
-	snapshotPath := path.Join(b.snapshotsPath, container.ID())
+	snapshotPath := path.Join(b.snapshotsPath, id)
 
-	snapshot, err := os.Create(snapshotPath)
+	file, err := ioutil.TempFile(b.snapshotsPath, id+temporarySnapshotSuffix)
 	if err != nil {
 		return &FailedToSnapshotError{err}
 	}
 
-	err = container.Snapshot(snapshot)
+	_, err = file.Write(snapshot)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), snapshotPath)
+	}
+
 	if err != nil {
+		os.Remove(file.Name())
 		return &FailedToSnapshotError{err}
 	}
 
-	return snapshot.Close()
+	return nil
+}
+
+const temporarySnapshotSuffix = ".tmp"
+
+func isTemporarySnapshot(name string) bool {
+	return strings.Contains(name, temporarySnapshotSuffix)
 }
 
 func (b *LinuxBackend) restore(snapshot io.Reader) (warden.Container, error) {
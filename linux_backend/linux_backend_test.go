@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -24,7 +25,7 @@ var _ = Describe("Setup", func() {
 	BeforeEach(func() {
 		fakeContainerPool = fake_container_pool.New()
 		fakeSystemInfo = fake_system_info.NewFakeProvider()
-		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 	})
 
 	It("sets up the container pool", func() {
@@ -54,7 +55,7 @@ var _ = Describe("Start", func() {
 	It("creates the snapshots directory if it's not already there", func() {
 		snapshotsPath := path.Join(tmpdir, "snapshots")
 
-		linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath)
+		linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
 
 		err := linuxBackend.Start()
 		Ω(err).ShouldNot(HaveOccurred())
@@ -75,6 +76,7 @@ var _ = Describe("Start", func() {
 				fakeSystemInfo,
 				// weird scenario: /foo/X/snapshots with X being a file
 				path.Join(tmpfile.Name(), "snapshots"),
+				"",
 			)
 
 			err = linuxBackend.Start()
@@ -84,7 +86,7 @@ var _ = Describe("Start", func() {
 
 	Context("when no snapshots directory is given", func() {
 		It("successfully starts", func() {
-			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 
 			err := linuxBackend.Start()
 			Ω(err).ShouldNot(HaveOccurred())
@@ -114,7 +116,7 @@ var _ = Describe("Start", func() {
 		})
 
 		It("restores them via the container pool", func() {
-			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath)
+			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
 
 			Ω(fakeContainerPool.RestoredSnapshots).Should(BeEmpty())
 
@@ -124,8 +126,8 @@ var _ = Describe("Start", func() {
 			Ω(fakeContainerPool.RestoredSnapshots).Should(HaveLen(2))
 		})
 
-		It("removes the snapshots", func() {
-			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath)
+		It("replaces them with snapshots of the restored containers", func() {
+			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
 
 			Ω(fakeContainerPool.RestoredSnapshots).Should(BeEmpty())
 
@@ -137,10 +139,56 @@ var _ = Describe("Start", func() {
 
 			_, err = os.Stat(path.Join(snapshotsPath, "some-other-id"))
 			Ω(err).Should(HaveOccurred())
+
+			snapshot, err := ioutil.ReadFile(path.Join(snapshotsPath, "handle-a"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(snapshot).Should(MatchJSON(`{"Handle":"handle-a"}`))
+
+			snapshot, err = ioutil.ReadFile(path.Join(snapshotsPath, "handle-b"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(snapshot).Should(MatchJSON(`{"Handle":"handle-b"}`))
+		})
+
+		Context("when a snapshot was left partially written", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(path.Join(snapshotsPath, "handle-c.tmp123"), []byte("handle-c"), 0644)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("does not restore it, and removes it", func() {
+				linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
+
+				err := linuxBackend.Start()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeContainerPool.RestoredSnapshots).Should(HaveLen(2))
+
+				_, err = os.Stat(path.Join(snapshotsPath, "handle-c.tmp123"))
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+
+		Context("when pruning the container pool fails", func() {
+			BeforeEach(func() {
+				fakeContainerPool.PruneError = errors.New("failed to prune")
+			})
+
+			It("keeps the snapshots", func() {
+				linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
+
+				err := linuxBackend.Start()
+				Ω(err).Should(HaveOccurred())
+
+				_, err = os.Stat(path.Join(snapshotsPath, "some-id"))
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, err = os.Stat(path.Join(snapshotsPath, "some-other-id"))
+				Ω(err).ShouldNot(HaveOccurred())
+			})
 		})
 
 		It("registers the containers", func() {
-			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath)
+			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
 
 			err := linuxBackend.Start()
 			Ω(err).ShouldNot(HaveOccurred())
@@ -152,7 +200,7 @@ var _ = Describe("Start", func() {
 		})
 
 		It("keeps them when pruning the container pool", func() {
-			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath)
+			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
 
 			err := linuxBackend.Start()
 			Ω(err).ShouldNot(HaveOccurred())
@@ -172,7 +220,7 @@ var _ = Describe("Start", func() {
 			})
 
 			It("successfully starts anyway", func() {
-				linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath)
+				linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, "")
 
 				err := linuxBackend.Start()
 				Ω(err).ShouldNot(HaveOccurred())
@@ -181,7 +229,7 @@ var _ = Describe("Start", func() {
 	})
 
 	It("prunes the container pool", func() {
-		linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 
 		err := linuxBackend.Start()
 		Ω(err).ShouldNot(HaveOccurred())
@@ -198,7 +246,7 @@ var _ = Describe("Start", func() {
 		})
 
 		It("returns the error", func() {
-			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+			linuxBackend := linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 
 			err := linuxBackend.Start()
 			Ω(err).Should(Equal(disaster))
@@ -206,6 +254,245 @@ var _ = Describe("Start", func() {
 	})
 })
 
+var _ = Describe("Snapshotting", func() {
+	var fakeContainerPool *fake_container_pool.FakeContainerPool
+	var linuxBackend *linux_backend.LinuxBackend
+
+	var snapshotsPath string
+
+	BeforeEach(func() {
+		tmpdir, err := ioutil.TempDir(os.TempDir(), "warden-server-test")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		snapshotsPath = path.Join(tmpdir, "snapshots")
+
+		fakeContainerPool = fake_container_pool.New()
+		linuxBackend = linux_backend.New(fakeContainerPool, fake_system_info.NewFakeProvider(), snapshotsPath, "")
+
+		err = linuxBackend.Start()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("snapshots created containers", func() {
+		_, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		snapshot, err := ioutil.ReadFile(path.Join(snapshotsPath, "some-handle"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(snapshot).Should(MatchJSON(`{"Handle":"some-handle"}`))
+	})
+
+	It("snapshots containers again when they change", func() {
+		container, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = os.Remove(path.Join(snapshotsPath, "some-handle"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		container.(*fake_container_pool.FakeContainer).ChangeCallback()
+
+		_, err = os.Stat(path.Join(snapshotsPath, "some-handle"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("removes the snapshots of destroyed containers", func() {
+		_, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = linuxBackend.Destroy("some-handle")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = os.Stat(path.Join(snapshotsPath, "some-handle"))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	Context("when snapshotting fails", func() {
+		It("leaves the previous snapshot in place", func() {
+			container, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fakeContainer := container.(*fake_container_pool.FakeContainer)
+			fakeContainer.SnapshotError = errors.New("oh no!")
+			fakeContainer.ChangeCallback()
+
+			snapshot, err := ioutil.ReadFile(path.Join(snapshotsPath, "some-handle"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(snapshot).Should(MatchJSON(`{"Handle":"some-handle"}`))
+
+			entries, err := ioutil.ReadDir(snapshotsPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(entries).Should(HaveLen(1))
+		})
+	})
+})
+
+var _ = Describe("Journaling", func() {
+	var fakeContainerPool *fake_container_pool.FakeContainerPool
+	var fakeSystemInfo *fake_system_info.FakeProvider
+	var linuxBackend *linux_backend.LinuxBackend
+
+	var snapshotsPath string
+	var journalPath string
+
+	var tmpdir string
+
+	BeforeEach(func() {
+		var err error
+
+		tmpdir, err = ioutil.TempDir(os.TempDir(), "warden-server-test")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		snapshotsPath = ""
+		journalPath = path.Join(tmpdir, "state.journal")
+
+		fakeContainerPool = fake_container_pool.New()
+		fakeSystemInfo = fake_system_info.NewFakeProvider()
+	})
+
+	JustBeforeEach(func() {
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, journalPath)
+
+		err := linuxBackend.Start()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	restart := func() {
+		fakeContainerPool = fake_container_pool.New()
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, snapshotsPath, journalPath)
+
+		err := linuxBackend.Start()
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	It("recovers created containers without them having been snapshotted", func() {
+		_, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		restart()
+
+		Ω(fakeContainerPool.RestoredSnapshots).Should(HaveLen(1))
+
+		container, err := linuxBackend.Lookup("some-handle")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(container.Handle()).Should(Equal("some-handle"))
+
+		Ω(fakeContainerPool.KeptContainers).Should(Equal(map[string]bool{
+			"some-handle": true,
+		}))
+	})
+
+	It("does not recover destroyed containers", func() {
+		_, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = linuxBackend.Destroy("some-handle")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		restart()
+
+		Ω(fakeContainerPool.RestoredSnapshots).Should(BeEmpty())
+	})
+
+	It("records the containers again when they change", func() {
+		container, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fakeContainer := container.(*fake_container_pool.FakeContainer)
+		Ω(fakeContainer.SavedSnapshots).Should(HaveLen(1))
+
+		fakeContainer.ChangeCallback()
+
+		Ω(fakeContainer.SavedSnapshots).Should(HaveLen(2))
+	})
+
+	It("journals only what changed", func() {
+		container, err := linuxBackend.Create(warden.ContainerSpec{
+			Handle:     "some-handle",
+			Properties: warden.Properties{"a": "b"},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fakeContainer := container.(*fake_container_pool.FakeContainer)
+		fakeContainer.Spec.Properties = warden.Properties{"a": "c"}
+		fakeContainer.ChangeCallback()
+
+		journal, err := ioutil.ReadFile(journalPath)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		entries := strings.Split(strings.TrimSpace(string(journal)), "\n")
+		Ω(entries).Should(HaveLen(2))
+		Ω(entries[1]).Should(MatchJSON(`{"ID":"some-handle","Changes":{"Properties":{"a":"c"}}}`))
+
+		restart()
+
+		recovered, err := linuxBackend.Lookup("some-handle")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(recovered.(linux_backend.Container).Properties()).Should(Equal(warden.Properties{"a": "c"}))
+	})
+
+	It("journals nothing when nothing changed", func() {
+		container, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		before, err := ioutil.ReadFile(journalPath)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		container.(*fake_container_pool.FakeContainer).ChangeCallback()
+
+		after, err := ioutil.ReadFile(journalPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(after).Should(Equal(before))
+	})
+
+	Context("when the containers were also snapshotted", func() {
+		BeforeEach(func() {
+			snapshotsPath = path.Join(tmpdir, "snapshots")
+		})
+
+		It("takes one snapshot of each change for both", func() {
+			container, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fakeContainer := container.(*fake_container_pool.FakeContainer)
+			Ω(fakeContainer.SavedSnapshots).Should(HaveLen(1))
+
+			fakeContainer.ChangeCallback()
+
+			Ω(fakeContainer.SavedSnapshots).Should(HaveLen(2))
+		})
+
+		It("restores each of them only once", func() {
+			_, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			linuxBackend.Stop()
+
+			restart()
+
+			Ω(fakeContainerPool.RestoredSnapshots).Should(HaveLen(1))
+		})
+	})
+
+	Context("when the journal ends with an incomplete entry", func() {
+		It("recovers the complete entries", func() {
+			_, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-handle"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			journal, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = journal.Write([]byte(`{"ID":"some-other-handle","Chan`))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			journal.Close()
+
+			restart()
+
+			Ω(fakeContainerPool.RestoredSnapshots).Should(HaveLen(1))
+		})
+	})
+})
+
 var _ = Describe("Stop", func() {
 	var fakeContainerPool *fake_container_pool.FakeContainerPool
 	var fakeSystemInfo *fake_system_info.FakeProvider
@@ -220,6 +507,7 @@ var _ = Describe("Stop", func() {
 			fakeContainerPool,
 			fakeSystemInfo,
 			path.Join(tmpdir, "snapshots"),
+			"",
 		)
 
 		err = linuxBackend.Start()
@@ -233,12 +521,15 @@ var _ = Describe("Stop", func() {
 		container2, err := linuxBackend.Create(warden.ContainerSpec{Handle: "some-other-handle"})
 		Ω(err).ShouldNot(HaveOccurred())
 
-		linuxBackend.Stop()
-
 		fakeContainer1 := container1.(*fake_container_pool.FakeContainer)
 		fakeContainer2 := container2.(*fake_container_pool.FakeContainer)
 		Ω(fakeContainer1.SavedSnapshots).Should(HaveLen(1))
 		Ω(fakeContainer2.SavedSnapshots).Should(HaveLen(1))
+
+		linuxBackend.Stop()
+
+		Ω(fakeContainer1.SavedSnapshots).Should(HaveLen(2))
+		Ω(fakeContainer2.SavedSnapshots).Should(HaveLen(2))
 	})
 
 	It("cleans up each container", func() {
@@ -265,7 +556,7 @@ var _ = Describe("Capacity", func() {
 	BeforeEach(func() {
 		fakeContainerPool = fake_container_pool.New()
 		fakeSystemInfo = fake_system_info.NewFakeProvider()
-		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 	})
 
 	It("returns the right capacity values", func() {
@@ -315,7 +606,7 @@ var _ = Describe("Create", func() {
 	BeforeEach(func() {
 		fakeContainerPool = fake_container_pool.New()
 		fakeSystemInfo := fake_system_info.NewFakeProvider()
-		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 	})
 
 	It("creates a container from the pool", func() {
@@ -397,7 +688,7 @@ var _ = Describe("Destroy", func() {
 	BeforeEach(func() {
 		fakeContainerPool = fake_container_pool.New()
 		fakeSystemInfo := fake_system_info.NewFakeProvider()
-		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 
 		newContainer, err := linuxBackend.Create(warden.ContainerSpec{})
 		Ω(err).ShouldNot(HaveOccurred())
@@ -462,7 +753,7 @@ var _ = Describe("Lookup", func() {
 	BeforeEach(func() {
 		fakeContainerPool = fake_container_pool.New()
 		fakeSystemInfo := fake_system_info.NewFakeProvider()
-		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 	})
 
 	It("returns the container", func() {
@@ -493,7 +784,7 @@ var _ = Describe("Containers", func() {
 	BeforeEach(func() {
 		fakeContainerPool = fake_container_pool.New()
 		fakeSystemInfo := fake_system_info.NewFakeProvider()
-		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 	})
 
 	It("returns a list of all existing containers", func() {
@@ -546,7 +837,7 @@ var _ = Describe("GraceTime", func() {
 	BeforeEach(func() {
 		fakeContainerPool = fake_container_pool.New()
 		fakeSystemInfo := fake_system_info.NewFakeProvider()
-		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "")
+		linuxBackend = linux_backend.New(fakeContainerPool, fakeSystemInfo, "", "")
 	})
 
 	It("returns the container's grace time", func() {
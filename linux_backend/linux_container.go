@@ -2,22 +2,27 @@ package linux_backend
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cloudfoundry-incubator/garden/warden"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/cgroups_manager"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/quota_manager"
 	"github.com/cloudfoundry/gunk/command_runner"
@@ -32,6 +37,9 @@ type LinuxContainer struct {
 
 	graceTime time.Duration
 
+	dnsConfig DNSConfig
+	mtu       uint32
+
 	state      State
 	stateMutex sync.RWMutex
 
@@ -47,13 +55,14 @@ type LinuxContainer struct {
 	cgroupsManager   cgroups_manager.CgroupsManager
 	quotaManager     quota_manager.QuotaManager
 	bandwidthManager bandwidth_manager.BandwidthManager
+	networkManager   network_manager.NetworkManager
 
 	processTracker process_tracker.ProcessTracker
 
 	oomMutex    sync.RWMutex
 	oomNotifier *exec.Cmd
 
-	currentBandwidthLimits *warden.BandwidthLimits
+	currentBandwidthLimits *bandwidth_manager.Limits
 	bandwidthMutex         sync.RWMutex
 
 	currentDiskLimits *warden.DiskLimits
@@ -70,20 +79,92 @@ type LinuxContainer struct {
 
 	netOuts      []NetOutSpec
 	netOutsMutex sync.RWMutex
+
+	// traffic accounted before the container's chains were last set up, e.g.
+	// before the server restarted
+	previousAccounting map[string]network_manager.Traffic
+
+	// the totals as last read, which snapshots record rather than reading
+	// the counters each time the container changes
+	lastAccounting map[string]network_manager.Traffic
+
+	accountingMutex sync.RWMutex
+
+	onChange      func()
+	onChangeMutex sync.RWMutex
 }
 
+// NetInSpec maps PortCount consecutive host ports, from HostPort, to
+// container ports, from ContainerPort. A PortCount of 0 maps one port.
+//
+// HostIP is the IPv4 host address to map from: empty for the server's
+// external IP, or 0.0.0.0 for any of the host's addresses.
 type NetInSpec struct {
+	HostIP        string
 	HostPort      uint32
 	ContainerPort uint32
+	PortCount     uint32
+	Protocol      Protocol
 }
 
 type NetOutSpec struct {
-	Network string
-	Port    uint32
+	Network   string
+	Networks  []string
+	IPRange   IPRange
+	Port      uint32
+	PortRange PortRange
+	Protocol  Protocol
+}
+
+type IPRange struct {
+	Start string
+	End   string
+}
+
+type PortRange struct {
+	Start uint32
+	End   uint32
+}
+
+type Protocol string
+
+const (
+	ProtocolTCP  = Protocol("tcp")
+	ProtocolUDP  = Protocol("udp")
+	ProtocolICMP = Protocol("icmp")
+	ProtocolAll  = Protocol("all")
+)
+
+// denials logged by the network manager are registered as events with this
+// prefix, e.g. "egress denied: tcp to 10.0.0.1:80"
+const DenialEventPrefix = "egress denied: "
+
+const MaxDenialEvents = 10
+
+// limits that could not be re-applied when restoring the container are
+// registered as events with this prefix, e.g. "failed to restore cpu limits:
+// ..."
+const LimitRestoreFailedEventPrefix = "failed to restore "
+
+type UnknownNetInError struct {
+	Spec NetInSpec
+}
+
+func (e UnknownNetInError) Error() string {
+	return fmt.Sprintf("unknown net-in: host port %d to container port %d (%s)", e.Spec.HostPort, e.Spec.ContainerPort, e.Spec.Protocol)
+}
+
+type UnknownNetOutError struct {
+	Spec NetOutSpec
+}
+
+func (e UnknownNetOutError) Error() string {
+	return fmt.Sprintf("unknown net-out: %+v", e.Spec)
 }
 
 type PortPool interface {
 	Acquire() (uint32, error)
+	AcquireRange(count uint32) (uint32, error)
 	Remove(uint32) error
 	Release(uint32)
 }
@@ -100,12 +181,15 @@ func NewLinuxContainer(
 	id, handle, path string,
 	properties warden.Properties,
 	graceTime time.Duration,
+	dnsConfig DNSConfig,
+	mtu uint32,
 	resources *Resources,
 	portPool PortPool,
 	runner command_runner.CommandRunner,
 	cgroupsManager cgroups_manager.CgroupsManager,
 	quotaManager quota_manager.QuotaManager,
 	bandwidthManager bandwidth_manager.BandwidthManager,
+	networkManager network_manager.NetworkManager,
 	processTracker process_tracker.ProcessTracker,
 ) *LinuxContainer {
 	return &LinuxContainer{
@@ -117,9 +201,14 @@ func NewLinuxContainer(
 
 		graceTime: graceTime,
 
+		dnsConfig: dnsConfig,
+		mtu:       mtu,
+
 		state:  StateBorn,
 		events: []string{},
 
+		previousAccounting: map[string]network_manager.Traffic{},
+
 		resources: resources,
 
 		portPool: portPool,
@@ -129,6 +218,7 @@ func NewLinuxContainer(
 		cgroupsManager:   cgroupsManager,
 		quotaManager:     quotaManager,
 		bandwidthManager: bandwidthManager,
+		networkManager:   networkManager,
 
 		processTracker: processTracker, //process_tracker.New(path, runner),
 	}
@@ -146,6 +236,14 @@ func (c *LinuxContainer) GraceTime() time.Duration {
 	return c.graceTime
 }
 
+func (c *LinuxContainer) DNSConfig() DNSConfig {
+	return c.dnsConfig
+}
+
+func (c *LinuxContainer) MTU() uint32 {
+	return c.mtu
+}
+
 func (c *LinuxContainer) Properties() warden.Properties {
 	return c.properties
 }
@@ -203,6 +301,13 @@ func (c *LinuxContainer) Snapshot(out io.Writer) error {
 		)
 	}
 
+	c.accountingMutex.RLock()
+	accounting := c.lastAccounting
+	if accounting == nil {
+		accounting = c.previousAccounting
+	}
+	c.accountingMutex.RUnlock()
+
 	return json.NewEncoder(out).Encode(
 		ContainerSnapshot{
 			ID:     c.id,
@@ -210,25 +315,31 @@ func (c *LinuxContainer) Snapshot(out io.Writer) error {
 
 			GraceTime: c.graceTime,
 
+			DNS: c.dnsConfig,
+			MTU: c.mtu,
+
 			State:  string(c.State()),
 			Events: c.Events(),
 
 			Limits: LimitsSnapshot{
-				Bandwidth: c.currentBandwidthLimits,
-				CPU:       c.currentCPULimits,
-				Disk:      c.currentDiskLimits,
-				Memory:    c.currentMemoryLimits,
+				BandwidthByDirection: c.currentBandwidthLimits,
+				CPU:                  c.currentCPULimits,
+				Disk:                 c.currentDiskLimits,
+				Memory:               c.currentMemoryLimits,
 			},
 
 			Resources: ResourcesSnapshot{
-				UID:     c.resources.UID,
-				Network: c.resources.Network,
-				Ports:   c.resources.Ports,
+				UID:         c.resources.UID,
+				Network:     c.resources.Network,
+				IPv6Network: c.resources.IPv6Network,
+				Ports:       c.resources.Ports,
 			},
 
 			NetIns:  c.netIns,
 			NetOuts: c.netOuts,
 
+			Accounting: accounting,
+
 			Processes: processSnapshots,
 
 			Properties: c.Properties(),
@@ -243,36 +354,38 @@ func (c *LinuxContainer) Restore(snapshot ContainerSnapshot) error {
 		c.registerEvent(ev)
 	}
 
-	if snapshot.Limits.Memory != nil {
-		err := c.LimitMemory(*snapshot.Limits.Memory)
-		if err != nil {
-			return err
-		}
-	}
+	c.restoreLimits(snapshot.Limits)
 
 	for _, process := range snapshot.Processes {
 		c.processTracker.Restore(process.ID, process.TTY)
 	}
 
-	net := &exec.Cmd{
-		Path: path.Join(c.path, "net.sh"),
-		Args: []string{"setup"},
+	// setting up the chains resets their counters
+	c.accountingMutex.Lock()
+	for bucket, traffic := range snapshot.Accounting {
+		c.previousAccounting[bucket] = traffic
 	}
+	c.accountingMutex.Unlock()
 
-	err := c.runner.Run(net)
+	err := c.networkManager.Setup()
+	if err != nil {
+		return err
+	}
+
+	err = c.networkManager.WatchDenials(c.registerDenial)
 	if err != nil {
 		return err
 	}
 
 	for _, in := range snapshot.NetIns {
-		_, _, err = c.NetIn(in.HostPort, in.ContainerPort)
+		_, err = c.AddNetIn(in)
 		if err != nil {
 			return err
 		}
 	}
 
 	for _, out := range snapshot.NetOuts {
-		err = c.NetOut(out.Network, out.Port)
+		err = c.AddNetOut(out)
 		if err != nil {
 			return err
 		}
@@ -281,19 +394,87 @@ func (c *LinuxContainer) Restore(snapshot ContainerSnapshot) error {
 	return nil
 }
 
+// restoreLimits re-applies each snapshotted limit. A limit that fails to be
+// re-applied is registered as an event rather than failing the restore, and
+// is still recorded so that later snapshots keep it.
+func (c *LinuxContainer) restoreLimits(limits LimitsSnapshot) {
+	if limits.Memory != nil {
+		c.checkLimitRestored("memory", c.LimitMemory(*limits.Memory))
+
+		c.memoryMutex.Lock()
+		c.currentMemoryLimits = limits.Memory
+		c.memoryMutex.Unlock()
+	}
+
+	if limits.CPU != nil {
+		c.checkLimitRestored("cpu", c.LimitCPU(*limits.CPU))
+
+		c.cpuMutex.Lock()
+		c.currentCPULimits = limits.CPU
+		c.cpuMutex.Unlock()
+	}
+
+	bandwidth := limits.BandwidthByDirection
+	if bandwidth == nil && limits.Bandwidth != nil {
+		symmetric := bandwidth_manager.SymmetricLimits(*limits.Bandwidth)
+		bandwidth = &symmetric
+	}
+
+	if bandwidth != nil {
+		c.checkLimitRestored("bandwidth", c.LimitBandwidthByDirection(*bandwidth))
+
+		c.bandwidthMutex.Lock()
+		c.currentBandwidthLimits = bandwidth
+		c.bandwidthMutex.Unlock()
+	}
+
+	if limits.Disk != nil {
+		c.checkLimitRestored("disk", c.LimitDisk(*limits.Disk))
+
+		c.diskMutex.Lock()
+		c.currentDiskLimits = limits.Disk
+		c.diskMutex.Unlock()
+	}
+}
+
+func (c *LinuxContainer) checkLimitRestored(limit string, err error) {
+	if err == nil {
+		return
+	}
+
+	log.Println(c.id, "failed to restore", limit, "limits:", err)
+
+	c.registerEvent(fmt.Sprintf("%s%s limits: %s", LimitRestoreFailedEventPrefix, limit, err))
+}
+
 func (c *LinuxContainer) Start() error {
 	log.Println(c.id, "starting")
 
+	err := c.networkManager.CreateInterfaces(c.mtu)
+	if err != nil {
+		return err
+	}
+
+	err = c.networkManager.Setup()
+	if err != nil {
+		return err
+	}
+
+	err = c.networkManager.WatchDenials(c.registerDenial)
+	if err != nil {
+		return err
+	}
+
 	start := &exec.Cmd{
 		Path: path.Join(c.path, "start.sh"),
 		Env: []string{
 			"id=" + c.id,
-			"container_iface_mtu=1500",
+			fmt.Sprintf("container_iface_mtu=%d", c.mtu),
 			"PATH=" + os.Getenv("PATH"),
 		},
 	}
 
-	err := c.runner.Run(start)
+	err = c.runner.Run(start)
 	if err != nil {
 		return err
 	}
@@ -323,13 +504,23 @@ func (c *LinuxContainer) Stop(kill bool) error {
 
 	c.setState(StateStopped)
 
+	c.changed()
+
 	return nil
 }
 
 func (c *LinuxContainer) Cleanup() {
 	c.stopOomNotifier()
 
+	c.networkManager.StopWatchingDenials()
+
 	c.processTracker.UnlinkAll()
+
+	// so that the snapshot taken as the server stops has the latest totals
+	_, err := c.Accounting()
+	if err != nil {
+		log.Println(c.id, "failed to read accounting:", err)
+	}
 }
 
 func (c *LinuxContainer) Info() (warden.ContainerInfo, error) {
@@ -365,10 +556,12 @@ func (c *LinuxContainer) Info() (warden.ContainerInfo, error) {
 	c.netInsMutex.RLock()
 
 	for _, spec := range c.netIns {
-		mappedPorts = append(mappedPorts, warden.PortMapping{
-			HostPort:      spec.HostPort,
-			ContainerPort: spec.ContainerPort,
-		})
+		for offset := uint32(0); offset < spec.portCount(); offset++ {
+			mappedPorts = append(mappedPorts, warden.PortMapping{
+				HostPort:      spec.HostPort + offset,
+				ContainerPort: spec.ContainerPort + offset,
+			})
+		}
 	}
 
 	c.netInsMutex.RUnlock()
@@ -394,6 +587,60 @@ func (c *LinuxContainer) Info() (warden.ContainerInfo, error) {
 	}, nil
 }
 
+// BandwidthStat is warden's bandwidth stat, with the traffic counters of the
+// container's host interface, which warden's stat has no room for.
+type BandwidthStat struct {
+	warden.ContainerBandwidthStat
+
+	Traffic network_manager.InterfaceStat
+}
+
+func (c *LinuxContainer) BandwidthStat() (BandwidthStat, error) {
+	limits, err := c.bandwidthManager.GetLimits()
+	if err != nil {
+		return BandwidthStat{}, err
+	}
+
+	traffic, err := c.networkManager.Stat()
+	if err != nil {
+		return BandwidthStat{}, err
+	}
+
+	return BandwidthStat{
+		ContainerBandwidthStat: limits,
+		Traffic:                traffic,
+	}, nil
+}
+
+// Accounting is the container's total traffic to each of the server's
+// accounting buckets, including traffic from before a server restart.
+//
+// Snapshots record the totals as of the last call, so traffic since then is
+// lost if the server is killed rather than stopped.
+func (c *LinuxContainer) Accounting() (map[string]network_manager.Traffic, error) {
+	current, err := c.networkManager.Accounting()
+	if err != nil {
+		return nil, err
+	}
+
+	c.accountingMutex.Lock()
+	defer c.accountingMutex.Unlock()
+
+	accounting := map[string]network_manager.Traffic{}
+
+	for bucket, traffic := range c.previousAccounting {
+		accounting[bucket] = traffic
+	}
+
+	for bucket, traffic := range current {
+		accounting[bucket] = accounting[bucket].Add(traffic)
+	}
+
+	c.lastAccounting = accounting
+
+	return accounting, nil
+}
+
 func (c *LinuxContainer) StreamIn(dstPath string, tarStream io.Reader) error {
 	log.Println(c.id, "writing data to:", dstPath)
 
@@ -453,12 +700,22 @@ func (c *LinuxContainer) StreamOut(srcPath string) (io.ReadCloser, error) {
 }
 
 func (c *LinuxContainer) LimitBandwidth(limits warden.BandwidthLimits) error {
+	return c.LimitBandwidthByDirection(bandwidth_manager.SymmetricLimits(limits))
+}
+
+// LimitBandwidthByDirection limits traffic to and from the container
+// independently.
+func (c *LinuxContainer) LimitBandwidthByDirection(limits bandwidth_manager.Limits) error {
 	log.Println(
 		c.id,
 		"limiting bandwidth to",
-		limits.RateInBytesPerSecond,
-		"bytes per second; burst",
-		limits.BurstRateInBytesPerSecond,
+		limits.IngressRate,
+		"bytes per second in; burst",
+		limits.IngressBurst,
+		"and",
+		limits.EgressRate,
+		"bytes per second out; burst",
+		limits.EgressBurst,
 	)
 
 	err := c.bandwidthManager.SetLimits(limits)
@@ -467,19 +724,34 @@ func (c *LinuxContainer) LimitBandwidth(limits warden.BandwidthLimits) error {
 	}
 
 	c.bandwidthMutex.Lock()
-	defer c.bandwidthMutex.Unlock()
-
 	c.currentBandwidthLimits = &limits
+	c.bandwidthMutex.Unlock()
+
+	c.changed()
 
 	return nil
 }
 
+// CurrentBandwidthLimits reports the ingress limits, as warden's limits are
+// symmetric.
 func (c *LinuxContainer) CurrentBandwidthLimits() (warden.BandwidthLimits, error) {
+	limits, err := c.CurrentBandwidthLimitsByDirection()
+	if err != nil {
+		return warden.BandwidthLimits{}, err
+	}
+
+	return warden.BandwidthLimits{
+		RateInBytesPerSecond:      limits.IngressRate,
+		BurstRateInBytesPerSecond: limits.IngressBurst,
+	}, nil
+}
+
+func (c *LinuxContainer) CurrentBandwidthLimitsByDirection() (bandwidth_manager.Limits, error) {
 	c.bandwidthMutex.RLock()
 	defer c.bandwidthMutex.RUnlock()
 
 	if c.currentBandwidthLimits == nil {
-		return warden.BandwidthLimits{}, nil
+		return bandwidth_manager.Limits{}, nil
 	}
 
 	return *c.currentBandwidthLimits, nil
@@ -494,9 +766,10 @@ func (c *LinuxContainer) LimitDisk(limits warden.DiskLimits) error {
 	}
 
 	c.diskMutex.Lock()
-	defer c.diskMutex.Unlock()
-
 	c.currentDiskLimits = &limits
+	c.diskMutex.Unlock()
+
+	c.changed()
 
 	return nil
 }
@@ -530,9 +803,10 @@ func (c *LinuxContainer) LimitMemory(limits warden.MemoryLimits) error {
 	}
 
 	c.memoryMutex.Lock()
-	defer c.memoryMutex.Unlock()
-
 	c.currentMemoryLimits = &limits
+	c.memoryMutex.Unlock()
+
+	c.changed()
 
 	return nil
 }
@@ -562,9 +836,10 @@ func (c *LinuxContainer) LimitCPU(limits warden.CPULimits) error {
 	}
 
 	c.cpuMutex.Lock()
-	defer c.cpuMutex.Unlock()
-
 	c.currentCPULimits = &limits
+	c.cpuMutex.Unlock()
+
+	c.changed()
 
 	return nil
 }
@@ -612,7 +887,14 @@ func (c *LinuxContainer) Run(spec warden.ProcessSpec, processIO warden.ProcessIO
 
 	setRLimitsEnv(wsh, spec.Limits)
 
-	return c.processTracker.Run(wsh, processIO, spec.TTY)
+	process, err := c.processTracker.Run(wsh, processIO, spec.TTY)
+	if err != nil {
+		return nil, err
+	}
+
+	c.changed()
+
+	return process, nil
 }
 
 func (c *LinuxContainer) Attach(processID uint32, processIO warden.ProcessIO) (warden.Process, error) {
@@ -620,100 +902,525 @@ func (c *LinuxContainer) Attach(processID uint32, processIO warden.ProcessIO) (w
 	return c.processTracker.Attach(processID, processIO)
 }
 
+// AttachFrom attaches to a process like Attach, but replays its output from
+// the given offsets rather than from the start of the scrollback, e.g. so that
+// a client reconnecting doesn't receive output twice.
+func (c *LinuxContainer) AttachFrom(processID uint32, processIO warden.ProcessIO, offsets process_tracker.OutputOffsets) (warden.Process, error) {
+	log.Println(c.id, "attaching to process", processID, "from", offsets.Stdout, offsets.Stderr)
+	return c.processTracker.AttachFrom(processID, processIO, offsets)
+}
+
+// Signal sends the signal to a single process running in the container,
+// leaving the others untouched. The signal is forwarded into the container by
+// wsh, so SIGKILL and SIGSTOP, which wsh cannot catch, only reach wsh itself.
+func (c *LinuxContainer) Signal(processID uint32, signal syscall.Signal) error {
+	log.Println(c.id, "signalling process", processID, "with", signal)
+	return c.processTracker.Signal(processID, signal)
+}
+
+// ReadLogs returns a process's logged output, or the last tail chunks of it
+// if tail is positive. Output is only logged if the server is configured to.
+func (c *LinuxContainer) ReadLogs(processID uint32, tail int) ([]process_tracker.LogChunk, error) {
+	return c.processTracker.ReadLogs(processID, tail)
+}
+
 func (c *LinuxContainer) NetIn(hostPort uint32, containerPort uint32) (uint32, uint32, error) {
-	if hostPort == 0 {
-		randomPort, err := c.portPool.Acquire()
+	spec, err := c.AddNetIn(NetInSpec{
+		HostPort:      hostPort,
+		ContainerPort: containerPort,
+		Protocol:      ProtocolTCP,
+	})
+
+	return spec.HostPort, spec.ContainerPort, err
+}
+
+// AddNetIn maps a host port, or range of ports, to a container port for the
+// spec's protocol; ProtocolAll maps both tcp and udp. Missing ports are filled
+// in the same way as NetIn, a missing range being acquired from the port pool
+// as a whole, and the spec that was applied is returned.
+func (c *LinuxContainer) AddNetIn(spec NetInSpec) (NetInSpec, error) {
+	spec = spec.withDefaults()
+
+	switch spec.Protocol {
+	case ProtocolTCP, ProtocolUDP, ProtocolAll:
+	default:
+		return NetInSpec{}, fmt.Errorf("cannot map ports for protocol %s", spec.Protocol)
+	}
+
+	if spec.HostIP != "" {
+		hostIP := net.ParseIP(spec.HostIP)
+		if hostIP == nil || (hostIP.To4() == nil && !hostIP.IsUnspecified()) {
+			return NetInSpec{}, fmt.Errorf("cannot map ports from host IP %s (must be an IPv4 address or 0.0.0.0)", spec.HostIP)
+		}
+	}
+
+	count := spec.portCount()
+
+	acquired := false
+
+	if spec.HostPort == 0 {
+		var firstPort uint32
+		var err error
+
+		if count == 1 {
+			firstPort, err = c.portPool.Acquire()
+		} else {
+			firstPort, err = c.portPool.AcquireRange(count)
+		}
+
 		if err != nil {
-			return 0, 0, err
+			return NetInSpec{}, err
 		}
 
-		c.resources.AddPort(randomPort)
+		for port := firstPort; port < firstPort+count; port++ {
+			c.resources.AddPort(port)
+		}
 
-		hostPort = randomPort
+		spec.HostPort = firstPort
+		acquired = true
 	}
 
-	if containerPort == 0 {
-		containerPort = hostPort
+	if spec.ContainerPort == 0 {
+		spec.ContainerPort = spec.HostPort
+	}
+
+	if uint64(spec.HostPort)+uint64(count) > 65536 || uint64(spec.ContainerPort)+uint64(count) > 65536 {
+		if acquired {
+			c.releasePorts(spec.HostPort, count)
+		}
+
+		return NetInSpec{}, fmt.Errorf("cannot map %d ports from host port %d to container port %d: range exceeds 65535", count, spec.HostPort, spec.ContainerPort)
 	}
 
 	log.Println(
 		c.id,
 		"mapping host port",
-		hostPort,
+		spec.HostPort,
 		"to container port",
-		containerPort,
+		spec.ContainerPort,
+		"for",
+		spec.Protocol,
+		"ports:",
+		count,
+		"host IP:",
+		spec.HostIP,
 	)
 
-	net := &exec.Cmd{
-		Path: path.Join(c.path, "net.sh"),
-		Args: []string{"in"},
-		Env: []string{
-			fmt.Sprintf("HOST_PORT=%d", hostPort),
-			fmt.Sprintf("CONTAINER_PORT=%d", containerPort),
-			"PATH=" + os.Getenv("PATH"),
-		},
-	}
-
-	err := c.runner.Run(net)
+	err := c.networkManager.NetIn(spec.portMapping())
 	if err != nil {
-		return 0, 0, err
+		if acquired {
+			c.releasePorts(spec.HostPort, count)
+		}
+
+		return NetInSpec{}, err
 	}
 
 	c.netInsMutex.Lock()
-	defer c.netInsMutex.Unlock()
+	c.netIns = append(c.netIns, spec)
+	c.netInsMutex.Unlock()
 
-	c.netIns = append(c.netIns, NetInSpec{hostPort, containerPort})
+	c.changed()
 
-	return hostPort, containerPort, nil
+	return spec, nil
 }
 
+// releasePorts returns acquired ports to the pool
+func (c *LinuxContainer) releasePorts(firstPort, count uint32) {
+	for port := firstPort; port < firstPort+count; port++ {
+		if c.resources.RemovePort(port) {
+			c.portPool.Release(port)
+		}
+	}
+}
+
+// NetOut permits outbound traffic to the network and/or port. The network
+// may also be a comma-separated list of networks, e.g. "10.0.0.0/8,1.2.3.4",
+// or a range of IPs, e.g. "10.0.0.1-10.0.0.9".
 func (c *LinuxContainer) NetOut(network string, port uint32) error {
-	net := &exec.Cmd{
-		Path: path.Join(c.path, "net.sh"),
-		Args: []string{"out"},
-	}
-
-	if port != 0 {
-		log.Println(
-			c.id,
-			"permitting traffic to",
-			network,
-			"with port",
-			port,
-		)
+	spec, err := parseNetOutNetwork(network)
+	if err != nil {
+		return err
+	}
 
-		net.Env = []string{
-			"NETWORK=" + network,
-			fmt.Sprintf("PORT=%d", port),
-			"PATH=" + os.Getenv("PATH"),
+	spec.Port = port
+
+	return c.AddNetOut(spec)
+}
+
+// AddNetOut permits outbound traffic to the spec's destinations and/or
+// ports for its protocol, using a single rule however many networks or ports
+// it covers. Without a protocol, traffic to a port is restricted to tcp, and
+// traffic to a network is permitted for all protocols, like NetOut.
+func (c *LinuxContainer) AddNetOut(spec NetOutSpec) error {
+	spec = spec.withDefaultProtocol()
+
+	err := spec.validate()
+	if err != nil {
+		return err
+	}
+
+	log.Println(c.id, "permitting", spec)
+
+	err = c.networkManager.NetOut(spec.egressRule())
+	if err != nil {
+		return err
+	}
+
+	c.netOutsMutex.Lock()
+	c.netOuts = append(c.netOuts, spec)
+	c.netOutsMutex.Unlock()
+
+	c.changed()
+
+	return nil
+}
+
+// RemoveNetIn undoes a mapping made by NetIn or AddNetIn. A host port that
+// was acquired from the port pool is released once no mapping uses it.
+//
+// warden.Container has no verb for revoking mappings or rules, so this and
+// RemoveNetOut are only available to callers holding a *LinuxContainer.
+func (c *LinuxContainer) RemoveNetIn(spec NetInSpec) error {
+	err := c.removeNetIn(spec)
+	if err != nil {
+		return err
+	}
+
+	c.changed()
+
+	return nil
+}
+
+func (c *LinuxContainer) removeNetIn(spec NetInSpec) error {
+	spec = spec.withDefaults()
+
+	if spec.ContainerPort == 0 {
+		spec.ContainerPort = spec.HostPort
+	}
+
+	c.netInsMutex.Lock()
+	defer c.netInsMutex.Unlock()
+
+	index := -1
+	for i, in := range c.netIns {
+		if in == spec {
+			index = i
+			break
 		}
-	} else {
-		if network == "" {
-			return fmt.Errorf("network and/or port must be provided")
+	}
+
+	if index == -1 {
+		return UnknownNetInError{spec}
+	}
+
+	log.Println(
+		c.id,
+		"unmapping host port",
+		spec.HostPort,
+		"from container port",
+		spec.ContainerPort,
+		"for",
+		spec.Protocol,
+		"ports:",
+		spec.portCount(),
+	)
+
+	err := c.networkManager.RemoveNetIn(spec.portMapping())
+	if err != nil {
+		return err
+	}
+
+	c.netIns = append(c.netIns[:index], c.netIns[index+1:]...)
+
+	for port := spec.HostPort; port < spec.HostPort+spec.portCount(); port++ {
+		if c.hostPortMapped(port) {
+			continue
 		}
 
-		log.Println(c.id, "permitting traffic to", network)
+		c.releasePorts(port, 1)
+	}
 
-		net.Env = []string{
-			"NETWORK=" + network,
-			"PORT=",
-			"PATH=" + os.Getenv("PATH"),
+	return nil
+}
+
+// hostPortMapped is whether any of the remaining mappings use the port
+func (c *LinuxContainer) hostPortMapped(port uint32) bool {
+	for _, in := range c.netIns {
+		if port >= in.HostPort && port < in.HostPort+in.portCount() {
+			return true
 		}
 	}
 
-	err := c.runner.Run(net)
+	return false
+}
+
+// RemoveNetOut undoes a rule added by NetOut or AddNetOut.
+func (c *LinuxContainer) RemoveNetOut(spec NetOutSpec) error {
+	err := c.removeNetOut(spec)
 	if err != nil {
 		return err
 	}
 
+	c.changed()
+
+	return nil
+}
+
+func (c *LinuxContainer) removeNetOut(spec NetOutSpec) error {
+	spec = spec.withDefaultProtocol()
+
 	c.netOutsMutex.Lock()
 	defer c.netOutsMutex.Unlock()
 
-	c.netOuts = append(c.netOuts, NetOutSpec{network, port})
+	index := -1
+	// rules are the same if they are applied the same way
+	for i, out := range c.netOuts {
+		if reflect.DeepEqual(out.egressRule(), spec.egressRule()) {
+			index = i
+			break
+		}
+	}
+
+	if index == -1 {
+		return UnknownNetOutError{spec}
+	}
+
+	log.Println(c.id, "revoking", spec)
+
+	err := c.networkManager.RemoveNetOut(spec.egressRule())
+	if err != nil {
+		return err
+	}
+
+	c.netOuts = append(c.netOuts[:index], c.netOuts[index+1:]...)
+
+	return nil
+}
+
+// withDefaults maps tcp, and records a single port as a PortCount of 0, so
+// that specs that map the same way are equal
+func (spec NetInSpec) withDefaults() NetInSpec {
+	if spec.Protocol == "" {
+		spec.Protocol = ProtocolTCP
+	}
+
+	if spec.PortCount == 1 {
+		spec.PortCount = 0
+	}
+
+	return spec
+}
+
+func (spec NetInSpec) portCount() uint32 {
+	if spec.PortCount == 0 {
+		return 1
+	}
+
+	return spec.PortCount
+}
+
+func (spec NetInSpec) portMapping() network_manager.PortMapping {
+	mapping := network_manager.PortMapping{
+		HostPort:      spec.HostPort,
+		ContainerPort: spec.ContainerPort,
+		PortCount:     spec.PortCount,
+		Protocol:      string(spec.Protocol),
+	}
+
+	if spec.HostIP != "" {
+		mapping.HostIP = net.ParseIP(spec.HostIP)
+	}
+
+	return mapping
+}
+
+// parseNetOutNetwork parses NetOut's network into the spec's networks or IP
+// range
+func parseNetOutNetwork(network string) (NetOutSpec, error) {
+	if network == "" {
+		return NetOutSpec{}, nil
+	}
+
+	// hostnames may contain hyphens too, so only an IP on the left makes a range
+	if bounds := strings.Split(network, "-"); len(bounds) > 1 && net.ParseIP(strings.TrimSpace(bounds[0])) != nil {
+		if len(bounds) != 2 {
+			return NetOutSpec{}, fmt.Errorf("invalid IP range: %s", network)
+		}
+
+		return NetOutSpec{
+			IPRange: IPRange{
+				Start: strings.TrimSpace(bounds[0]),
+				End:   strings.TrimSpace(bounds[1]),
+			},
+		}, nil
+	}
+
+	networks := strings.Split(network, ",")
+
+	for i, listed := range networks {
+		networks[i] = strings.TrimSpace(listed)
+
+		if networks[i] == "" {
+			return NetOutSpec{}, fmt.Errorf("empty network in list: %s", network)
+		}
+	}
+
+	if len(networks) == 1 {
+		return NetOutSpec{Network: networks[0]}, nil
+	}
+
+	return NetOutSpec{Networks: networks}, nil
+}
+
+func (spec NetOutSpec) withDefaultProtocol() NetOutSpec {
+	if spec.Protocol == "" {
+		if spec.Port != 0 || spec.PortRange != (PortRange{}) {
+			spec.Protocol = ProtocolTCP
+		} else {
+			spec.Protocol = ProtocolAll
+		}
+	}
+
+	return spec
+}
+
+func (spec NetOutSpec) egressRule() network_manager.EgressRule {
+	rule := network_manager.EgressRule{
+		Networks: spec.networks(),
+		Port:     spec.Port,
+		Protocol: string(spec.Protocol),
+	}
+
+	if spec.IPRange != (IPRange{}) {
+		rule.IPRange = spec.IPRange.Start + "-" + spec.IPRange.End
+	}
+
+	if spec.PortRange != (PortRange{}) {
+		rule.PortRange = fmt.Sprintf("%d:%d", spec.PortRange.Start, spec.PortRange.End)
+	}
+
+	return rule
+}
+
+// String describes the traffic covered, e.g.
+// "tcp traffic to 1.2.3.4/22,5.6.7.8 on port 567".
+func (spec NetOutSpec) String() string {
+	rule := spec.egressRule()
+
+	destinations := rule.Networks
+	if rule.IPRange != "" {
+		destinations = append(destinations, rule.IPRange)
+	}
+
+	description := rule.Protocol + " traffic to "
+
+	if len(destinations) == 0 {
+		description += "any network"
+	} else {
+		description += strings.Join(destinations, ",")
+	}
+
+	if rule.Port != 0 {
+		description += fmt.Sprintf(" on port %d", rule.Port)
+	}
+
+	if spec.PortRange != (PortRange{}) {
+		description += fmt.Sprintf(" on ports %d-%d", spec.PortRange.Start, spec.PortRange.End)
+	}
+
+	return description
+}
+
+func (spec NetOutSpec) networks() []string {
+	networks := []string{}
+
+	if spec.Network != "" {
+		networks = append(networks, spec.Network)
+	}
+
+	return append(networks, spec.Networks...)
+}
+
+func (spec NetOutSpec) validate() error {
+	networks := spec.networks()
+	hasIPRange := spec.IPRange != (IPRange{})
+	hasPortRange := spec.PortRange != (PortRange{})
+
+	switch spec.Protocol {
+	case ProtocolTCP, ProtocolUDP:
+	case ProtocolICMP, ProtocolAll:
+		if spec.Port != 0 || hasPortRange {
+			return fmt.Errorf("a port can only be given for tcp or udp, not %s", spec.Protocol)
+		}
+	default:
+		return fmt.Errorf("unknown protocol: %s", spec.Protocol)
+	}
+
+	if len(networks) > 0 && hasIPRange {
+		return fmt.Errorf("networks and an IP range cannot be given together")
+	}
+
+	if spec.Port != 0 && hasPortRange {
+		return fmt.Errorf("a port and a port range cannot be given together")
+	}
+
+	if len(networks) == 0 && !hasIPRange && spec.Port == 0 && !hasPortRange && spec.Protocol == ProtocolAll {
+		return fmt.Errorf("network, port, and/or protocol must be provided")
+	}
+
+	ipv6 := 0
+	for _, network := range networks {
+		if strings.Contains(network, ":") {
+			ipv6++
+		}
+	}
+
+	if ipv6 != 0 && ipv6 != len(networks) {
+		return fmt.Errorf("IPv4 and IPv6 networks cannot be mixed in one rule: %v", networks)
+	}
+
+	if hasIPRange {
+		start := net.ParseIP(spec.IPRange.Start)
+		end := net.ParseIP(spec.IPRange.End)
+
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+			return fmt.Errorf("invalid IP range: %s-%s", spec.IPRange.Start, spec.IPRange.End)
+		}
+
+		if bytes.Compare(start.To16(), end.To16()) > 0 {
+			return fmt.Errorf("invalid IP range: %s-%s", spec.IPRange.Start, spec.IPRange.End)
+		}
+	}
+
+	if hasPortRange {
+		if spec.PortRange.Start == 0 || spec.PortRange.Start > spec.PortRange.End || spec.PortRange.End > 65535 {
+			return fmt.Errorf("invalid port range: %d-%d", spec.PortRange.Start, spec.PortRange.End)
+		}
+	}
 
 	return nil
 }
 
+// OnChange registers a callback to run whenever the container's state
+// changes, e.g. its limits, net rules, resources or processes, so that it can
+// be persisted.
+func (c *LinuxContainer) OnChange(callback func()) {
+	c.onChangeMutex.Lock()
+	defer c.onChangeMutex.Unlock()
+
+	c.onChange = callback
+}
+
+func (c *LinuxContainer) changed() {
+	c.onChangeMutex.RLock()
+	callback := c.onChange
+	c.onChangeMutex.RUnlock()
+
+	if callback != nil {
+		callback()
+	}
+}
+
 func (c *LinuxContainer) setState(state State) {
 	c.stateMutex.Lock()
 	defer c.stateMutex.Unlock()
@@ -728,6 +1435,39 @@ func (c *LinuxContainer) registerEvent(event string) {
 	c.events = append(c.events, event)
 }
 
+// registerDenial records a denial as an event, keeping only the most recent
+// distinct denials so that a chatty app cannot grow the events unboundedly
+func (c *LinuxContainer) registerDenial(denial network_manager.Denial) {
+	event := DenialEventPrefix + denial.String()
+
+	log.Println(c.id, event)
+
+	c.eventsMutex.Lock()
+	defer c.eventsMutex.Unlock()
+
+	events := []string{}
+	denials := []int{}
+
+	for _, ev := range c.events {
+		if ev == event {
+			continue
+		}
+
+		if strings.HasPrefix(ev, DenialEventPrefix) {
+			denials = append(denials, len(events))
+		}
+
+		events = append(events, ev)
+	}
+
+	if len(denials) >= MaxDenialEvents {
+		oldest := denials[0]
+		events = append(events[:oldest], events[oldest+1:]...)
+	}
+
+	c.events = append(events, event)
+}
+
 func (c *LinuxContainer) startOomNotifier() error {
 	c.oomMutex.Lock()
 	defer c.oomMutex.Unlock()
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -21,13 +22,18 @@ import (
 
 	"github.com/cloudfoundry-incubator/garden/warden"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager/fake_bandwidth_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/cgroups_manager/fake_cgroups_manager"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager/fake_links"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager/fake_network_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/port_pool/fake_port_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker/fake_process_tracker"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/quota_manager/fake_quota_manager"
+	"github.com/cloudfoundry-incubator/warden-linux/sysconfig"
 	"github.com/cloudfoundry/gunk/command_runner/fake_command_runner"
 	. "github.com/cloudfoundry/gunk/command_runner/fake_command_runner/matchers"
 )
@@ -35,6 +41,7 @@ import (
 var fakeCgroups *fake_cgroups_manager.FakeCgroupsManager
 var fakeQuotaManager *fake_quota_manager.FakeQuotaManager
 var fakeBandwidthManager *fake_bandwidth_manager.FakeBandwidthManager
+var fakeNetworkManager *fake_network_manager.FakeNetworkManager
 var fakeRunner *fake_command_runner.FakeCommandRunner
 var containerResources *linux_backend.Resources
 var container *linux_backend.LinuxContainer
@@ -49,6 +56,7 @@ var _ = Describe("Linux containers", func() {
 
 		fakeQuotaManager = fake_quota_manager.New()
 		fakeBandwidthManager = fake_bandwidth_manager.New()
+		fakeNetworkManager = fake_network_manager.New()
 		fakeProcessTracker = new(fake_process_tracker.FakeProcessTracker)
 
 		_, ipNet, err := net.ParseCIDR("10.254.0.0/24")
@@ -56,14 +64,21 @@ var _ = Describe("Linux containers", func() {
 
 		fakePortPool = fake_port_pool.New(1000)
 
-		networkPool := network_pool.New(ipNet)
+		networkPool := network_pool.New(ipNet, 30, 0)
 
 		network, err := networkPool.Acquire()
 		Ω(err).ShouldNot(HaveOccurred())
 
+		_, ipv6Net, err := net.ParseCIDR("fd00:10:254::/112")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		ipv6Network, err := network_pool.New(ipv6Net, 126, 0).Acquire()
+		Ω(err).ShouldNot(HaveOccurred())
+
 		containerResources = linux_backend.NewResources(
 			1234,
 			network,
+			ipv6Network,
 			[]uint32{},
 		)
 
@@ -75,16 +90,53 @@ var _ = Describe("Linux containers", func() {
 				"property-name": "property-value",
 			},
 			1*time.Second,
+			linux_backend.DNSConfig{
+				Nameservers: []string{"8.8.8.8"},
+			},
+			1400,
 			containerResources,
 			fakePortPool,
 			fakeRunner,
 			fakeCgroups,
 			fakeQuotaManager,
 			fakeBandwidthManager,
+			fakeNetworkManager,
 			fakeProcessTracker,
 		)
 	})
 
+	// containerWithLinks has a real network manager, so that what happens to
+	// the container's interfaces can be seen in the fake links
+	containerWithLinks := func(fakeLinks *fake_links.FakeLinks) *linux_backend.LinuxContainer {
+		return linux_backend.NewLinuxContainer(
+			"some-id",
+			"some-handle",
+			"/depot/some-id",
+			nil,
+			1*time.Second,
+			linux_backend.DNSConfig{},
+			1400,
+			containerResources,
+			fakePortPool,
+			fakeRunner,
+			fakeCgroups,
+			fakeQuotaManager,
+			fakeBandwidthManager,
+			network_manager.New(
+				sysconfig.NewConfig("0"),
+				"some-id",
+				containerResources.Network,
+				containerResources.IPv6Network,
+				net.ParseIP("1.2.3.4"),
+				network_manager.Policy{},
+				nil,
+				fakeLinks,
+				fakeRunner,
+			),
+			fakeProcessTracker,
+		)
+	}
+
 	Describe("Snapshotting", func() {
 		memoryLimits := warden.MemoryLimits{
 			LimitInBytes: 1,
@@ -128,6 +180,12 @@ var _ = Describe("Linux containers", func() {
 			err = container.NetOut("network-b", 2)
 			Ω(err).ShouldNot(HaveOccurred())
 
+			err = container.AddNetOut(linux_backend.NetOutSpec{
+				Network:  "network-c",
+				Protocol: linux_backend.ProtocolICMP,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
 			p1 := new(fake_process_tracker.FakeLinuxProcess)
 			p1.IDReturns(1)
 			p1.WithTTYReturns(true)
@@ -141,6 +199,14 @@ var _ = Describe("Linux containers", func() {
 			p3.WithTTYReturns(true)
 
 			fakeProcessTracker.ActiveProcessesReturns([]process_tracker.LinuxProcess{p1, p2, p3})
+
+			fakeNetworkManager.AccountingResult = map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+				"other":    {Bytes: 2048, Packets: 16},
+			}
+
+			_, err = container.Accounting()
+			Ω(err).ShouldNot(HaveOccurred())
 		})
 
 		It("writes a JSON ContainerSnapshot", func() {
@@ -159,13 +225,19 @@ var _ = Describe("Linux containers", func() {
 
 			Ω(snapshot.GraceTime).Should(Equal(1 * time.Second))
 
+			Ω(snapshot.DNS).Should(Equal(linux_backend.DNSConfig{
+				Nameservers: []string{"8.8.8.8"},
+			}))
+			Ω(snapshot.MTU).Should(Equal(uint32(1400)))
+
 			Ω(snapshot.State).Should(Equal("active"))
 
 			Ω(snapshot.Resources).Should(Equal(
 				linux_backend.ResourcesSnapshot{
-					UID:     containerResources.UID,
-					Network: containerResources.Network,
-					Ports:   containerResources.Ports,
+					UID:         containerResources.UID,
+					Network:     containerResources.Network,
+					IPv6Network: containerResources.IPv6Network,
+					Ports:       containerResources.Ports,
 				},
 			))
 
@@ -174,10 +246,12 @@ var _ = Describe("Linux containers", func() {
 					{
 						HostPort:      1,
 						ContainerPort: 2,
+						Protocol:      linux_backend.ProtocolTCP,
 					},
 					{
 						HostPort:      3,
 						ContainerPort: 4,
+						Protocol:      linux_backend.ProtocolTCP,
 					},
 				},
 			))
@@ -185,16 +259,27 @@ var _ = Describe("Linux containers", func() {
 			Ω(snapshot.NetOuts).Should(Equal(
 				[]linux_backend.NetOutSpec{
 					{
-						Network: "network-a",
-						Port:    1,
+						Network:  "network-a",
+						Port:     1,
+						Protocol: linux_backend.ProtocolTCP,
+					},
+					{
+						Network:  "network-b",
+						Port:     2,
+						Protocol: linux_backend.ProtocolTCP,
 					},
 					{
-						Network: "network-b",
-						Port:    2,
+						Network:  "network-c",
+						Protocol: linux_backend.ProtocolICMP,
 					},
 				},
 			))
 
+			Ω(snapshot.Accounting).Should(Equal(map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+				"other":    {Bytes: 2048, Packets: 16},
+			}))
+
 			Ω(snapshot.Processes).Should(ContainElement(
 				linux_backend.ProcessSnapshot{
 					ID:  1,
@@ -221,6 +306,27 @@ var _ = Describe("Linux containers", func() {
 			})))
 		})
 
+		It("records the accounting totals as last read, without reading the counters", func() {
+			fakeNetworkManager.AccountingResult = map[string]network_manager.Traffic{
+				"internal": {Bytes: 4096, Packets: 32},
+			}
+
+			out := new(bytes.Buffer)
+
+			err := container.Snapshot(out)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var snapshot linux_backend.ContainerSnapshot
+
+			err = json.NewDecoder(out).Decode(&snapshot)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(snapshot.Accounting).Should(Equal(map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+				"other":    {Bytes: 2048, Packets: 16},
+			}))
+		})
+
 		Context("with limits set", func() {
 			BeforeEach(func() {
 				err := container.LimitMemory(memoryLimits)
@@ -256,10 +362,15 @@ var _ = Describe("Linux containers", func() {
 
 				Ω(snapshot.Limits).Should(Equal(
 					linux_backend.LimitsSnapshot{
-						Memory:    &memoryLimits,
-						Disk:      &diskLimits,
-						Bandwidth: &bandwidthLimits,
-						CPU:       &cpuLimits,
+						Memory: &memoryLimits,
+						Disk:   &diskLimits,
+						BandwidthByDirection: &bandwidth_manager.Limits{
+							IngressRate:  1,
+							IngressBurst: 2,
+							EgressRate:   1,
+							EgressBurst:  2,
+						},
+						CPU: &cpuLimits,
 					},
 				))
 			})
@@ -279,10 +390,11 @@ var _ = Describe("Linux containers", func() {
 
 				Ω(snapshot.Limits).Should(Equal(
 					linux_backend.LimitsSnapshot{
-						Memory:    nil,
-						Disk:      nil,
-						Bandwidth: nil,
-						CPU:       nil,
+						Memory:               nil,
+						Disk:                 nil,
+						Bandwidth:            nil,
+						BandwidthByDirection: nil,
+						CPU:                  nil,
 					},
 				))
 
@@ -306,6 +418,18 @@ var _ = Describe("Linux containers", func() {
 
 		})
 
+		It("keeps the container's interfaces", func() {
+			fakeLinks := fake_links.New()
+
+			err := containerWithLinks(fakeLinks).Restore(linux_backend.ContainerSnapshot{
+				State:  "active",
+				Events: []string{},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLinks.Deleted).Should(BeEmpty())
+		})
+
 		It("restores process state", func() {
 			err := container.Restore(linux_backend.ContainerSnapshot{
 				State:  "active",
@@ -362,46 +486,123 @@ var _ = Describe("Linux containers", func() {
 			})
 			Ω(err).ShouldNot(HaveOccurred())
 
-			Ω(fakeRunner).Should(HaveExecutedSerially(
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/net.sh",
-					Args: []string{"setup"},
+			Ω(fakeNetworkManager.SetupCount).Should(Equal(1))
+			Ω(fakeNetworkManager.DenialCallback).ShouldNot(BeNil())
+
+			Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+				{
+					HostPort:      1234,
+					ContainerPort: 5678,
+					Protocol:      "tcp",
 				},
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/net.sh",
-					Args: []string{"in"},
+				{
+					HostPort:      1235,
+					ContainerPort: 5679,
+					Protocol:      "tcp",
 				},
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/net.sh",
-					Args: []string{"in"},
+			}))
+
+			Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+				{
+					Networks: []string{"somehost.example.com"},
+					Port:     80,
+					Protocol: "tcp",
 				},
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/net.sh",
-					Args: []string{"out"},
+				{
+					Networks: []string{"someotherhost.example.com"},
+					Port:     8080,
+					Protocol: "tcp",
 				},
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/net.sh",
-					Args: []string{"out"},
+			}))
+		})
+
+		It("carries on accounting from the snapshotted totals", func() {
+			err := container.Restore(linux_backend.ContainerSnapshot{
+				State:  "active",
+				Events: []string{},
+
+				Accounting: map[string]network_manager.Traffic{
+					"internal": {Bytes: 1024, Packets: 8},
+					"other":    {Bytes: 2048, Packets: 16},
 				},
-			))
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fakeNetworkManager.AccountingResult = map[string]network_manager.Traffic{
+				"internal": {Bytes: 1, Packets: 1},
+			}
+
+			accounting, err := container.Accounting()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(accounting).Should(Equal(map[string]network_manager.Traffic{
+				"internal": {Bytes: 1025, Packets: 9},
+				"other":    {Bytes: 2048, Packets: 16},
+			}))
+		})
+
+		It("redoes net-in/net-outs with their protocols", func() {
+			err := container.Restore(linux_backend.ContainerSnapshot{
+				State:  "active",
+				Events: []string{},
+
+				NetIns: []linux_backend.NetInSpec{
+					{
+						HostPort:      1234,
+						ContainerPort: 5678,
+						Protocol:      linux_backend.ProtocolUDP,
+					},
+				},
+
+				NetOuts: []linux_backend.NetOutSpec{
+					{
+						Network:  "somehost.example.com",
+						Protocol: linux_backend.ProtocolICMP,
+					},
+					{
+						Network: "someotherhost.example.com",
+						Port:    8080,
+					},
+				},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+				{
+					HostPort:      1234,
+					ContainerPort: 5678,
+					Protocol:      "udp",
+				},
+			}))
 
+			Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+				{
+					Networks: []string{"somehost.example.com"},
+					Protocol: "icmp",
+				},
+				{
+					Networks: []string{"someotherhost.example.com"},
+					Port:     8080,
+					Protocol: "tcp",
+				},
+			}))
 		})
 
-		for _, cmd := range []string{"setup", "in", "out"} {
-			command := cmd
+		for _, step := range []string{"setup", "in", "out"} {
+			failingStep := step
 
-			Context("when net.sh "+cmd+" fails", func() {
+			Context("when network "+step+" fails", func() {
 				disaster := errors.New("oh no!")
 
 				BeforeEach(func() {
-					fakeRunner.WhenRunning(
-						fake_command_runner.CommandSpec{
-							Path: "/depot/some-id/net.sh",
-							Args: []string{command},
-						}, func(*exec.Cmd) error {
-							return disaster
-						},
-					)
+					switch failingStep {
+					case "setup":
+						fakeNetworkManager.SetupError = disaster
+					case "in":
+						fakeNetworkManager.NetInError = disaster
+					case "out":
+						fakeNetworkManager.NetOutError = disaster
+					}
 				})
 
 				It("returns the error", func() {
@@ -481,6 +682,118 @@ var _ = Describe("Linux containers", func() {
 			})
 		})
 
+		It("re-enforces the cpu, bandwidth and disk limits", func() {
+			err := container.Restore(linux_backend.ContainerSnapshot{
+				State:  "active",
+				Events: []string{},
+
+				Limits: linux_backend.LimitsSnapshot{
+					CPU: &warden.CPULimits{
+						LimitInShares: 512,
+					},
+					BandwidthByDirection: &bandwidth_manager.Limits{
+						IngressRate:  128,
+						IngressBurst: 256,
+						EgressRate:   64,
+						EgressBurst:  512,
+					},
+					Disk: &warden.DiskLimits{
+						ByteHard: 1024,
+					},
+				},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeCgroups.SetValues()).Should(ContainElement(
+				fake_cgroups_manager.SetValue{
+					Subsystem: "cpu",
+					Name:      "cpu.shares",
+					Value:     "512",
+				},
+			))
+
+			Ω(fakeBandwidthManager.EnforcedLimits).Should(Equal([]bandwidth_manager.Limits{
+				{
+					IngressRate:  128,
+					IngressBurst: 256,
+					EgressRate:   64,
+					EgressBurst:  512,
+				},
+			}))
+
+			Ω(fakeQuotaManager.Limited).Should(HaveKeyWithValue(containerResources.UID, warden.DiskLimits{ByteHard: 1024}))
+		})
+
+		Context("when the snapshot is from before bandwidth limits had directions", func() {
+			It("re-enforces its bandwidth limits in both directions", func() {
+				var snapshot linux_backend.ContainerSnapshot
+
+				err := json.Unmarshal([]byte(`{
+					"State": "active",
+					"Limits": {
+						"Bandwidth": {
+							"RateInBytesPerSecond": 128,
+							"BurstRateInBytesPerSecond": 256
+						}
+					}
+				}`), &snapshot)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.Restore(snapshot)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeBandwidthManager.EnforcedLimits).Should(Equal([]bandwidth_manager.Limits{
+					{
+						IngressRate:  128,
+						IngressBurst: 256,
+						EgressRate:   128,
+						EgressBurst:  256,
+					},
+				}))
+
+				limits, err := container.CurrentBandwidthLimitsByDirection()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(limits.EgressRate).Should(Equal(uint64(128)))
+			})
+		})
+
+		It("keeps the limits in later snapshots", func() {
+			limits := linux_backend.LimitsSnapshot{
+				Memory: &warden.MemoryLimits{
+					LimitInBytes: 1024,
+				},
+				CPU: &warden.CPULimits{
+					LimitInShares: 512,
+				},
+				BandwidthByDirection: &bandwidth_manager.Limits{
+					IngressRate:  128,
+					IngressBurst: 256,
+				},
+				Disk: &warden.DiskLimits{
+					ByteHard: 1024,
+				},
+			}
+
+			err := container.Restore(linux_backend.ContainerSnapshot{
+				State:  "active",
+				Events: []string{},
+				Limits: limits,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			out := new(bytes.Buffer)
+
+			err = container.Snapshot(out)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var snapshot linux_backend.ContainerSnapshot
+
+			err = json.NewDecoder(out).Decode(&snapshot)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(snapshot.Limits).Should(Equal(limits))
+		})
+
 		Context("when re-enforcing the memory limit fails", func() {
 			disaster := errors.New("oh no!")
 
@@ -490,7 +803,7 @@ var _ = Describe("Linux containers", func() {
 				})
 			})
 
-			It("returns the error", func() {
+			It("registers an event and restores the rest of the container", func() {
 				err := container.Restore(linux_backend.ContainerSnapshot{
 					State:  "active",
 					Events: []string{},
@@ -499,9 +812,53 @@ var _ = Describe("Linux containers", func() {
 						Memory: &warden.MemoryLimits{
 							LimitInBytes: 1024,
 						},
+						CPU: &warden.CPULimits{
+							LimitInShares: 512,
+						},
 					},
 				})
-				Ω(err).Should(Equal(disaster))
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(container.Events()).Should(ContainElement("failed to restore memory limits: oh no!"))
+
+				Ω(fakeCgroups.SetValues()).Should(ContainElement(
+					fake_cgroups_manager.SetValue{
+						Subsystem: "cpu",
+						Name:      "cpu.shares",
+						Value:     "512",
+					},
+				))
+
+				Ω(fakeNetworkManager.SetupCount).Should(Equal(1))
+			})
+		})
+
+		Context("when re-enforcing the bandwidth and disk limits fails", func() {
+			BeforeEach(func() {
+				fakeBandwidthManager.SetLimitsError = errors.New("no tc")
+				fakeQuotaManager.SetLimitsError = errors.New("no quota")
+			})
+
+			It("registers an event for each", func() {
+				err := container.Restore(linux_backend.ContainerSnapshot{
+					State:  "active",
+					Events: []string{},
+
+					Limits: linux_backend.LimitsSnapshot{
+						BandwidthByDirection: &bandwidth_manager.Limits{
+							IngressRate: 128,
+						},
+						Disk: &warden.DiskLimits{
+							ByteHard: 1024,
+						},
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(container.Events()).Should(Equal([]string{
+					"failed to restore bandwidth limits: no tc",
+					"failed to restore disk limits: no quota",
+				}))
 			})
 		})
 	})
@@ -516,7 +873,7 @@ var _ = Describe("Linux containers", func() {
 					Path: "/depot/some-id/start.sh",
 					Env: []string{
 						"id=some-id",
-						"container_iface_mtu=1500",
+						"container_iface_mtu=1400",
 						"PATH=" + os.Getenv("PATH"),
 					},
 				},
@@ -524,67 +881,200 @@ var _ = Describe("Linux containers", func() {
 
 		})
 
-		It("changes the container's state to active", func() {
-			Ω(container.State()).Should(Equal(linux_backend.StateBorn))
-
+		It("creates the container's interfaces and sets up its network", func() {
 			err := container.Start()
 			Ω(err).ShouldNot(HaveOccurred())
 
-			Ω(container.State()).Should(Equal(linux_backend.StateActive))
+			Ω(fakeNetworkManager.CreatedInterfaces).Should(BeTrue())
+			Ω(fakeNetworkManager.InterfaceMTU).Should(Equal(uint32(1400)))
+			Ω(fakeNetworkManager.SetupCount).Should(Equal(1))
 		})
 
-		Context("when start.sh fails", func() {
-			nastyError := errors.New("oh no!")
+		It("keeps the interfaces it created", func() {
+			fakeLinks := fake_links.New()
 
-			BeforeEach(func() {
-				fakeRunner.WhenRunning(
-					fake_command_runner.CommandSpec{
-						Path: "/depot/some-id/start.sh",
-					}, func(*exec.Cmd) error {
-						return nastyError
-					},
-				)
-			})
+			err := containerWithLinks(fakeLinks).Start()
+			Ω(err).ShouldNot(HaveOccurred())
 
-			It("returns the error", func() {
-				err := container.Start()
-				Ω(err).Should(Equal(nastyError))
-			})
+			Ω(fakeLinks.VethPairs).Should(Equal([][2]string{{"w0some-id-0", "w0some-id-1"}}))
+			Ω(fakeLinks.Deleted).Should(BeEmpty())
+		})
 
-			It("does not change the container's state", func() {
-				Ω(container.State()).Should(Equal(linux_backend.StateBorn))
+		Describe("watching denied egress", func() {
+			denial := func(port uint32) network_manager.Denial {
+				return network_manager.Denial{
+					Protocol:    "tcp",
+					Destination: "10.0.0.1",
+					Port:        port,
+				}
+			}
 
+			It("registers denials as events", func() {
 				err := container.Start()
-				Ω(err).Should(HaveOccurred())
+				Ω(err).ShouldNot(HaveOccurred())
 
-				Ω(container.State()).Should(Equal(linux_backend.StateBorn))
+				fakeNetworkManager.DenialCallback(denial(80))
+
+				Ω(container.Events()).Should(Equal([]string{"egress denied: tcp to 10.0.0.1:80"}))
 			})
-		})
-	})
 
-	Describe("Stopping", func() {
-		It("executes the container's stop.sh", func() {
-			err := container.Stop(false)
-			Ω(err).ShouldNot(HaveOccurred())
+			It("registers repeated denials once, as the most recent", func() {
+				err := container.Start()
+				Ω(err).ShouldNot(HaveOccurred())
 
-			Ω(fakeRunner).Should(HaveExecutedSerially(
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/stop.sh",
-				},
-			))
+				fakeNetworkManager.DenialCallback(denial(80))
+				fakeNetworkManager.DenialCallback(denial(81))
+				fakeNetworkManager.DenialCallback(denial(80))
 
-		})
+				Ω(container.Events()).Should(Equal([]string{
+					"egress denied: tcp to 10.0.0.1:81",
+					"egress denied: tcp to 10.0.0.1:80",
+				}))
+			})
 
-		It("sets the container's state to stopped", func() {
-			Ω(container.State()).Should(Equal(linux_backend.StateBorn))
+			It("keeps only the most recent denials", func() {
+				err := container.Start()
+				Ω(err).ShouldNot(HaveOccurred())
 
-			err := container.Stop(false)
-			Ω(err).ShouldNot(HaveOccurred())
+				for port := uint32(1); port <= linux_backend.MaxDenialEvents+1; port++ {
+					fakeNetworkManager.DenialCallback(denial(port))
+				}
 
-			Ω(container.State()).Should(Equal(linux_backend.StateStopped))
+				events := container.Events()
+				Ω(events).Should(HaveLen(linux_backend.MaxDenialEvents))
+				Ω(events).ShouldNot(ContainElement("egress denied: tcp to 10.0.0.1:1"))
+				Ω(events).Should(ContainElement("egress denied: tcp to 10.0.0.1:11"))
+			})
+
+			Context("when watching fails", func() {
+				disaster := errors.New("oh no!")
+
+				BeforeEach(func() {
+					fakeNetworkManager.WatchDenialsError = disaster
+				})
+
+				It("returns the error and does not execute start.sh", func() {
+					err := container.Start()
+					Ω(err).Should(Equal(disaster))
+
+					Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "/depot/some-id/start.sh",
+						},
+					))
+				})
+			})
+		})
+
+		Context("when creating the interfaces fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeNetworkManager.CreateInterfacesError = disaster
+			})
+
+			It("returns the error and does not execute start.sh", func() {
+				err := container.Start()
+				Ω(err).Should(Equal(disaster))
+
+				Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/depot/some-id/start.sh",
+					},
+				))
+			})
+		})
+
+		Context("when setting up the network fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeNetworkManager.SetupError = disaster
+			})
+
+			It("returns the error and does not execute start.sh", func() {
+				err := container.Start()
+				Ω(err).Should(Equal(disaster))
+
+				Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/depot/some-id/start.sh",
+					},
+				))
+			})
+		})
+
+		It("changes the container's state to active", func() {
+			Ω(container.State()).Should(Equal(linux_backend.StateBorn))
+
+			err := container.Start()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(container.State()).Should(Equal(linux_backend.StateActive))
+		})
+
+		Context("when start.sh fails", func() {
+			nastyError := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "/depot/some-id/start.sh",
+					}, func(*exec.Cmd) error {
+						return nastyError
+					},
+				)
+			})
+
+			It("returns the error", func() {
+				err := container.Start()
+				Ω(err).Should(Equal(nastyError))
+			})
+
+			It("does not change the container's state", func() {
+				Ω(container.State()).Should(Equal(linux_backend.StateBorn))
+
+				err := container.Start()
+				Ω(err).Should(HaveOccurred())
+
+				Ω(container.State()).Should(Equal(linux_backend.StateBorn))
+			})
+		})
+	})
+
+	Describe("Stopping", func() {
+		It("executes the container's stop.sh", func() {
+			err := container.Stop(false)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "/depot/some-id/stop.sh",
+				},
+			))
+
+		})
+
+		It("sets the container's state to stopped", func() {
+			Ω(container.State()).Should(Equal(linux_backend.StateBorn))
+
+			err := container.Stop(false)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(container.State()).Should(Equal(linux_backend.StateStopped))
 
 		})
 
+		It("notifies that the container changed", func() {
+			changes := 0
+			container.OnChange(func() { changes++ })
+
+			err := container.Stop(false)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(changes).Should(Equal(1))
+		})
+
 		Context("when kill is true", func() {
 			It("executes stop.sh with -w 0", func() {
 				err := container.Stop(true)
@@ -656,6 +1146,34 @@ var _ = Describe("Linux containers", func() {
 			Ω(fakeProcessTracker.UnlinkAllCallCount()).Should(Equal(1))
 		})
 
+		It("stops watching for denied egress", func() {
+			container.Cleanup()
+
+			Ω(fakeNetworkManager.StoppedWatchingDenials).Should(BeTrue())
+		})
+
+		It("reads the accounting totals, so that they are snapshotted", func() {
+			fakeNetworkManager.AccountingResult = map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+			}
+
+			container.Cleanup()
+
+			out := new(bytes.Buffer)
+
+			err := container.Snapshot(out)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var snapshot linux_backend.ContainerSnapshot
+
+			err = json.NewDecoder(out).Decode(&snapshot)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(snapshot.Accounting).Should(Equal(map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+			}))
+		})
+
 		Context("when the container has an oom notifier running", func() {
 			BeforeEach(func() {
 				err := container.LimitMemory(warden.MemoryLimits{
@@ -799,6 +1317,16 @@ var _ = Describe("Linux containers", func() {
 	})
 
 	Describe("Running", func() {
+		It("notifies that the container changed", func() {
+			changes := 0
+			container.OnChange(func() { changes++ })
+
+			_, err := container.Run(warden.ProcessSpec{Path: "/some/script"}, warden.ProcessIO{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(changes).Should(Equal(1))
+		})
+
 		It("runs the /bin/bash via wsh with the given script as the input, and rlimits in env", func() {
 			_, err := container.Run(warden.ProcessSpec{
 				Path: "/some/script",
@@ -1101,6 +1629,102 @@ var _ = Describe("Linux containers", func() {
 		})
 	})
 
+	Describe("Attaching from output offsets", func() {
+		It("attaches via the process tracker with the offsets", func() {
+			fakeProcess := new(fake_process_tracker.FakeLinuxProcess)
+			fakeProcessTracker.AttachFromReturns(fakeProcess, nil)
+
+			stdout := gbytes.NewBuffer()
+
+			process, err := container.AttachFrom(1, warden.ProcessIO{
+				Stdout: stdout,
+			}, process_tracker.OutputOffsets{
+				Stdout: 12,
+				Stderr: 34,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(process).Should(Equal(fakeProcess))
+
+			pid, processIO, offsets := fakeProcessTracker.AttachFromArgsForCall(0)
+			Ω(pid).Should(Equal(uint32(1)))
+			Ω(processIO.Stdout).Should(Equal(stdout))
+			Ω(offsets).Should(Equal(process_tracker.OutputOffsets{
+				Stdout: 12,
+				Stderr: 34,
+			}))
+		})
+
+		Context("when attaching fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeProcessTracker.AttachFromReturns(nil, disaster)
+			})
+
+			It("returns the error", func() {
+				_, err := container.AttachFrom(42, warden.ProcessIO{}, process_tracker.OutputOffsets{})
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
+	Describe("Reading process logs", func() {
+		It("reads them via the process tracker", func() {
+			logged := []process_tracker.LogChunk{
+				{Source: "stdout", Data: []byte("hi out\n")},
+			}
+
+			fakeProcessTracker.ReadLogsReturns(logged, nil)
+
+			chunks, err := container.ReadLogs(42, 10)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(chunks).Should(Equal(logged))
+
+			pid, tail := fakeProcessTracker.ReadLogsArgsForCall(0)
+			Ω(pid).Should(Equal(uint32(42)))
+			Ω(tail).Should(Equal(10))
+		})
+
+		Context("when reading them fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeProcessTracker.ReadLogsReturns(nil, disaster)
+			})
+
+			It("returns the error", func() {
+				_, err := container.ReadLogs(42, 0)
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
+	Describe("Signalling a process", func() {
+		It("signals the process via the process tracker", func() {
+			err := container.Signal(42, syscall.SIGTERM)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeProcessTracker.SignalCallCount()).Should(Equal(1))
+
+			pid, signal := fakeProcessTracker.SignalArgsForCall(0)
+			Ω(pid).Should(Equal(uint32(42)))
+			Ω(signal).Should(Equal(syscall.SIGTERM))
+		})
+
+		Context("when signalling fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeProcessTracker.SignalReturns(disaster)
+			})
+
+			It("returns the error", func() {
+				err := container.Signal(42, syscall.SIGTERM)
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
 	Describe("Limiting bandwidth", func() {
 		limits := warden.BandwidthLimits{
 			RateInBytesPerSecond:      128,
@@ -1111,7 +1735,44 @@ var _ = Describe("Linux containers", func() {
 			err := container.LimitBandwidth(limits)
 			Ω(err).ShouldNot(HaveOccurred())
 
-			Ω(fakeBandwidthManager.EnforcedLimits).Should(ContainElement(limits))
+			Ω(fakeBandwidthManager.EnforcedLimits).Should(ContainElement(bandwidth_manager.Limits{
+				IngressRate:  128,
+				IngressBurst: 256,
+				EgressRate:   128,
+				EgressBurst:  256,
+			}))
+		})
+
+		Context("by direction", func() {
+			directionalLimits := bandwidth_manager.Limits{
+				IngressRate:  128,
+				IngressBurst: 256,
+				EgressRate:   64,
+				EgressBurst:  512,
+			}
+
+			It("sets the limits via the bandwidth manager", func() {
+				err := container.LimitBandwidthByDirection(directionalLimits)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeBandwidthManager.EnforcedLimits).Should(ContainElement(directionalLimits))
+			})
+
+			It("reports them, and the ingress limits as warden's limits", func() {
+				err := container.LimitBandwidthByDirection(directionalLimits)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				receivedLimits, err := container.CurrentBandwidthLimitsByDirection()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(receivedLimits).Should(Equal(directionalLimits))
+
+				wardenLimits, err := container.CurrentBandwidthLimits()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(wardenLimits).Should(Equal(warden.BandwidthLimits{
+					RateInBytesPerSecond:      128,
+					BurstRateInBytesPerSecond: 256,
+				}))
+			})
 		})
 
 		Context("when setting the limit fails", func() {
@@ -1128,6 +1789,89 @@ var _ = Describe("Linux containers", func() {
 		})
 	})
 
+	Describe("Getting the bandwidth stat", func() {
+		BeforeEach(func() {
+			fakeBandwidthManager.GetLimitsResult = warden.ContainerBandwidthStat{
+				InRate:   128,
+				InBurst:  256,
+				OutRate:  64,
+				OutBurst: 512,
+			}
+
+			fakeNetworkManager.StatResult = network_manager.InterfaceStat{
+				RxBytes:   1024,
+				RxPackets: 8,
+				RxDropped: 1,
+				TxBytes:   2048,
+				TxPackets: 16,
+				TxDropped: 2,
+			}
+		})
+
+		It("returns the limits and the host interface's traffic counters", func() {
+			stat, err := container.BandwidthStat()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(stat).Should(Equal(linux_backend.BandwidthStat{
+				ContainerBandwidthStat: warden.ContainerBandwidthStat{
+					InRate:   128,
+					InBurst:  256,
+					OutRate:  64,
+					OutBurst: 512,
+				},
+				Traffic: network_manager.InterfaceStat{
+					RxBytes:   1024,
+					RxPackets: 8,
+					RxDropped: 1,
+					TxBytes:   2048,
+					TxPackets: 16,
+					TxDropped: 2,
+				},
+			}))
+		})
+
+		Context("when reading the counters fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeNetworkManager.StatError = disaster
+			})
+
+			It("returns the error", func() {
+				_, err := container.BandwidthStat()
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
+	Describe("Getting the traffic accounting", func() {
+		It("returns the network manager's totals", func() {
+			fakeNetworkManager.AccountingResult = map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+			}
+
+			accounting, err := container.Accounting()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(accounting).Should(Equal(map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+			}))
+		})
+
+		Context("when reading the counters fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeNetworkManager.AccountingError = disaster
+			})
+
+			It("returns the error", func() {
+				_, err := container.Accounting()
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
 	Describe("Getting the current bandwidth limit", func() {
 		limits := warden.BandwidthLimits{
 			RateInBytesPerSecond:      128,
@@ -1404,6 +2148,16 @@ var _ = Describe("Linux containers", func() {
 	})
 
 	Describe("Limiting CPU", func() {
+		It("notifies that the container changed", func() {
+			changes := 0
+			container.OnChange(func() { changes++ })
+
+			err := container.LimitCPU(warden.CPULimits{LimitInShares: 512})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(changes).Should(Equal(1))
+		})
+
 		It("sets cpu.shares", func() {
 			limits := warden.CPULimits{
 				LimitInShares: 512,
@@ -1542,26 +2296,32 @@ var _ = Describe("Linux containers", func() {
 	})
 
 	Describe("Net in", func() {
-		It("executes net.sh in with HOST_PORT and CONTAINER_PORT", func() {
+		It("maps the host port to the container port over tcp", func() {
 			hostPort, containerPort, err := container.NetIn(123, 456)
 			Ω(err).ShouldNot(HaveOccurred())
 
-			Ω(fakeRunner).Should(HaveExecutedSerially(
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/net.sh",
-					Args: []string{"in"},
-					Env: []string{
-						"HOST_PORT=123",
-						"CONTAINER_PORT=456",
-						"PATH=" + os.Getenv("PATH"),
-					},
+			Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+				{
+					HostPort:      123,
+					ContainerPort: 456,
+					Protocol:      "tcp",
 				},
-			))
+			}))
 
 			Ω(hostPort).Should(Equal(uint32(123)))
 			Ω(containerPort).Should(Equal(uint32(456)))
 		})
 
+		It("notifies that the container changed", func() {
+			changes := 0
+			container.OnChange(func() { changes++ })
+
+			_, _, err := container.NetIn(123, 456)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(changes).Should(Equal(1))
+		})
+
 		Context("when a host port is not provided", func() {
 			It("acquires one from the port pool", func() {
 				hostPort, containerPort, err := container.NetIn(0, 456)
@@ -1597,17 +2357,13 @@ var _ = Describe("Linux containers", func() {
 				hostPort, containerPort, err := container.NetIn(123, 0)
 				Ω(err).ShouldNot(HaveOccurred())
 
-				Ω(fakeRunner).Should(HaveExecutedSerially(
-					fake_command_runner.CommandSpec{
-						Path: "/depot/some-id/net.sh",
-						Args: []string{"in"},
-						Env: []string{
-							"HOST_PORT=123",
-							"CONTAINER_PORT=123",
-							"PATH=" + os.Getenv("PATH"),
-						},
+				Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+					{
+						HostPort:      123,
+						ContainerPort: 123,
+						Protocol:      "tcp",
 					},
-				))
+				}))
 
 				Ω(hostPort).Should(Equal(uint32(123)))
 				Ω(containerPort).Should(Equal(uint32(123)))
@@ -1618,17 +2374,13 @@ var _ = Describe("Linux containers", func() {
 					hostPort, containerPort, err := container.NetIn(0, 0)
 					Ω(err).ShouldNot(HaveOccurred())
 
-					Ω(fakeRunner).Should(HaveExecutedSerially(
-						fake_command_runner.CommandSpec{
-							Path: "/depot/some-id/net.sh",
-							Args: []string{"in"},
-							Env: []string{
-								"HOST_PORT=1000",
-								"CONTAINER_PORT=1000",
-								"PATH=" + os.Getenv("PATH"),
-							},
+					Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+						{
+							HostPort:      1000,
+							ContainerPort: 1000,
+							Protocol:      "tcp",
 						},
-					))
+					}))
 
 					Ω(hostPort).Should(Equal(uint32(1000)))
 					Ω(containerPort).Should(Equal(uint32(1000)))
@@ -1636,17 +2388,168 @@ var _ = Describe("Linux containers", func() {
 			})
 		})
 
-		Context("when net.sh fails", func() {
+		Context("when a protocol is given", func() {
+			It("maps the ports for that protocol", func() {
+				spec, err := container.AddNetIn(linux_backend.NetInSpec{
+					HostPort:      123,
+					ContainerPort: 456,
+					Protocol:      linux_backend.ProtocolUDP,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+					{
+						HostPort:      123,
+						ContainerPort: 456,
+						Protocol:      "udp",
+					},
+				}))
+
+				Ω(spec).Should(Equal(linux_backend.NetInSpec{
+					HostPort:      123,
+					ContainerPort: 456,
+					Protocol:      linux_backend.ProtocolUDP,
+				}))
+			})
+
+			Context("and it has no ports", func() {
+				It("returns an error and does not map anything", func() {
+					_, err := container.AddNetIn(linux_backend.NetInSpec{
+						HostPort:      123,
+						ContainerPort: 456,
+						Protocol:      linux_backend.ProtocolICMP,
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeNetworkManager.MappedPorts).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when a host IP is given", func() {
+			It("maps the ports from that address", func() {
+				spec, err := container.AddNetIn(linux_backend.NetInSpec{
+					HostIP:        "5.6.7.8",
+					HostPort:      123,
+					ContainerPort: 456,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+					{
+						HostIP:        net.ParseIP("5.6.7.8"),
+						HostPort:      123,
+						ContainerPort: 456,
+						Protocol:      "tcp",
+					},
+				}))
+
+				Ω(spec.HostIP).Should(Equal("5.6.7.8"))
+			})
+
+			Context("and it is not an IPv4 address", func() {
+				It("returns an error and does not map anything", func() {
+					_, err := container.AddNetIn(linux_backend.NetInSpec{
+						HostIP:   "fd00::1",
+						HostPort: 123,
+					})
+					Ω(err).Should(HaveOccurred())
+
+					_, err = container.AddNetIn(linux_backend.NetInSpec{
+						HostIP:   "bogus",
+						HostPort: 123,
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeNetworkManager.MappedPorts).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when a range of ports is given", func() {
+			It("maps each host port to its counterpart", func() {
+				spec, err := container.AddNetIn(linux_backend.NetInSpec{
+					HostPort:      123,
+					ContainerPort: 456,
+					PortCount:     3,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.MappedPorts).Should(Equal([]network_manager.PortMapping{
+					{
+						HostPort:      123,
+						ContainerPort: 456,
+						PortCount:     3,
+						Protocol:      "tcp",
+					},
+				}))
+
+				Ω(spec.PortCount).Should(Equal(uint32(3)))
+
+				info, err := container.Info()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(info.MappedPorts).Should(Equal([]warden.PortMapping{
+					{HostPort: 123, ContainerPort: 456},
+					{HostPort: 124, ContainerPort: 457},
+					{HostPort: 125, ContainerPort: 458},
+				}))
+			})
+
+			Context("without a host port", func() {
+				It("acquires the whole range from the port pool", func() {
+					spec, err := container.AddNetIn(linux_backend.NetInSpec{
+						ContainerPort: 456,
+						PortCount:     3,
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(spec.HostPort).Should(Equal(uint32(1000)))
+
+					Ω(container.Resources().Ports).Should(ContainElement(uint32(1000)))
+					Ω(container.Resources().Ports).Should(ContainElement(uint32(1001)))
+					Ω(container.Resources().Ports).Should(ContainElement(uint32(1002)))
+				})
+
+				Context("and mapping the ports fails", func() {
+					disaster := errors.New("oh no!")
+
+					BeforeEach(func() {
+						fakeNetworkManager.NetInError = disaster
+					})
+
+					It("releases the range", func() {
+						_, err := container.AddNetIn(linux_backend.NetInSpec{
+							ContainerPort: 456,
+							PortCount:     3,
+						})
+						Ω(err).Should(Equal(disaster))
+
+						Ω(fakePortPool.Released).Should(Equal([]uint32{1000, 1001, 1002}))
+						Ω(container.Resources().Ports).ShouldNot(ContainElement(uint32(1000)))
+					})
+				})
+			})
+
+			Context("when the range goes past the last port", func() {
+				It("returns an error and does not map anything", func() {
+					_, err := container.AddNetIn(linux_backend.NetInSpec{
+						HostPort:      65534,
+						ContainerPort: 456,
+						PortCount:     3,
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeNetworkManager.MappedPorts).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when mapping the ports fails", func() {
 			disaster := errors.New("oh no!")
 
 			BeforeEach(func() {
-				fakeRunner.WhenRunning(
-					fake_command_runner.CommandSpec{
-						Path: "/depot/some-id/net.sh",
-					}, func(*exec.Cmd) error {
-						return disaster
-					},
-				)
+				fakeNetworkManager.NetInError = disaster
 			})
 
 			It("returns the error", func() {
@@ -1656,42 +2559,113 @@ var _ = Describe("Linux containers", func() {
 		})
 	})
 
+	Describe("describing a net-out spec", func() {
+		It("lists the protocol, destinations, and ports", func() {
+			Ω(linux_backend.NetOutSpec{
+				Network:  "1.2.3.4/22",
+				Networks: []string{"5.6.7.8"},
+				Port:     567,
+				Protocol: linux_backend.ProtocolTCP,
+			}.String()).Should(Equal("tcp traffic to 1.2.3.4/22,5.6.7.8 on port 567"))
+
+			Ω(linux_backend.NetOutSpec{
+				IPRange:   linux_backend.IPRange{Start: "10.0.0.1", End: "10.0.0.9"},
+				PortRange: linux_backend.PortRange{Start: 80, End: 90},
+				Protocol:  linux_backend.ProtocolUDP,
+			}.String()).Should(Equal("udp traffic to 10.0.0.1-10.0.0.9 on ports 80-90"))
+
+			Ω(linux_backend.NetOutSpec{
+				Protocol: linux_backend.ProtocolICMP,
+			}.String()).Should(Equal("icmp traffic to any network"))
+		})
+	})
+
 	Describe("Net out", func() {
-		It("executes net.sh out with NETWORK and PORT", func() {
+		It("notifies that the container changed", func() {
+			changes := 0
+			container.OnChange(func() { changes++ })
+
 			err := container.NetOut("1.2.3.4/22", 567)
 			Ω(err).ShouldNot(HaveOccurred())
 
-			Ω(fakeRunner).Should(HaveExecutedSerially(
-				fake_command_runner.CommandSpec{
-					Path: "/depot/some-id/net.sh",
-					Args: []string{"out"},
-					Env: []string{
-						"NETWORK=1.2.3.4/22",
-						"PORT=567",
-						"PATH=" + os.Getenv("PATH"),
-					},
+			Ω(changes).Should(Equal(1))
+		})
+
+		It("permits tcp traffic to the network and port", func() {
+			err := container.NetOut("1.2.3.4/22", 567)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+				{
+					Networks: []string{"1.2.3.4/22"},
+					Port:     567,
+					Protocol: "tcp",
 				},
-			))
+			}))
+		})
 
+		Context("when a comma-separated list of networks is given", func() {
+			It("permits traffic to all of them with one rule", func() {
+				err := container.NetOut("1.2.3.4/22, 5.6.7.8", 567)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+					{
+						Networks: []string{"1.2.3.4/22", "5.6.7.8"},
+						Port:     567,
+						Protocol: "tcp",
+					},
+				}))
+			})
+
+			Context("and one of them is empty", func() {
+				It("returns an error", func() {
+					err := container.NetOut("1.2.3.4/22,,5.6.7.8", 567)
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeNetworkManager.PermittedRules).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when an IP range is given", func() {
+			It("permits traffic to the range", func() {
+				err := container.NetOut("10.0.0.1-10.0.0.9", 0)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+					{
+						Networks: []string{},
+						IPRange:  "10.0.0.1-10.0.0.9",
+						Protocol: "all",
+					},
+				}))
+			})
+
+			Context("and it is malformed", func() {
+				It("returns an error", func() {
+					err := container.NetOut("10.0.0.1-10.0.0.5-10.0.0.9", 0)
+					Ω(err).Should(HaveOccurred())
+
+					err = container.NetOut("10.0.0.1-bogus", 0)
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeNetworkManager.PermittedRules).Should(BeEmpty())
+				})
+			})
 		})
 
 		Context("when port 0 is given", func() {
-			It("executes with PORT as an empty string", func() {
+			It("permits all traffic to the network", func() {
 				err := container.NetOut("1.2.3.4/22", 0)
 				Ω(err).ShouldNot(HaveOccurred())
 
-				Ω(fakeRunner).Should(HaveExecutedSerially(
-					fake_command_runner.CommandSpec{
-						Path: "/depot/some-id/net.sh",
-						Args: []string{"out"},
-						Env: []string{
-							"NETWORK=1.2.3.4/22",
-							"PORT=",
-							"PATH=" + os.Getenv("PATH"),
-						},
+				Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+					{
+						Networks: []string{"1.2.3.4/22"},
+						Protocol: "all",
 					},
-				))
-
+				}))
 			})
 
 			Context("and a network is not given", func() {
@@ -1702,17 +2676,181 @@ var _ = Describe("Linux containers", func() {
 			})
 		})
 
-		Context("when net.sh fails", func() {
+		Context("when a protocol is given", func() {
+			It("permits traffic for that protocol", func() {
+				err := container.AddNetOut(linux_backend.NetOutSpec{
+					Network:  "1.2.3.4/22",
+					Port:     53,
+					Protocol: linux_backend.ProtocolUDP,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+					{
+						Networks: []string{"1.2.3.4/22"},
+						Port:     53,
+						Protocol: "udp",
+					},
+				}))
+			})
+
+			Context("and it is icmp", func() {
+				It("permits icmp without a network", func() {
+					err := container.AddNetOut(linux_backend.NetOutSpec{
+						Protocol: linux_backend.ProtocolICMP,
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+						{
+							Networks: []string{},
+							Protocol: "icmp",
+						},
+					}))
+				})
+
+				Context("and a port is given", func() {
+					It("returns an error and does not permit anything", func() {
+						err := container.AddNetOut(linux_backend.NetOutSpec{
+							Network:  "1.2.3.4/22",
+							Port:     53,
+							Protocol: linux_backend.ProtocolICMP,
+						})
+						Ω(err).Should(HaveOccurred())
+
+						Ω(fakeNetworkManager.PermittedRules).Should(BeEmpty())
+					})
+				})
+			})
+
+			Context("and it is unknown", func() {
+				It("returns an error and does not permit anything", func() {
+					err := container.AddNetOut(linux_backend.NetOutSpec{
+						Network:  "1.2.3.4/22",
+						Protocol: linux_backend.Protocol("sctp"),
+					})
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeNetworkManager.PermittedRules).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when multiple networks and a port range are given", func() {
+			It("permits them all in one rule", func() {
+				err := container.AddNetOut(linux_backend.NetOutSpec{
+					Network:  "1.2.3.4/22",
+					Networks: []string{"5.6.7.8/24", "9.10.11.12"},
+					PortRange: linux_backend.PortRange{
+						Start: 8000,
+						End:   9000,
+					},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+					{
+						Networks:  []string{"1.2.3.4/22", "5.6.7.8/24", "9.10.11.12"},
+						PortRange: "8000:9000",
+						Protocol:  "tcp",
+					},
+				}))
+			})
+
+			It("is included in the snapshot", func() {
+				spec := linux_backend.NetOutSpec{
+					Networks: []string{"5.6.7.8/24", "9.10.11.12"},
+					PortRange: linux_backend.PortRange{
+						Start: 8000,
+						End:   9000,
+					},
+					Protocol: linux_backend.ProtocolUDP,
+				}
+
+				err := container.AddNetOut(spec)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				out := new(bytes.Buffer)
+
+				err = container.Snapshot(out)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				var snapshot linux_backend.ContainerSnapshot
+
+				err = json.NewDecoder(out).Decode(&snapshot)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(snapshot.NetOuts).Should(Equal([]linux_backend.NetOutSpec{spec}))
+			})
+		})
+
+		Context("when an IP range is given", func() {
+			It("permits traffic to the range", func() {
+				err := container.AddNetOut(linux_backend.NetOutSpec{
+					IPRange: linux_backend.IPRange{
+						Start: "10.0.0.1",
+						End:   "10.0.0.100",
+					},
+					Port: 53,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeNetworkManager.PermittedRules).Should(Equal([]network_manager.EgressRule{
+					{
+						Networks: []string{},
+						IPRange:  "10.0.0.1-10.0.0.100",
+						Port:     53,
+						Protocol: "tcp",
+					},
+				}))
+			})
+		})
+
+		for description, spec := range map[string]linux_backend.NetOutSpec{
+			"a port and a port range": {
+				Network:   "1.2.3.4/22",
+				Port:      80,
+				PortRange: linux_backend.PortRange{Start: 8000, End: 9000},
+			},
+			"a reversed port range": {
+				Network:   "1.2.3.4/22",
+				PortRange: linux_backend.PortRange{Start: 9000, End: 8000},
+			},
+			"a port range for icmp": {
+				PortRange: linux_backend.PortRange{Start: 8000, End: 9000},
+				Protocol:  linux_backend.ProtocolICMP,
+			},
+			"networks and an IP range": {
+				Network: "1.2.3.4/22",
+				IPRange: linux_backend.IPRange{Start: "10.0.0.1", End: "10.0.0.2"},
+			},
+			"a reversed IP range": {
+				IPRange: linux_backend.IPRange{Start: "10.0.0.2", End: "10.0.0.1"},
+			},
+			"a malformed IP range": {
+				IPRange: linux_backend.IPRange{Start: "10.0.0.1", End: "bogus"},
+			},
+			"IPv4 and IPv6 networks": {
+				Networks: []string{"1.2.3.4/22", "fd00::/64"},
+			},
+		} {
+			invalidSpec := spec
+
+			Context("when "+description+" are given", func() {
+				It("returns an error and does not permit anything", func() {
+					err := container.AddNetOut(invalidSpec)
+					Ω(err).Should(HaveOccurred())
+
+					Ω(fakeNetworkManager.PermittedRules).Should(BeEmpty())
+				})
+			})
+		}
+
+		Context("when permitting the traffic fails", func() {
 			disaster := errors.New("oh no!")
 
 			BeforeEach(func() {
-				fakeRunner.WhenRunning(
-					fake_command_runner.CommandSpec{
-						Path: "/depot/some-id/net.sh",
-					}, func(*exec.Cmd) error {
-						return disaster
-					},
-				)
+				fakeNetworkManager.NetOutError = disaster
 			})
 
 			It("returns the error", func() {
@@ -1722,6 +2860,252 @@ var _ = Describe("Linux containers", func() {
 		})
 	})
 
+	Describe("Removing a net in", func() {
+		It("unmaps the ports", func() {
+			_, _, err := container.NetIn(123, 456)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = container.RemoveNetIn(linux_backend.NetInSpec{
+				HostPort:      123,
+				ContainerPort: 456,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeNetworkManager.UnmappedPorts).Should(Equal([]network_manager.PortMapping{
+				{
+					HostPort:      123,
+					ContainerPort: 456,
+					Protocol:      "tcp",
+				},
+			}))
+
+			info, err := container.Info()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(info.MappedPorts).Should(BeEmpty())
+		})
+
+		It("notifies that the container changed", func() {
+			_, _, err := container.NetIn(123, 456)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			changes := 0
+			container.OnChange(func() { changes++ })
+
+			err = container.RemoveNetIn(linux_backend.NetInSpec{
+				HostPort:      123,
+				ContainerPort: 456,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(changes).Should(Equal(1))
+		})
+
+		It("no longer includes the mapping in the snapshot", func() {
+			_, _, err := container.NetIn(123, 456)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, _, err = container.NetIn(789, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = container.RemoveNetIn(linux_backend.NetInSpec{
+				HostPort:      123,
+				ContainerPort: 456,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			out := new(bytes.Buffer)
+
+			err = container.Snapshot(out)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var snapshot linux_backend.ContainerSnapshot
+
+			err = json.NewDecoder(out).Decode(&snapshot)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(snapshot.NetIns).Should(Equal([]linux_backend.NetInSpec{
+				{
+					HostPort:      789,
+					ContainerPort: 789,
+					Protocol:      linux_backend.ProtocolTCP,
+				},
+			}))
+		})
+
+		Context("when the host port was acquired from the pool", func() {
+			It("releases it and removes it from the container's resources", func() {
+				hostPort, containerPort, err := container.NetIn(0, 456)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.RemoveNetIn(linux_backend.NetInSpec{
+					HostPort:      hostPort,
+					ContainerPort: containerPort,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakePortPool.Released).Should(ContainElement(hostPort))
+				Ω(container.Resources().Ports).ShouldNot(ContainElement(hostPort))
+			})
+
+			Context("as part of a range", func() {
+				It("releases the whole range", func() {
+					spec, err := container.AddNetIn(linux_backend.NetInSpec{
+						ContainerPort: 456,
+						PortCount:     3,
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = container.RemoveNetIn(spec)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakePortPool.Released).Should(Equal([]uint32{1000, 1001, 1002}))
+					Ω(container.Resources().Ports).Should(BeEmpty())
+				})
+			})
+
+			Context("and another mapping still uses it", func() {
+				It("does not release it", func() {
+					spec, err := container.AddNetIn(linux_backend.NetInSpec{
+						ContainerPort: 456,
+						Protocol:      linux_backend.ProtocolTCP,
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, err = container.AddNetIn(linux_backend.NetInSpec{
+						HostPort:      spec.HostPort,
+						ContainerPort: 456,
+						Protocol:      linux_backend.ProtocolUDP,
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = container.RemoveNetIn(spec)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakePortPool.Released).Should(BeEmpty())
+					Ω(container.Resources().Ports).Should(ContainElement(spec.HostPort))
+				})
+			})
+		})
+
+		Context("when the host port was not acquired from the pool", func() {
+			It("does not release it", func() {
+				_, _, err := container.NetIn(123, 456)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.RemoveNetIn(linux_backend.NetInSpec{
+					HostPort:      123,
+					ContainerPort: 456,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakePortPool.Released).Should(BeEmpty())
+			})
+		})
+
+		Context("when the mapping does not exist", func() {
+			It("returns an UnknownNetInError and does not unmap anything", func() {
+				err := container.RemoveNetIn(linux_backend.NetInSpec{
+					HostPort:      123,
+					ContainerPort: 456,
+				})
+				Ω(err).Should(Equal(linux_backend.UnknownNetInError{
+					Spec: linux_backend.NetInSpec{
+						HostPort:      123,
+						ContainerPort: 456,
+						Protocol:      linux_backend.ProtocolTCP,
+					},
+				}))
+
+				Ω(fakeNetworkManager.UnmappedPorts).Should(BeEmpty())
+			})
+		})
+
+		Context("when unmapping the ports fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeNetworkManager.RemoveNetInError = disaster
+			})
+
+			It("returns the error and keeps the mapping", func() {
+				hostPort, containerPort, err := container.NetIn(0, 456)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.RemoveNetIn(linux_backend.NetInSpec{
+					HostPort:      hostPort,
+					ContainerPort: containerPort,
+				})
+				Ω(err).Should(Equal(disaster))
+
+				Ω(fakePortPool.Released).Should(BeEmpty())
+				Ω(container.Resources().Ports).Should(ContainElement(hostPort))
+			})
+		})
+	})
+
+	Describe("Removing a net out", func() {
+		It("revokes the rule", func() {
+			err := container.NetOut("1.2.3.4/22", 567)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = container.RemoveNetOut(linux_backend.NetOutSpec{
+				Network: "1.2.3.4/22",
+				Port:    567,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeNetworkManager.RevokedRules).Should(Equal([]network_manager.EgressRule{
+				{
+					Networks: []string{"1.2.3.4/22"},
+					Port:     567,
+					Protocol: "tcp",
+				},
+			}))
+
+			out := new(bytes.Buffer)
+
+			err = container.Snapshot(out)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var snapshot linux_backend.ContainerSnapshot
+
+			err = json.NewDecoder(out).Decode(&snapshot)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(snapshot.NetOuts).Should(BeEmpty())
+		})
+
+		Context("when the rule does not exist", func() {
+			It("returns an UnknownNetOutError and does not revoke anything", func() {
+				err := container.RemoveNetOut(linux_backend.NetOutSpec{
+					Network: "1.2.3.4/22",
+				})
+				Ω(err).Should(BeAssignableToTypeOf(linux_backend.UnknownNetOutError{}))
+
+				Ω(fakeNetworkManager.RevokedRules).Should(BeEmpty())
+			})
+		})
+
+		Context("when revoking the rule fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeNetworkManager.RemoveNetOutError = disaster
+			})
+
+			It("returns the error", func() {
+				err := container.NetOut("1.2.3.4/22", 0)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = container.RemoveNetOut(linux_backend.NetOutSpec{
+					Network: "1.2.3.4/22",
+				})
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
 	Describe("Info", func() {
 		It("returns the container's state", func() {
 			info, err := container.Info()
@@ -1741,6 +3125,18 @@ var _ = Describe("Linux containers", func() {
 			info, err := container.Info()
 			Ω(err).ShouldNot(HaveOccurred())
 
+			Ω(info.Properties).Should(HaveKeyWithValue("property-name", "property-value"))
+		})
+
+		It("returns only the container's properties", func() {
+			fakeNetworkManager.StatResult = network_manager.InterfaceStat{RxBytes: 1024}
+			fakeNetworkManager.AccountingResult = map[string]network_manager.Traffic{
+				"internal": {Bytes: 1024, Packets: 8},
+			}
+
+			info, err := container.Info()
+			Ω(err).ShouldNot(HaveOccurred())
+
 			Ω(info.Properties).Should(Equal(container.Properties()))
 		})
 
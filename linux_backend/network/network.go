@@ -10,6 +10,8 @@ type Network struct {
 
 	hostIP      net.IP
 	containerIP net.IP
+
+	lastUsableIP net.IP
 }
 
 func New(ipNet *net.IPNet) *Network {
@@ -17,6 +19,8 @@ func New(ipNet *net.IPNet) *Network {
 		ipNet:       ipNet,
 		hostIP:      nextIP(ipNet.IP),
 		containerIP: nextIP(nextIP(ipNet.IP)),
+
+		lastUsableIP: lastUsableIP(ipNet),
 	}
 }
 
@@ -36,6 +40,18 @@ func (n Network) ContainerIP() net.IP {
 	return n.containerIP
 }
 
+// the usable range of a network spans from its host IP to the address before
+// its broadcast address; everything after the container IP is free for the
+// container to claim (e.g. as aliases)
+func (n Network) LastUsableIP() net.IP {
+	return n.lastUsableIP
+}
+
+func (n Network) PrefixLength() int {
+	ones, _ := n.ipNet.Mask.Size()
+	return ones
+}
+
 func (n Network) MarshalJSON() ([]byte, error) {
 	return json.Marshal(map[string]interface{}{
 		"IPNet": n.String(),
@@ -66,16 +82,38 @@ func (n *Network) UnmarshalJSON(data []byte) error {
 	n.ipNet = ipNet
 	n.hostIP = tmp.HostIP
 	n.containerIP = tmp.ContainerIP
+	n.lastUsableIP = lastUsableIP(ipNet)
 
 	return nil
 }
 
+func lastUsableIP(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP
+	if len(ipNet.Mask) == net.IPv4len {
+		ip = ip.To4()
+	}
+
+	broadcast := make(net.IP, len(ip))
+
+	for i := range ip {
+		broadcast[i] = ip[i] | ^ipNet.Mask[i]
+	}
+
+	return prevIP(broadcast)
+}
+
 func nextIP(ip net.IP) net.IP {
 	next := net.ParseIP(ip.String())
 	inc(next)
 	return next
 }
 
+func prevIP(ip net.IP) net.IP {
+	prev := net.ParseIP(ip.String())
+	dec(prev)
+	return prev
+}
+
 func inc(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -84,3 +122,12 @@ func inc(ip net.IP) {
 		}
 	}
 }
+
+func dec(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]--
+		if ip[j] < 255 {
+			break
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package network_manager
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the bucket that traffic to none of the buckets' networks is counted in
+const OtherBucket = "other"
+
+// AccountingBucket counts the container's traffic to any of its networks.
+type AccountingBucket struct {
+	Name     string
+	Networks []string
+}
+
+// Traffic is what the container sent to a bucket's networks.
+type Traffic struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+func (t Traffic) Add(other Traffic) Traffic {
+	return Traffic{
+		Bytes:   t.Bytes + other.Bytes,
+		Packets: t.Packets + other.Packets,
+	}
+}
+
+// ParseAccountingBuckets parses semicolon-separated buckets of the form
+// name=cidr,cidr.
+func ParseAccountingBuckets(spec string) ([]AccountingBucket, error) {
+	buckets := []AccountingBucket{}
+
+	for _, bucketSpec := range strings.Split(spec, ";") {
+		if bucketSpec == "" {
+			continue
+		}
+
+		segs := strings.SplitN(bucketSpec, "=", 2)
+		if len(segs) != 2 || segs[0] == "" || segs[1] == "" {
+			return nil, fmt.Errorf("invalid accounting bucket (must be name=cidr,...): %s", bucketSpec)
+		}
+
+		if segs[0] == OtherBucket {
+			return nil, fmt.Errorf("accounting bucket name is reserved: %s", OtherBucket)
+		}
+
+		bucket := AccountingBucket{Name: segs[0]}
+
+		for _, network := range strings.Split(segs[1], ",") {
+			_, _, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network in accounting bucket %s: %s", segs[0], network)
+			}
+
+			bucket.Networks = append(bucket.Networks, network)
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, nil
+}
+
+// accountingRules count the container's traffic in the first bucket whose
+// networks it is to, or in OtherBucket, and return to the forward chain.
+// bucketNames is the bucket that each rule counts in, in order.
+func (m *ContainerNetworkManager) accountingRules(ipv6 bool) (rules []string, bucketNames []string) {
+	chain := m.filterAccountingChain()
+
+	for _, bucket := range m.policy.Buckets {
+		for _, network := range bucket.Networks {
+			if network == "" || strings.Contains(network, ":") != ipv6 {
+				continue
+			}
+
+			rules = append(rules, fmt.Sprintf("-A %s --destination %s --jump RETURN", chain, network))
+			bucketNames = append(bucketNames, bucket.Name)
+		}
+	}
+
+	rules = append(rules, fmt.Sprintf("-A %s --jump RETURN", chain))
+	bucketNames = append(bucketNames, OtherBucket)
+
+	return rules, bucketNames
+}
+
+// Accounting returns what the container has sent to each bucket since its
+// chains were set up. It returns nothing unless the policy has buckets.
+func (m *ContainerNetworkManager) Accounting() (map[string]Traffic, error) {
+	accounting := map[string]Traffic{}
+
+	if len(m.policy.Buckets) == 0 {
+		return accounting, nil
+	}
+
+	for _, iptables := range m.families() {
+		_, bucketNames := m.accountingRules(iptables == "ip6tables")
+
+		out := new(bytes.Buffer)
+
+		err := m.runner.Run(&exec.Cmd{
+			Path:   iptables,
+			Args:   []string{"-w", "-t", "filter", "-L", m.filterAccountingChain(), "-v", "-x", "-n"},
+			Stdout: out,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// the chain and column headers precede one line per rule, starting
+		// with its packet and byte counts
+		rule := 0
+
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+
+			packets, err := strconv.ParseUint(fields[0], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			byteCount, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if rule >= len(bucketNames) {
+				break
+			}
+
+			name := bucketNames[rule]
+			accounting[name] = accounting[name].Add(Traffic{Bytes: byteCount, Packets: packets})
+
+			rule++
+		}
+	}
+
+	return accounting, nil
+}
+
+func (m *ContainerNetworkManager) filterAccountingChain() string {
+	return m.config.IPTables.Filter.AccountingPrefix + m.id
+}
@@ -0,0 +1,155 @@
+package network_manager
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rate at which denials are logged per denied network, in iptables' limit
+// module syntax
+const (
+	DenialLogRate  = "6/minute"
+	DenialLogBurst = 5
+)
+
+// the kernel log, which carries iptables' LOG messages
+var KernelLogPath = "/dev/kmsg"
+
+// Denial is a connection from the container that was denied by the default
+// chain.
+type Denial struct {
+	Protocol    string
+	Destination string
+	Port        uint32
+}
+
+func (d Denial) String() string {
+	if d.Port == 0 {
+		return fmt.Sprintf("%s to %s", d.Protocol, d.Destination)
+	}
+
+	return fmt.Sprintf("%s to %s", d.Protocol, net.JoinHostPort(d.Destination, strconv.Itoa(int(d.Port))))
+}
+
+// ParseDenial parses an iptables LOG message with the given prefix, e.g.
+//
+//	w0abc-0 denied: IN=w0abc-0 OUT=eth0 SRC=10.254.0.2 DST=10.0.0.1 ... PROTO=TCP SPT=4321 DPT=80 ...
+func ParseDenial(prefix, message string) (Denial, bool) {
+	start := strings.Index(message, prefix)
+	if start == -1 {
+		return Denial{}, false
+	}
+
+	denial := Denial{}
+
+	for _, field := range strings.Fields(message[start+len(prefix):]) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "DST":
+			denial.Destination = kv[1]
+		case "PROTO":
+			denial.Protocol = strings.ToLower(kv[1])
+		case "DPT":
+			port, err := strconv.ParseUint(kv[1], 10, 16)
+			if err == nil {
+				denial.Port = uint32(port)
+			}
+		}
+	}
+
+	if denial.Destination == "" || denial.Protocol == "" {
+		return Denial{}, false
+	}
+
+	return denial, true
+}
+
+// WatchDenials calls back with each logged denial until StopWatchingDenials
+// is called. It does nothing unless the policy logs denials.
+func (m *ContainerNetworkManager) WatchDenials(callback func(Denial)) error {
+	if !m.policy.LogDenied {
+		return nil
+	}
+
+	m.kernelLogMutex.Lock()
+	defer m.kernelLogMutex.Unlock()
+
+	if m.kernelLog != nil {
+		return nil
+	}
+
+	kernelLog, err := os.Open(KernelLogPath)
+	if err != nil {
+		return err
+	}
+
+	// only report denials from now on
+	_, err = kernelLog.Seek(0, os.SEEK_END)
+	if err != nil {
+		kernelLog.Close()
+		return err
+	}
+
+	m.kernelLog = kernelLog
+
+	go m.watchKernelLog(kernelLog, callback)
+
+	return nil
+}
+
+func (m *ContainerNetworkManager) StopWatchingDenials() {
+	m.kernelLogMutex.Lock()
+	defer m.kernelLogMutex.Unlock()
+
+	if m.kernelLog != nil {
+		m.kernelLog.Close()
+		m.kernelLog = nil
+	}
+}
+
+// watchKernelLog reads one record per read; records look like
+// "priority,sequence,timestamp,flags;message\n"
+func (m *ContainerNetworkManager) watchKernelLog(kernelLog *os.File, callback func(Denial)) {
+	prefix := m.denialLogPrefix()
+
+	record := make([]byte, 8192)
+
+	for {
+		n, err := kernelLog.Read(record)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EPIPE {
+				// records were overwritten before we could read them
+				continue
+			}
+
+			log.Println(m.id, "stopped watching denials:", err)
+			return
+		}
+
+		message := record[:n]
+
+		semicolon := bytes.IndexByte(message, ';')
+		if semicolon != -1 {
+			message = message[semicolon+1:]
+		}
+
+		denial, ok := ParseDenial(prefix, string(message))
+		if ok {
+			callback(denial)
+		}
+	}
+}
+
+func (m *ContainerNetworkManager) denialLogPrefix() string {
+	return m.hostIface + " denied: "
+}
@@ -0,0 +1,95 @@
+package fake_links
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+type FakeLinks struct {
+	CreateVethPairError error
+	AddAddressError     error
+	SetMTUError         error
+	SetUpError          error
+	DeleteError         error
+
+	VethPairs [][2]string
+	Addresses map[string][]string
+	MTUs      map[string]uint32
+	Up        []string
+	Deleted   []string
+
+	sync.Mutex
+}
+
+func New() *FakeLinks {
+	return &FakeLinks{
+		Addresses: make(map[string][]string),
+		MTUs:      make(map[string]uint32),
+	}
+}
+
+func (l *FakeLinks) CreateVethPair(hostIface, containerIface string) error {
+	if l.CreateVethPairError != nil {
+		return l.CreateVethPairError
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.VethPairs = append(l.VethPairs, [2]string{hostIface, containerIface})
+
+	return nil
+}
+
+func (l *FakeLinks) AddAddress(iface string, ip net.IP, prefixLength int) error {
+	if l.AddAddressError != nil {
+		return l.AddAddressError
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.Addresses[iface] = append(l.Addresses[iface], fmt.Sprintf("%s/%d", ip, prefixLength))
+
+	return nil
+}
+
+func (l *FakeLinks) SetMTU(iface string, mtu uint32) error {
+	if l.SetMTUError != nil {
+		return l.SetMTUError
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.MTUs[iface] = mtu
+
+	return nil
+}
+
+func (l *FakeLinks) SetUp(iface string) error {
+	if l.SetUpError != nil {
+		return l.SetUpError
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.Up = append(l.Up, iface)
+
+	return nil
+}
+
+func (l *FakeLinks) Delete(iface string) error {
+	if l.DeleteError != nil {
+		return l.DeleteError
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.Deleted = append(l.Deleted, iface)
+
+	return nil
+}
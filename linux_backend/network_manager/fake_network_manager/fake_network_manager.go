@@ -0,0 +1,181 @@
+package fake_network_manager
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
+)
+
+type FakeNetworkManager struct {
+	CreateInterfacesError error
+	CreatedInterfaces     bool
+	InterfaceMTU          uint32
+
+	SetupError error
+	SetupCount int
+
+	TeardownError error
+	TornDown      bool
+
+	NetInError       error
+	MappedPorts      []network_manager.PortMapping
+	RemoveNetInError error
+	UnmappedPorts    []network_manager.PortMapping
+
+	NetOutError       error
+	PermittedRules    []network_manager.EgressRule
+	RemoveNetOutError error
+	RevokedRules      []network_manager.EgressRule
+
+	WatchDenialsError      error
+	DenialCallback         func(network_manager.Denial)
+	StoppedWatchingDenials bool
+
+	StatResult network_manager.InterfaceStat
+	StatError  error
+
+	AccountingResult map[string]network_manager.Traffic
+	AccountingError  error
+
+	sync.Mutex
+}
+
+func New() *FakeNetworkManager {
+	return &FakeNetworkManager{}
+}
+
+func (m *FakeNetworkManager) CreateInterfaces(mtu uint32) error {
+	if m.CreateInterfacesError != nil {
+		return m.CreateInterfacesError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.CreatedInterfaces = true
+	m.InterfaceMTU = mtu
+
+	return nil
+}
+
+func (m *FakeNetworkManager) Setup() error {
+	if m.SetupError != nil {
+		return m.SetupError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.SetupCount++
+
+	return nil
+}
+
+func (m *FakeNetworkManager) Teardown() error {
+	if m.TeardownError != nil {
+		return m.TeardownError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.TornDown = true
+
+	return nil
+}
+
+func (m *FakeNetworkManager) NetIn(mapping network_manager.PortMapping) error {
+	if m.NetInError != nil {
+		return m.NetInError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.MappedPorts = append(m.MappedPorts, mapping)
+
+	return nil
+}
+
+func (m *FakeNetworkManager) RemoveNetIn(mapping network_manager.PortMapping) error {
+	if m.RemoveNetInError != nil {
+		return m.RemoveNetInError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.UnmappedPorts = append(m.UnmappedPorts, mapping)
+
+	return nil
+}
+
+func (m *FakeNetworkManager) NetOut(rule network_manager.EgressRule) error {
+	if m.NetOutError != nil {
+		return m.NetOutError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.PermittedRules = append(m.PermittedRules, rule)
+
+	return nil
+}
+
+func (m *FakeNetworkManager) RemoveNetOut(rule network_manager.EgressRule) error {
+	if m.RemoveNetOutError != nil {
+		return m.RemoveNetOutError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.RevokedRules = append(m.RevokedRules, rule)
+
+	return nil
+}
+
+func (m *FakeNetworkManager) WatchDenials(callback func(network_manager.Denial)) error {
+	if m.WatchDenialsError != nil {
+		return m.WatchDenialsError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.DenialCallback = callback
+
+	return nil
+}
+
+func (m *FakeNetworkManager) StopWatchingDenials() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.StoppedWatchingDenials = true
+}
+
+func (m *FakeNetworkManager) Stat() (network_manager.InterfaceStat, error) {
+	if m.StatError != nil {
+		return network_manager.InterfaceStat{}, m.StatError
+	}
+
+	return m.StatResult, nil
+}
+
+func (m *FakeNetworkManager) Accounting() (map[string]network_manager.Traffic, error) {
+	if m.AccountingError != nil {
+		return nil, m.AccountingError
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	accounting := map[string]network_manager.Traffic{}
+	for name, traffic := range m.AccountingResult {
+		accounting[name] = traffic
+	}
+
+	return accounting, nil
+}
@@ -0,0 +1,163 @@
+package network_manager
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/warden-linux/sysconfig"
+	"github.com/cloudfoundry/gunk/command_runner"
+)
+
+// GroupMember is the addresses a container in a network group is reached on.
+type GroupMember struct {
+	IP   net.IP
+	IPv6 net.IP
+}
+
+// NetworkGroups keeps a chain per network group that accepts traffic to the
+// group's members. Members' instance chains jump to it, so members can reach
+// each other directly, while other containers are left to the default chain.
+type NetworkGroups struct {
+	config sysconfig.Config
+	ipv6   bool
+
+	runner command_runner.CommandRunner
+
+	members      map[string]map[string]GroupMember
+	membersMutex sync.Mutex
+}
+
+func NewGroups(config sysconfig.Config, ipv6 bool, runner command_runner.CommandRunner) *NetworkGroups {
+	return &NetworkGroups{
+		config: config,
+		ipv6:   ipv6,
+
+		runner: runner,
+
+		members: make(map[string]map[string]GroupMember),
+	}
+}
+
+// Chain is the name of a group's chain. Group names are arbitrary, so they
+// are hashed to keep the name within iptables' limit.
+func (g *NetworkGroups) Chain(group string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(group))
+
+	return fmt.Sprintf("%s%08x", g.config.IPTables.Filter.GroupPrefix, hash.Sum32())
+}
+
+// Join adds a container to a group, creating the group's chain if it is the
+// first member.
+func (g *NetworkGroups) Join(group, id string, member GroupMember) error {
+	g.membersMutex.Lock()
+	defer g.membersMutex.Unlock()
+
+	members, found := g.members[group]
+	if !found {
+		members = make(map[string]GroupMember)
+		g.members[group] = members
+	}
+
+	members[id] = member
+
+	err := g.write(group)
+	if err != nil {
+		delete(members, id)
+
+		if len(members) == 0 {
+			delete(g.members, group)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Leave removes a container from whichever group it is in, deleting the
+// group's chain if it was the last member. The container's instance chain
+// must no longer jump to it.
+func (g *NetworkGroups) Leave(id string) error {
+	g.membersMutex.Lock()
+	defer g.membersMutex.Unlock()
+
+	for group, members := range g.members {
+		if _, found := members[id]; !found {
+			continue
+		}
+
+		delete(members, id)
+
+		if len(members) > 0 {
+			return g.write(group)
+		}
+
+		delete(g.members, group)
+
+		return g.remove(group)
+	}
+
+	return nil
+}
+
+// write (re)creates a group's chains with a rule for each member
+func (g *NetworkGroups) write(group string) error {
+	chain := g.Chain(group)
+
+	ids := []string{}
+	for id := range g.members[group] {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	batch := []string{"*filter", fmt.Sprintf(":%s - [0:0]", chain)}
+	ipv6Batch := []string{"*filter", fmt.Sprintf(":%s - [0:0]", chain)}
+
+	for _, id := range ids {
+		member := g.members[group][id]
+
+		batch = append(batch, fmt.Sprintf("-A %s --destination %s --jump ACCEPT", chain, member.IP))
+
+		if member.IPv6 != nil {
+			ipv6Batch = append(ipv6Batch, fmt.Sprintf("-A %s --destination %s --jump ACCEPT", chain, member.IPv6))
+		}
+	}
+
+	err := restore(g.runner, group, "iptables", append(batch, "COMMIT")...)
+	if err != nil {
+		return err
+	}
+
+	if g.ipv6 {
+		return restore(g.runner, group, "ip6tables", append(ipv6Batch, "COMMIT")...)
+	}
+
+	return nil
+}
+
+func (g *NetworkGroups) remove(group string) error {
+	chain := g.Chain(group)
+
+	batch := []string{
+		"*filter",
+		"-F " + chain,
+		"-X " + chain,
+		"COMMIT",
+	}
+
+	err := restore(g.runner, group, "iptables", batch...)
+	if err != nil {
+		return err
+	}
+
+	if g.ipv6 {
+		return restore(g.runner, group, "ip6tables", batch...)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package network_manager_test
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
+	"github.com/cloudfoundry-incubator/warden-linux/sysconfig"
+	"github.com/cloudfoundry/gunk/command_runner/fake_command_runner"
+	. "github.com/cloudfoundry/gunk/command_runner/fake_command_runner/matchers"
+)
+
+var _ = Describe("Network groups", func() {
+	var fakeRunner *fake_command_runner.FakeCommandRunner
+	var ipv6 bool
+	var groups *network_manager.NetworkGroups
+
+	batch := func(lines ...string) string {
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	member := func(ip string) network_manager.GroupMember {
+		return network_manager.GroupMember{IP: net.ParseIP(ip)}
+	}
+
+	BeforeEach(func() {
+		fakeRunner = fake_command_runner.New()
+		ipv6 = false
+	})
+
+	JustBeforeEach(func() {
+		groups = network_manager.NewGroups(sysconfig.NewConfig("0"), ipv6, fakeRunner)
+	})
+
+	It("names chains by a hash of the group, so they fit in iptables' limit", func() {
+		Ω(groups.Chain("some-group")).Should(Equal("w-0-group-92b6f927"))
+		Ω(groups.Chain("other-group")).Should(Equal("w-0-group-dc7c172b"))
+	})
+
+	Describe("joining", func() {
+		It("(re)creates the group's chain, accepting traffic to each member", func() {
+			err := groups.Join("some-group", "id-b", member("10.254.0.6"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = groups.Join("some-group", "id-a", member("10.254.0.2"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables-restore",
+					Args: []string{"--noflush"},
+					Stdin: batch(
+						"*filter",
+						":w-0-group-92b6f927 - [0:0]",
+						"-A w-0-group-92b6f927 --destination 10.254.0.6 --jump ACCEPT",
+						"COMMIT",
+					),
+				},
+				fake_command_runner.CommandSpec{
+					Path: "iptables-restore",
+					Args: []string{"--noflush"},
+					Stdin: batch(
+						"*filter",
+						":w-0-group-92b6f927 - [0:0]",
+						"-A w-0-group-92b6f927 --destination 10.254.0.2 --jump ACCEPT",
+						"-A w-0-group-92b6f927 --destination 10.254.0.6 --jump ACCEPT",
+						"COMMIT",
+					),
+				},
+			))
+		})
+
+		Context("with IPv6", func() {
+			BeforeEach(func() {
+				ipv6 = true
+			})
+
+			It("also creates the group's IPv6 chain", func() {
+				err := groups.Join("some-group", "id-a", network_manager.GroupMember{
+					IP:   net.ParseIP("10.254.0.2"),
+					IPv6: net.ParseIP("fd00::2"),
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+					},
+					fake_command_runner.CommandSpec{
+						Path: "ip6tables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							":w-0-group-92b6f927 - [0:0]",
+							"-A w-0-group-92b6f927 --destination fd00::2 --jump ACCEPT",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("when writing the chain fails", func() {
+			disaster := errors.New("oh no!")
+
+			It("returns the error and does not keep the member", func() {
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+					}, func(*exec.Cmd) error {
+						return disaster
+					},
+				)
+
+				err := groups.Join("some-group", "id-a", member("10.254.0.2"))
+				Ω(err).Should(Equal(disaster))
+
+				err = groups.Leave("id-a")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner.ExecutedCommands()).Should(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("leaving", func() {
+		JustBeforeEach(func() {
+			err := groups.Join("some-group", "id-a", member("10.254.0.2"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = groups.Join("some-group", "id-b", member("10.254.0.6"))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rewrites the group's chain without the member", func() {
+			err := groups.Leave("id-a")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables-restore",
+					Stdin: batch(
+						"*filter",
+						":w-0-group-92b6f927 - [0:0]",
+						"-A w-0-group-92b6f927 --destination 10.254.0.6 --jump ACCEPT",
+						"COMMIT",
+					),
+				},
+			))
+		})
+
+		Context("as the last member", func() {
+			It("deletes the group's chain", func() {
+				err := groups.Leave("id-a")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = groups.Leave("id-b")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*filter",
+							"-F w-0-group-92b6f927",
+							"-X w-0-group-92b6f927",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("when the container is in no group", func() {
+			It("does nothing", func() {
+				err := groups.Leave("id-c")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner.ExecutedCommands()).Should(HaveLen(2))
+			})
+		})
+	})
+})
@@ -0,0 +1,210 @@
+package network_manager
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+type Links interface {
+	CreateVethPair(hostIface, containerIface string) error
+	AddAddress(iface string, ip net.IP, prefixLength int) error
+	SetMTU(iface string, mtu uint32) error
+	SetUp(iface string) error
+	Delete(iface string) error
+}
+
+// NetlinkLinks manages interfaces by talking rtnetlink directly, rather than
+// by running ip(8).
+type NetlinkLinks struct{}
+
+func NewNetlinkLinks() *NetlinkLinks {
+	return &NetlinkLinks{}
+}
+
+// not defined by package syscall
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	vethInfoPeer = 1
+	ifaFNodad    = 0x02
+)
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+var netlinkSequence uint32
+
+func (l *NetlinkLinks) CreateVethPair(hostIface, containerIface string) error {
+	peer := ifInfomsg(0, 0, 0)
+	peer = append(peer, rtAttr(syscall.IFLA_IFNAME, zeroTerminated(containerIface))...)
+
+	linkInfo := rtAttr(iflaInfoKind, []byte("veth"))
+	linkInfo = append(linkInfo, rtAttr(iflaInfoData, rtAttr(vethInfoPeer, peer))...)
+
+	body := ifInfomsg(0, 0, 0)
+	body = append(body, rtAttr(syscall.IFLA_IFNAME, zeroTerminated(hostIface))...)
+	body = append(body, rtAttr(syscall.IFLA_LINKINFO, linkInfo)...)
+
+	return netlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+}
+
+func (l *NetlinkLinks) AddAddress(iface string, ip net.IP, prefixLength int) error {
+	intf, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	family := syscall.AF_INET
+	flags := 0
+
+	address := ip.To4()
+	if address == nil {
+		family = syscall.AF_INET6
+		flags = ifaFNodad
+		address = ip.To16()
+	}
+
+	body := []byte{byte(family), byte(prefixLength), byte(flags), 0, 0, 0, 0, 0}
+	nativeEndian.PutUint32(body[4:], uint32(intf.Index))
+
+	body = append(body, rtAttr(syscall.IFA_LOCAL, address)...)
+	body = append(body, rtAttr(syscall.IFA_ADDRESS, address)...)
+
+	return netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+}
+
+func (l *NetlinkLinks) SetMTU(iface string, mtu uint32) error {
+	intf, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	value := make([]byte, 4)
+	nativeEndian.PutUint32(value, mtu)
+
+	body := ifInfomsg(intf.Index, 0, 0)
+	body = append(body, rtAttr(syscall.IFLA_MTU, value)...)
+
+	return netlinkRequest(syscall.RTM_NEWLINK, 0, body)
+}
+
+func (l *NetlinkLinks) SetUp(iface string) error {
+	intf, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	body := ifInfomsg(intf.Index, syscall.IFF_UP, syscall.IFF_UP)
+
+	return netlinkRequest(syscall.RTM_NEWLINK, 0, body)
+}
+
+// Delete removes an interface, along with its peer if it is one end of a veth
+// pair. Deleting an interface that does not exist is not an error.
+func (l *NetlinkLinks) Delete(iface string) error {
+	intf, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil
+	}
+
+	body := ifInfomsg(intf.Index, 0, 0)
+
+	err = netlinkRequest(syscall.RTM_DELLINK, 0, body)
+	if err == syscall.ENODEV {
+		return nil
+	}
+
+	return err
+}
+
+func netlinkRequest(msgType int, flags int, body []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint32(&netlinkSequence, 1)
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN)
+	nativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	nativeEndian.PutUint16(msg[4:6], uint16(msgType))
+	nativeEndian.PutUint16(msg[6:8], uint16(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags))
+	nativeEndian.PutUint32(msg[8:12], seq)
+	msg = append(msg, body...)
+
+	err = syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+
+			errno := int32(nativeEndian.Uint32(m.Data[0:4]))
+			if errno == 0 {
+				return nil
+			}
+
+			return syscall.Errno(-errno)
+		}
+	}
+}
+
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(msg[4:8], uint32(index))
+	nativeEndian.PutUint32(msg[8:12], flags)
+	nativeEndian.PutUint32(msg[12:16], change)
+	return msg
+}
+
+func rtAttr(attrType int, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+
+	attr := make([]byte, rtaAlign(length))
+	nativeEndian.PutUint16(attr[0:2], uint16(length))
+	nativeEndian.PutUint16(attr[2:4], uint16(attrType))
+	copy(attr[syscall.SizeofRtAttr:], data)
+
+	return attr
+}
+
+func rtaAlign(length int) int {
+	return (length + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+}
+
+func zeroTerminated(s string) []byte {
+	return append([]byte(s), 0)
+}
@@ -0,0 +1,716 @@
+package network_manager
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network"
+	"github.com/cloudfoundry-incubator/warden-linux/sysconfig"
+	"github.com/cloudfoundry/gunk/command_runner"
+)
+
+var ErrNoIPv6Network = errors.New("container has no IPv6 network")
+
+type NetworkManager interface {
+	CreateInterfaces(mtu uint32) error
+	Setup() error
+	Teardown() error
+
+	NetIn(PortMapping) error
+	RemoveNetIn(PortMapping) error
+
+	NetOut(EgressRule) error
+	RemoveNetOut(EgressRule) error
+
+	WatchDenials(func(Denial)) error
+	StopWatchingDenials()
+
+	Stat() (InterfaceStat, error)
+	Accounting() (map[string]Traffic, error)
+}
+
+// DenyAction is what happens to traffic to denied networks.
+type DenyAction string
+
+const (
+	DenyActionDrop = DenyAction("drop")
+
+	// reject TCP with a reset and everything else with ICMP port unreachable
+	DenyActionReject = DenyAction("reject")
+)
+
+func (a DenyAction) Validate() error {
+	switch a {
+	case DenyActionDrop, DenyActionReject:
+		return nil
+	default:
+		return fmt.Errorf("unknown deny action (must be drop or reject): %s", a)
+	}
+}
+
+// Policy configures how the container's instance chain treats traffic that
+// is not explicitly permitted. AllowNetworks and DenyNetworks are the
+// server-wide networks that the default chain returns from and denies.
+type Policy struct {
+	AllowNetworks []string
+	DenyNetworks  []string
+
+	// LogDenied logs new connections to DenyNetworks (and not to
+	// AllowNetworks) from the container, at a limited rate.
+	LogDenied bool
+
+	// DenyAction overrides the default chain's action for new connections
+	// to DenyNetworks, if set.
+	DenyAction DenyAction
+
+	// Group is the network group whose members the container can reach
+	// directly, if any.
+	Group string
+
+	// Buckets count the container's traffic by destination, if any.
+	Buckets []AccountingBucket
+}
+
+// PortMapping maps a host port to a container port. Protocol is tcp, udp, or
+// all, which maps both.
+//
+// HostIP is the host address the port is mapped on: nil for the external IP,
+// or the unspecified address for any of the host's addresses. A specific
+// address only maps IPv4. PortCount maps that many consecutive ports from
+// HostPort and ContainerPort.
+type PortMapping struct {
+	HostIP        net.IP
+	HostPort      uint32
+	ContainerPort uint32
+	PortCount     uint32
+	Protocol      string
+}
+
+// EgressRule permits traffic to any of Networks or to IPRange ("start-end"),
+// optionally restricted to Port or PortRange ("start:end"). Protocol is tcp,
+// udp, icmp, or all.
+type EgressRule struct {
+	Networks  []string
+	IPRange   string
+	Port      uint32
+	PortRange string
+	Protocol  string
+}
+
+// iptables-restore has no equivalent to iptables -w, so batches from this
+// process are serialized here
+var iptablesLock = &sync.Mutex{}
+
+type ContainerNetworkManager struct {
+	config sysconfig.Config
+
+	id             string
+	hostIface      string
+	containerIface string
+
+	network     *network.Network
+	ipv6Network *network.Network
+
+	externalIP net.IP
+
+	policy Policy
+	groups *NetworkGroups
+
+	links  Links
+	runner command_runner.CommandRunner
+
+	kernelLog      io.Closer
+	kernelLogMutex sync.Mutex
+}
+
+func New(
+	config sysconfig.Config,
+	id string,
+	network, ipv6Network *network.Network,
+	externalIP net.IP,
+	policy Policy,
+	groups *NetworkGroups,
+	links Links,
+	runner command_runner.CommandRunner,
+) *ContainerNetworkManager {
+	hostIface, containerIface := InterfaceNames(config.NetworkInterfacePrefix, id)
+
+	return &ContainerNetworkManager{
+		config: config,
+
+		id:             id,
+		hostIface:      hostIface,
+		containerIface: containerIface,
+
+		network:     network,
+		ipv6Network: ipv6Network,
+
+		externalIP: externalIP,
+
+		policy: policy,
+		groups: groups,
+
+		links:  links,
+		runner: runner,
+	}
+}
+
+// InterfaceNames returns the names of the host and container ends of a
+// container's veth pair, truncating the ID from the left so that the names
+// fit in IFNAMSIZ.
+//
+// The truncation is setup.sh's, so that containers created by it keep their
+// names: its "tail -c $(expr 16 - ${#prefix} - 2)" also counted the newline
+// that "<<<" appends, keeping one character fewer of the ID.
+func InterfaceNames(prefix, id string) (string, string) {
+	maxIDLength := 16 - len(prefix) - 2
+	maxIDLength -= 1 // the newline
+
+	if maxIDLength < 0 {
+		maxIDLength = 0
+	}
+
+	if len(id) > maxIDLength {
+		id = id[len(id)-maxIDLength:]
+	}
+
+	return prefix + id + "-0", prefix + id + "-1"
+}
+
+// InterfaceMTU returns the MTU of the interface with the given address.
+func InterfaceMTU(ip net.IP) (uint32, error) {
+	intf, err := InterfaceWithIP(ip)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(intf.MTU), nil
+}
+
+// InterfaceWithIP finds the host's interface that has the given address.
+func InterfaceWithIP(ip net.IP) (net.Interface, error) {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return net.Interface{}, err
+	}
+
+	for _, intf := range intfs {
+		addrs, err := intf.Addrs()
+		if err != nil {
+			return net.Interface{}, err
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.Equal(ip) {
+				return intf, nil
+			}
+		}
+	}
+
+	return net.Interface{}, fmt.Errorf("no interface has address %s", ip)
+}
+
+// ExternalIP determines the address that traffic to the outside world leaves
+// the host from. Connecting a UDP socket sends no packets.
+func ExternalIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// CreateInterfaces creates the container's veth pair with the given MTU and
+// configures the host end; the container end is moved into the container's
+// namespace once it has been cloned.
+func (m *ContainerNetworkManager) CreateInterfaces(mtu uint32) error {
+	err := m.links.CreateVethPair(m.hostIface, m.containerIface)
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range []string{m.hostIface, m.containerIface} {
+		err := m.links.SetMTU(iface, mtu)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.links.AddAddress(m.hostIface, m.network.HostIP(), m.network.PrefixLength())
+	if err != nil {
+		return err
+	}
+
+	if m.ipv6Network != nil {
+		err = m.links.AddAddress(m.hostIface, m.ipv6Network.HostIP(), m.ipv6Network.PrefixLength())
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.links.SetUp(m.hostIface)
+}
+
+// Setup (re)creates the container's instance chains and binds them to the
+// global chains, and to its network group's chains. The container's
+// interfaces are left alone, so it is safe to run against a live container,
+// e.g. when restoring it.
+func (m *ContainerNetworkManager) Setup() error {
+	err := m.Teardown()
+	if err != nil {
+		return err
+	}
+
+	if m.policy.Group != "" {
+		member := GroupMember{IP: m.network.ContainerIP()}
+		if m.ipv6Network != nil {
+			member.IPv6 = m.ipv6Network.ContainerIP()
+		}
+
+		err := m.groups.Join(m.policy.Group, m.id, member)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, iptables := range m.families() {
+		batch := []string{"*filter"}
+
+		if len(m.policy.Buckets) > 0 {
+			accountingRules, _ := m.accountingRules(iptables == "ip6tables")
+
+			batch = append(batch, fmt.Sprintf(":%s - [0:0]", m.filterAccountingChain()))
+			batch = append(batch, accountingRules...)
+		}
+
+		batch = append(batch, fmt.Sprintf(":%s - [0:0]", m.filterInstanceChain()))
+
+		if m.policy.Group != "" {
+			batch = append(batch, fmt.Sprintf("-A %s --jump %s", m.filterInstanceChain(), m.groups.Chain(m.policy.Group)))
+		}
+
+		if m.policy.LogDenied || m.policy.DenyAction != "" {
+			batch = append(batch, m.denialRules(iptables == "ip6tables")...)
+		}
+
+		batch = append(
+			batch,
+			fmt.Sprintf("-A %s --goto %s", m.filterInstanceChain(), m.config.IPTables.Filter.DefaultChain),
+			fmt.Sprintf(
+				"-I %s 2 --in-interface %s --goto %s",
+				m.config.IPTables.Filter.ForwardChain,
+				m.hostIface,
+				m.filterInstanceChain(),
+			),
+		)
+
+		// count traffic before the instance chain, as permitted traffic
+		// returns from the top of it
+		if len(m.policy.Buckets) > 0 {
+			batch = append(batch, fmt.Sprintf(
+				"-I %s 2 --in-interface %s --jump %s",
+				m.config.IPTables.Filter.ForwardChain,
+				m.hostIface,
+				m.filterAccountingChain(),
+			))
+		}
+
+		batch = append(
+			batch,
+			"COMMIT",
+			"*nat",
+			fmt.Sprintf(":%s - [0:0]", m.natInstanceChain()),
+			fmt.Sprintf("-A %s --jump %s", m.config.IPTables.NAT.PreroutingChain, m.natInstanceChain()),
+			"COMMIT",
+		)
+
+		err := m.restore(iptables, batch...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// denialRules log and/or deny new connections to the denied networks
+// before the default chain does. Allowed networks go straight to the default
+// chain first, as they take precedence over denied ones there.
+func (m *ContainerNetworkManager) denialRules(ipv6 bool) []string {
+	rules := []string{}
+
+	for _, network := range m.policy.AllowNetworks {
+		if network == "" || strings.Contains(network, ":") != ipv6 {
+			continue
+		}
+
+		rules = append(rules, fmt.Sprintf(
+			"-A %s --destination %s --goto %s",
+			m.filterInstanceChain(),
+			network,
+			m.config.IPTables.Filter.DefaultChain,
+		))
+	}
+
+	for _, network := range m.policy.DenyNetworks {
+		if network == "" || strings.Contains(network, ":") != ipv6 {
+			continue
+		}
+
+		newConnections := fmt.Sprintf(
+			"-A %s --destination %s --match conntrack ! --ctstate ESTABLISHED,RELATED",
+			m.filterInstanceChain(),
+			network,
+		)
+
+		if m.policy.LogDenied {
+			rules = append(rules, fmt.Sprintf(
+				"%s --match limit --limit %s --limit-burst %d --jump LOG --log-prefix %q",
+				newConnections,
+				DenialLogRate,
+				DenialLogBurst,
+				m.denialLogPrefix(),
+			))
+		}
+
+		switch m.policy.DenyAction {
+		case DenyActionDrop:
+			rules = append(rules, newConnections+" --jump DROP")
+
+		case DenyActionReject:
+			unreachable := "icmp-port-unreachable"
+			if ipv6 {
+				unreachable = "icmp6-port-unreachable"
+			}
+
+			rules = append(
+				rules,
+				newConnections+" --protocol tcp --jump REJECT --reject-with tcp-reset",
+				newConnections+" --jump REJECT --reject-with "+unreachable,
+			)
+		}
+	}
+
+	return rules
+}
+
+// Teardown removes the container's instance chains and its membership of
+// its network group, leaving its interfaces in place so that Setup can
+// recreate the rest around them. Any of these may already be gone.
+func (m *ContainerNetworkManager) Teardown() error {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		filterRules := m.teardownRules(
+			iptables,
+			"filter",
+			m.config.IPTables.Filter.ForwardChain,
+			boundChain{"-g", m.filterInstanceChain()},
+			boundChain{"-j", m.filterAccountingChain()},
+		)
+
+		natChains := []boundChain{{"-j", m.natInstanceChain()}}
+		if m.legacyNATInstanceChain() != m.natInstanceChain() {
+			natChains = append(natChains, boundChain{"-j", m.legacyNATInstanceChain()})
+		}
+
+		natRules := m.teardownRules(
+			iptables,
+			"nat",
+			m.config.IPTables.NAT.PreroutingChain,
+			natChains...,
+		)
+
+		if len(filterRules) == 0 && len(natRules) == 0 {
+			continue
+		}
+
+		batch := []string{"*filter"}
+		batch = append(batch, filterRules...)
+		batch = append(batch, "COMMIT", "*nat")
+		batch = append(batch, natRules...)
+		batch = append(batch, "COMMIT")
+
+		err := m.restore(iptables, batch...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.groups != nil {
+		err := m.groups.Leave(m.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Destroy tears down the container's networking, including its host
+// interface, which takes the container end and its qdiscs with it.
+func (m *ContainerNetworkManager) Destroy() error {
+	err := m.Teardown()
+	if err != nil {
+		return err
+	}
+
+	return m.links.Delete(m.hostIface)
+}
+
+func (m *ContainerNetworkManager) NetIn(mapping PortMapping) error {
+	return m.netIn("-A", mapping)
+}
+
+func (m *ContainerNetworkManager) RemoveNetIn(mapping PortMapping) error {
+	return m.netIn("-D", mapping)
+}
+
+func (m *ContainerNetworkManager) NetOut(rule EgressRule) error {
+	return m.netOut(fmt.Sprintf("-I %s 1", m.filterInstanceChain()), rule)
+}
+
+func (m *ContainerNetworkManager) RemoveNetOut(rule EgressRule) error {
+	return m.netOut(fmt.Sprintf("-D %s", m.filterInstanceChain()), rule)
+}
+
+func (m *ContainerNetworkManager) netIn(action string, mapping PortMapping) error {
+	protocols := []string{mapping.Protocol}
+	if mapping.Protocol == "" {
+		protocols = []string{"tcp"}
+	} else if mapping.Protocol == "all" {
+		protocols = []string{"tcp", "udp"}
+	}
+
+	count := mapping.PortCount
+	if count == 0 {
+		count = 1
+	}
+
+	// without an external IP, e.g. on hosts with no default route, map from
+	// any local address
+	destination := "--match addrtype --dst-type LOCAL"
+	if m.externalIP != nil {
+		destination = "--destination " + m.externalIP.String()
+	}
+
+	if mapping.HostIP != nil {
+		if mapping.HostIP.IsUnspecified() {
+			destination = "--match addrtype --dst-type LOCAL"
+		} else {
+			destination = "--destination " + mapping.HostIP.String()
+		}
+	}
+
+	// there is no single external IPv6 address; map from any local address
+	// unless the mapping is bound to a specific address
+	mapIPv6 := m.ipv6Network != nil && (mapping.HostIP == nil || mapping.HostIP.IsUnspecified())
+
+	rules := []string{}
+	ipv6Rules := []string{}
+
+	for offset := uint32(0); offset < count; offset++ {
+		for _, protocol := range protocols {
+			rules = append(rules, fmt.Sprintf(
+				"%s %s --protocol %s %s --destination-port %d --jump DNAT --to-destination %s:%d",
+				action,
+				m.natInstanceChain(),
+				protocol,
+				destination,
+				mapping.HostPort+offset,
+				m.network.ContainerIP(),
+				mapping.ContainerPort+offset,
+			))
+
+			if mapIPv6 {
+				ipv6Rules = append(ipv6Rules, fmt.Sprintf(
+					"%s %s --protocol %s --match addrtype --dst-type LOCAL --destination-port %d --jump DNAT --to-destination [%s]:%d",
+					action,
+					m.natInstanceChain(),
+					protocol,
+					mapping.HostPort+offset,
+					m.ipv6Network.ContainerIP(),
+					mapping.ContainerPort+offset,
+				))
+			}
+		}
+	}
+
+	err := m.restore("iptables", append(append([]string{"*nat"}, rules...), "COMMIT")...)
+	if err != nil {
+		return err
+	}
+
+	if len(ipv6Rules) > 0 {
+		return m.restore("ip6tables", append(append([]string{"*nat"}, ipv6Rules...), "COMMIT")...)
+	}
+
+	return nil
+}
+
+func (m *ContainerNetworkManager) netOut(action string, rule EgressRule) error {
+	destination := strings.Join(rule.Networks, ",") + rule.IPRange
+
+	if destination == "" && rule.Port == 0 && rule.PortRange == "" && (rule.Protocol == "" || rule.Protocol == "all") {
+		return fmt.Errorf("network, port, and/or protocol must be provided")
+	}
+
+	opts := []string{}
+
+	if len(rule.Networks) > 0 {
+		opts = append(opts, "--destination "+strings.Join(rule.Networks, ","))
+	}
+
+	if rule.IPRange != "" {
+		opts = append(opts, "--match iprange --dst-range "+rule.IPRange)
+	}
+
+	protocol := rule.Protocol
+	if protocol == "" && (rule.Port != 0 || rule.PortRange != "") {
+		protocol = "tcp"
+	}
+
+	if protocol != "" && protocol != "all" {
+		opts = append(opts, "--protocol "+protocol)
+	}
+
+	if rule.Port != 0 {
+		opts = append(opts, fmt.Sprintf("--destination-port %d", rule.Port))
+	}
+
+	if rule.PortRange != "" {
+		opts = append(opts, "--match multiport --destination-ports "+rule.PortRange)
+	}
+
+	line := action + " " + strings.Join(opts, " ") + " --jump RETURN"
+
+	// ip6tables knows ICMP for IPv6 under its own name
+	ipv6Line := strings.Replace(line, "--protocol icmp", "--protocol icmpv6", 1)
+
+	// apply the rule to the address family of the destination, or to both if
+	// only ports and/or a protocol are given
+	if strings.Contains(destination, ":") {
+		if m.ipv6Network == nil {
+			return ErrNoIPv6Network
+		}
+
+		return m.restore("ip6tables", "*filter", ipv6Line, "COMMIT")
+	}
+
+	err := m.restore("iptables", "*filter", line, "COMMIT")
+	if err != nil {
+		return err
+	}
+
+	if destination == "" && m.ipv6Network != nil {
+		return m.restore("ip6tables", "*filter", ipv6Line, "COMMIT")
+	}
+
+	return nil
+}
+
+// teardownRules lists the rules that unbind and delete an instance chain, if
+// it exists. Failing to list the table (e.g. because the family is not
+// available) means there is nothing to tear down.
+// boundChain is a chain of the container's that its parent chain jumps to
+type boundChain struct {
+	jump string
+	name string
+}
+
+func (m *ContainerNetworkManager) teardownRules(iptables, table, parentChain string, chains ...boundChain) []string {
+	out := new(bytes.Buffer)
+
+	err := m.runner.Run(&exec.Cmd{
+		Path:   iptables,
+		Args:   []string{"-w", "-t", table, "-S"},
+		Stdout: out,
+	})
+	if err != nil {
+		return nil
+	}
+
+	bindings := []string{}
+	exists := map[string]bool{}
+
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		for _, chain := range chains {
+			if line == "-N "+chain.name {
+				exists[chain.name] = true
+			}
+
+			if strings.HasPrefix(line, "-A "+parentChain+" ") && strings.HasSuffix(line, " "+chain.jump+" "+chain.name) {
+				bindings = append(bindings, "-D"+strings.TrimPrefix(line, "-A"))
+			}
+		}
+	}
+
+	rules := bindings
+
+	for _, chain := range chains {
+		if exists[chain.name] {
+			rules = append(rules, "-F "+chain.name, "-X "+chain.name)
+		}
+	}
+
+	return rules
+}
+
+func (m *ContainerNetworkManager) restore(iptables string, batch ...string) error {
+	return restore(m.runner, m.id, iptables, batch...)
+}
+
+func restore(runner command_runner.CommandRunner, logID string, iptables string, batch ...string) error {
+	iptablesLock.Lock()
+	defer iptablesLock.Unlock()
+
+	stderr := new(bytes.Buffer)
+
+	err := runner.Run(&exec.Cmd{
+		Path:   iptables + "-restore",
+		Args:   []string{"--noflush"},
+		Stdin:  strings.NewReader(strings.Join(batch, "\n") + "\n"),
+		Stderr: stderr,
+	})
+	if err != nil {
+		log.Println(logID, iptables+"-restore failed:", stderr.String())
+		return err
+	}
+
+	return nil
+}
+
+func (m *ContainerNetworkManager) families() []string {
+	if m.ipv6Network != nil {
+		return []string{"iptables", "ip6tables"}
+	}
+
+	return []string{"iptables"}
+}
+
+func (m *ContainerNetworkManager) filterInstanceChain() string {
+	return m.config.IPTables.Filter.InstancePrefix + m.id
+}
+
+func (m *ContainerNetworkManager) natInstanceChain() string {
+	return m.config.IPTables.NAT.InstancePrefix + m.id
+}
+
+// legacyNATInstanceChain is what net.sh named the NAT instance chain, using
+// the filter prefix, for containers set up before it was replaced.
+func (m *ContainerNetworkManager) legacyNATInstanceChain() string {
+	return m.config.IPTables.Filter.InstancePrefix + m.id
+}
@@ -0,0 +1,13 @@
+package network_manager_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNetwork_manager(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Network_manager Suite")
+}
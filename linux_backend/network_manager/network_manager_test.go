@@ -0,0 +1,1321 @@
+package network_manager_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager/fake_links"
+	"github.com/cloudfoundry-incubator/warden-linux/sysconfig"
+	"github.com/cloudfoundry/gunk/command_runner/fake_command_runner"
+	. "github.com/cloudfoundry/gunk/command_runner/fake_command_runner/matchers"
+)
+
+var _ = Describe("Network manager", func() {
+	var fakeRunner *fake_command_runner.FakeCommandRunner
+	var fakeLinks *fake_links.FakeLinks
+	var containerNetwork *network.Network
+	var ipv6Network *network.Network
+	var externalIP net.IP
+	var policy network_manager.Policy
+	var config sysconfig.Config
+	var networkManager *network_manager.ContainerNetworkManager
+
+	batch := func(lines ...string) string {
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	BeforeEach(func() {
+		fakeRunner = fake_command_runner.New()
+		fakeLinks = fake_links.New()
+
+		_, ipNet, err := net.ParseCIDR("10.254.0.4/30")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		containerNetwork = network.New(ipNet)
+
+		ipv6Network = nil
+
+		externalIP = net.ParseIP("1.2.3.4")
+
+		policy = network_manager.Policy{}
+
+		config = sysconfig.NewConfig("0")
+	})
+
+	JustBeforeEach(func() {
+		networkManager = network_manager.New(
+			config,
+			"some-id",
+			containerNetwork,
+			ipv6Network,
+			externalIP,
+			policy,
+			network_manager.NewGroups(sysconfig.NewConfig("0"), ipv6Network != nil, fakeRunner),
+			fakeLinks,
+			fakeRunner,
+		)
+	})
+
+	withIPv6 := func() {
+		BeforeEach(func() {
+			_, ipNet, err := net.ParseCIDR("fd00::4/126")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			ipv6Network = network.New(ipNet)
+		})
+	}
+
+	Describe("interface names", func() {
+		It("are the prefix, the ID, and the end of the pair", func() {
+			hostIface, containerIface := network_manager.InterfaceNames("w0", "some-id")
+			Ω(hostIface).Should(Equal("w0some-id-0"))
+			Ω(containerIface).Should(Equal("w0some-id-1"))
+		})
+
+		Context("when the ID is too long", func() {
+			It("keeps the end of it so that the names fit in IFNAMSIZ", func() {
+				hostIface, containerIface := network_manager.InterfaceNames("w0", "0123456789abcdefghij")
+				Ω(hostIface).Should(Equal("w09abcdefghij-0"))
+				Ω(containerIface).Should(Equal("w09abcdefghij-1"))
+				Ω(len(hostIface)).Should(Equal(15))
+			})
+		})
+	})
+
+	Describe("looking up an interface's MTU", func() {
+		It("finds the interface by its address", func() {
+			mtu, err := network_manager.InterfaceMTU(net.ParseIP("127.0.0.1"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mtu).ShouldNot(BeZero())
+		})
+
+		Context("when no interface has the address", func() {
+			It("returns an error", func() {
+				_, err := network_manager.InterfaceMTU(net.ParseIP("192.0.2.1"))
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("creating interfaces", func() {
+		It("creates a veth pair and brings up the addressed host end", func() {
+			err := networkManager.CreateInterfaces(1400)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLinks.VethPairs).Should(Equal([][2]string{{"w0some-id-0", "w0some-id-1"}}))
+			Ω(fakeLinks.MTUs).Should(Equal(map[string]uint32{
+				"w0some-id-0": 1400,
+				"w0some-id-1": 1400,
+			}))
+			Ω(fakeLinks.Addresses["w0some-id-0"]).Should(Equal([]string{"10.254.0.5/30"}))
+			Ω(fakeLinks.Up).Should(Equal([]string{"w0some-id-0"}))
+		})
+
+		Context("with an IPv6 network", func() {
+			withIPv6()
+
+			It("also adds the IPv6 host address", func() {
+				err := networkManager.CreateInterfaces(1400)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLinks.Addresses["w0some-id-0"]).Should(Equal([]string{"10.254.0.5/30", "fd00::5/126"}))
+			})
+		})
+
+		Context("when setting the MTU fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeLinks.SetMTUError = disaster
+			})
+
+			It("returns the error", func() {
+				err := networkManager.CreateInterfaces(1400)
+				Ω(err).Should(Equal(disaster))
+
+				Ω(fakeLinks.Up).Should(BeEmpty())
+			})
+		})
+
+		Context("when creating the veth pair fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeLinks.CreateVethPairError = disaster
+			})
+
+			It("returns the error", func() {
+				err := networkManager.CreateInterfaces(1400)
+				Ω(err).Should(Equal(disaster))
+
+				Ω(fakeLinks.Up).Should(BeEmpty())
+			})
+		})
+	})
+
+	Describe("setting up", func() {
+		It("creates the instance chains and binds them in one batch", func() {
+			err := networkManager.Setup()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables-restore",
+					Args: []string{"--noflush"},
+					Stdin: batch(
+						"*filter",
+						":w-0-instance-some-id - [0:0]",
+						"-A w-0-instance-some-id --goto w-0-default",
+						"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+						"COMMIT",
+						"*nat",
+						":w-0-instance-some-id - [0:0]",
+						"-A w-0-prerouting --jump w-0-instance-some-id",
+						"COMMIT",
+					),
+				},
+			))
+
+			Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "ip6tables-restore",
+				},
+			))
+		})
+
+		It("keeps the interfaces created before it", func() {
+			err := networkManager.CreateInterfaces(1500)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = networkManager.Setup()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLinks.VethPairs).Should(Equal([][2]string{{"w0some-id-0", "w0some-id-1"}}))
+			Ω(fakeLinks.Deleted).Should(BeEmpty())
+		})
+
+		Context("with an IPv6 network", func() {
+			withIPv6()
+
+			It("also sets up the IPv6 chains", func() {
+				err := networkManager.Setup()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+					},
+					fake_command_runner.CommandSpec{
+						Path: "ip6tables-restore",
+					},
+				))
+			})
+		})
+
+		Context("when the batch fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+					}, func(*exec.Cmd) error {
+						return disaster
+					},
+				)
+			})
+
+			It("returns the error", func() {
+				err := networkManager.Setup()
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+
+		Context("when denials are logged", func() {
+			BeforeEach(func() {
+				policy = network_manager.Policy{
+					AllowNetworks: []string{"10.1.0.0/16", "fd00:1::/64"},
+					DenyNetworks:  []string{"10.0.0.0/8", "fd00::/8"},
+					LogDenied:     true,
+				}
+			})
+
+			It("logs new connections to denied networks that are not allowed, at a limited rate", func() {
+				err := networkManager.Setup()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-instance-some-id --destination 10.1.0.0/16 --goto w-0-default",
+							`-A w-0-instance-some-id --destination 10.0.0.0/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --match limit --limit 6/minute --limit-burst 5 --jump LOG --log-prefix "w0some-id-0 denied: "`,
+							"-A w-0-instance-some-id --goto w-0-default",
+							"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+							"COMMIT",
+							"*nat",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-prerouting --jump w-0-instance-some-id",
+							"COMMIT",
+						),
+					},
+				))
+			})
+
+			Context("with an IPv6 network", func() {
+				withIPv6()
+
+				It("logs denials of the IPv6 networks in the IPv6 chain", func() {
+					err := networkManager.Setup()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeRunner).Should(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "iptables-restore",
+						},
+						fake_command_runner.CommandSpec{
+							Path: "ip6tables-restore",
+							Args: []string{"--noflush"},
+							Stdin: batch(
+								"*filter",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-instance-some-id --destination fd00:1::/64 --goto w-0-default",
+								`-A w-0-instance-some-id --destination fd00::/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --match limit --limit 6/minute --limit-burst 5 --jump LOG --log-prefix "w0some-id-0 denied: "`,
+								"-A w-0-instance-some-id --goto w-0-default",
+								"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+								"COMMIT",
+								"*nat",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-prerouting --jump w-0-instance-some-id",
+								"COMMIT",
+							),
+						},
+					))
+				})
+			})
+		})
+
+		Context("when the deny action is overridden", func() {
+			BeforeEach(func() {
+				policy = network_manager.Policy{
+					AllowNetworks: []string{"10.1.0.0/16", ""},
+					DenyNetworks:  []string{"10.0.0.0/8", "fd00::/8", ""},
+					DenyAction:    network_manager.DenyActionDrop,
+				}
+			})
+
+			It("denies new connections to denied networks that are not allowed", func() {
+				err := networkManager.Setup()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-instance-some-id --destination 10.1.0.0/16 --goto w-0-default",
+							"-A w-0-instance-some-id --destination 10.0.0.0/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --jump DROP",
+							"-A w-0-instance-some-id --goto w-0-default",
+							"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+							"COMMIT",
+							"*nat",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-prerouting --jump w-0-instance-some-id",
+							"COMMIT",
+						),
+					},
+				))
+			})
+
+			Context("and denials are logged", func() {
+				BeforeEach(func() {
+					policy.LogDenied = true
+				})
+
+				It("logs them before denying them", func() {
+					err := networkManager.Setup()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeRunner).Should(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "iptables-restore",
+							Args: []string{"--noflush"},
+							Stdin: batch(
+								"*filter",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-instance-some-id --destination 10.1.0.0/16 --goto w-0-default",
+								`-A w-0-instance-some-id --destination 10.0.0.0/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --match limit --limit 6/minute --limit-burst 5 --jump LOG --log-prefix "w0some-id-0 denied: "`,
+								"-A w-0-instance-some-id --destination 10.0.0.0/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --jump DROP",
+								"-A w-0-instance-some-id --goto w-0-default",
+								"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+								"COMMIT",
+								"*nat",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-prerouting --jump w-0-instance-some-id",
+								"COMMIT",
+							),
+						},
+					))
+				})
+			})
+
+			Context("to reject", func() {
+				BeforeEach(func() {
+					policy.DenyAction = network_manager.DenyActionReject
+				})
+
+				withIPv6()
+
+				It("resets TCP connections and rejects everything else as unreachable", func() {
+					err := networkManager.Setup()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeRunner).Should(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "iptables-restore",
+							Args: []string{"--noflush"},
+							Stdin: batch(
+								"*filter",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-instance-some-id --destination 10.1.0.0/16 --goto w-0-default",
+								"-A w-0-instance-some-id --destination 10.0.0.0/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --protocol tcp --jump REJECT --reject-with tcp-reset",
+								"-A w-0-instance-some-id --destination 10.0.0.0/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --jump REJECT --reject-with icmp-port-unreachable",
+								"-A w-0-instance-some-id --goto w-0-default",
+								"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+								"COMMIT",
+								"*nat",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-prerouting --jump w-0-instance-some-id",
+								"COMMIT",
+							),
+						},
+						fake_command_runner.CommandSpec{
+							Path: "ip6tables-restore",
+							Args: []string{"--noflush"},
+							Stdin: batch(
+								"*filter",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-instance-some-id --destination fd00::/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --protocol tcp --jump REJECT --reject-with tcp-reset",
+								"-A w-0-instance-some-id --destination fd00::/8 --match conntrack ! --ctstate ESTABLISHED,RELATED --jump REJECT --reject-with icmp6-port-unreachable",
+								"-A w-0-instance-some-id --goto w-0-default",
+								"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+								"COMMIT",
+								"*nat",
+								":w-0-instance-some-id - [0:0]",
+								"-A w-0-prerouting --jump w-0-instance-some-id",
+								"COMMIT",
+							),
+						},
+					))
+				})
+			})
+		})
+
+		Context("when traffic is accounted", func() {
+			BeforeEach(func() {
+				policy.Buckets = []network_manager.AccountingBucket{
+					{Name: "internal", Networks: []string{"10.0.0.0/8", "fd00::/8"}},
+					{Name: "peers", Networks: []string{"192.168.0.0/16"}},
+				}
+			})
+
+			It("counts it by bucket before the instance chain", func() {
+				err := networkManager.Setup()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							":w-0-acct-some-id - [0:0]",
+							"-A w-0-acct-some-id --destination 10.0.0.0/8 --jump RETURN",
+							"-A w-0-acct-some-id --destination 192.168.0.0/16 --jump RETURN",
+							"-A w-0-acct-some-id --jump RETURN",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-instance-some-id --goto w-0-default",
+							"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+							"-I w-0-forward 2 --in-interface w0some-id-0 --jump w-0-acct-some-id",
+							"COMMIT",
+							"*nat",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-prerouting --jump w-0-instance-some-id",
+							"COMMIT",
+						),
+					},
+				))
+			})
+
+			Describe("reading the totals", func() {
+				withIPv6()
+
+				BeforeEach(func() {
+					fakeRunner.WhenRunning(
+						fake_command_runner.CommandSpec{
+							Path: "iptables",
+							Args: []string{"-w", "-t", "filter", "-L", "w-0-acct-some-id", "-v", "-x", "-n"},
+						}, func(cmd *exec.Cmd) error {
+							cmd.Stdout.Write([]byte(`Chain w-0-acct-some-id (1 references)
+    pkts      bytes target     prot opt in     out     source               destination
+       8     1024 RETURN     all  --  *      *       0.0.0.0/0            10.0.0.0/8
+       2      128 RETURN     all  --  *      *       0.0.0.0/0            192.168.0.0/16
+      16     2048 RETURN     all  --  *      *       0.0.0.0/0            0.0.0.0/0
+`))
+							return nil
+						},
+					)
+
+					fakeRunner.WhenRunning(
+						fake_command_runner.CommandSpec{
+							Path: "ip6tables",
+							Args: []string{"-w", "-t", "filter", "-L", "w-0-acct-some-id", "-v", "-x", "-n"},
+						}, func(cmd *exec.Cmd) error {
+							cmd.Stdout.Write([]byte(`Chain w-0-acct-some-id (1 references)
+    pkts      bytes target     prot opt in     out     source               destination
+       1      100 RETURN     all      *      *       ::/0                 fd00::/8
+       4      400 RETURN     all      *      *       ::/0                 ::/0
+`))
+							return nil
+						},
+					)
+				})
+
+				It("sums each bucket's counters across both families", func() {
+					accounting, err := networkManager.Accounting()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(accounting).Should(Equal(map[string]network_manager.Traffic{
+						"internal": {Bytes: 1124, Packets: 9},
+						"peers":    {Bytes: 128, Packets: 2},
+						"other":    {Bytes: 2448, Packets: 20},
+					}))
+				})
+			})
+
+			Context("when reading the totals fails", func() {
+				disaster := errors.New("oh no!")
+
+				BeforeEach(func() {
+					fakeRunner.WhenRunning(
+						fake_command_runner.CommandSpec{
+							Path: "iptables",
+						}, func(*exec.Cmd) error {
+							return disaster
+						},
+					)
+				})
+
+				It("returns the error", func() {
+					_, err := networkManager.Accounting()
+					Ω(err).Should(Equal(disaster))
+				})
+			})
+		})
+
+		Context("when traffic is not accounted", func() {
+			It("has no totals", func() {
+				accounting, err := networkManager.Accounting()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(accounting).Should(BeEmpty())
+
+				Ω(fakeRunner.ExecutedCommands()).Should(BeEmpty())
+			})
+		})
+
+		Context("when the container is in a network group", func() {
+			BeforeEach(func() {
+				policy.Group = "some-group"
+			})
+
+			It("joins the group and jumps to its chain first", func() {
+				err := networkManager.Setup()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							":w-0-group-92b6f927 - [0:0]",
+							"-A w-0-group-92b6f927 --destination 10.254.0.6 --jump ACCEPT",
+							"COMMIT",
+						),
+					},
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-instance-some-id --jump w-0-group-92b6f927",
+							"-A w-0-instance-some-id --goto w-0-default",
+							"-I w-0-forward 2 --in-interface w0some-id-0 --goto w-0-instance-some-id",
+							"COMMIT",
+							"*nat",
+							":w-0-instance-some-id - [0:0]",
+							"-A w-0-prerouting --jump w-0-instance-some-id",
+							"COMMIT",
+						),
+					},
+				))
+			})
+
+			It("leaves the group when tearing down", func() {
+				err := networkManager.Setup()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = networkManager.Teardown()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*filter",
+							"-F w-0-group-92b6f927",
+							"-X w-0-group-92b6f927",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+	})
+
+	Describe("watching denials", func() {
+		var originalKernelLogPath string
+
+		BeforeEach(func() {
+			originalKernelLogPath = network_manager.KernelLogPath
+			network_manager.KernelLogPath = "/path/to/nonexistent/kmsg"
+		})
+
+		AfterEach(func() {
+			network_manager.KernelLogPath = originalKernelLogPath
+		})
+
+		Context("when denials are not logged", func() {
+			It("does not read the kernel log", func() {
+				err := networkManager.WatchDenials(func(network_manager.Denial) {})
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when denials are logged", func() {
+			BeforeEach(func() {
+				policy.LogDenied = true
+			})
+
+			Context("and the kernel log cannot be read", func() {
+				It("returns the error", func() {
+					err := networkManager.WatchDenials(func(network_manager.Denial) {})
+					Ω(err).Should(HaveOccurred())
+				})
+			})
+		})
+	})
+
+	Describe("stat", func() {
+		var originalSysClassNetPath string
+
+		BeforeEach(func() {
+			originalSysClassNetPath = network_manager.SysClassNetPath
+
+			sysClassNet, err := ioutil.TempDir("", "sys-class-net")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			network_manager.SysClassNetPath = sysClassNet
+
+			statistics := path.Join(sysClassNet, "w0some-id-0", "statistics")
+
+			err = os.MkdirAll(statistics, 0755)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			counters := map[string]string{
+				"rx_bytes":   "1024\n",
+				"rx_packets": "8\n",
+				"rx_dropped": "1\n",
+				"tx_bytes":   "2048\n",
+				"tx_packets": "16\n",
+				"tx_dropped": "2\n",
+			}
+
+			for name, value := range counters {
+				err := ioutil.WriteFile(path.Join(statistics, name), []byte(value), 0644)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(network_manager.SysClassNetPath)
+			network_manager.SysClassNetPath = originalSysClassNetPath
+		})
+
+		It("reads the host interface's counters", func() {
+			stat, err := networkManager.Stat()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(stat).Should(Equal(network_manager.InterfaceStat{
+				RxBytes:   1024,
+				RxPackets: 8,
+				RxDropped: 1,
+				TxBytes:   2048,
+				TxPackets: 16,
+				TxDropped: 2,
+			}))
+		})
+
+		Context("when the interface does not exist", func() {
+			It("returns an error", func() {
+				os.RemoveAll(path.Join(network_manager.SysClassNetPath, "w0some-id-0"))
+
+				_, err := networkManager.Stat()
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("parsing accounting buckets", func() {
+		It("parses semicolon-separated name=cidr,... buckets", func() {
+			buckets, err := network_manager.ParseAccountingBuckets("internal=10.0.0.0/8,fd00::/8;peers=192.168.0.0/16")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(buckets).Should(Equal([]network_manager.AccountingBucket{
+				{Name: "internal", Networks: []string{"10.0.0.0/8", "fd00::/8"}},
+				{Name: "peers", Networks: []string{"192.168.0.0/16"}},
+			}))
+		})
+
+		It("returns no buckets for an empty spec", func() {
+			buckets, err := network_manager.ParseAccountingBuckets("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(buckets).Should(BeEmpty())
+		})
+
+		It("rejects invalid buckets", func() {
+			_, err := network_manager.ParseAccountingBuckets("internal")
+			Ω(err).Should(HaveOccurred())
+
+			_, err = network_manager.ParseAccountingBuckets("internal=10.0.0.0")
+			Ω(err).Should(HaveOccurred())
+
+			_, err = network_manager.ParseAccountingBuckets("other=10.0.0.0/8")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("deny actions", func() {
+		It("are drop or reject", func() {
+			Ω(network_manager.DenyActionDrop.Validate()).ShouldNot(HaveOccurred())
+			Ω(network_manager.DenyActionReject.Validate()).ShouldNot(HaveOccurred())
+			Ω(network_manager.DenyAction("explode").Validate()).Should(HaveOccurred())
+			Ω(network_manager.DenyAction("").Validate()).Should(HaveOccurred())
+		})
+	})
+
+	Describe("parsing denials", func() {
+		prefix := "w0some-id-0 denied: "
+
+		It("extracts the protocol, destination, and port", func() {
+			denial, ok := network_manager.ParseDenial(
+				prefix,
+				"w0some-id-0 denied: IN=w0some-id-0 OUT=eth0 SRC=10.254.0.6 DST=10.0.0.1 LEN=60 TTL=63 ID=1 DF PROTO=TCP SPT=4321 DPT=80 WINDOW=29200 SYN\n",
+			)
+			Ω(ok).Should(BeTrue())
+			Ω(denial).Should(Equal(network_manager.Denial{
+				Protocol:    "tcp",
+				Destination: "10.0.0.1",
+				Port:        80,
+			}))
+			Ω(denial.String()).Should(Equal("tcp to 10.0.0.1:80"))
+		})
+
+		It("handles protocols without ports", func() {
+			denial, ok := network_manager.ParseDenial(
+				prefix,
+				"w0some-id-0 denied: IN=w0some-id-0 OUT=eth0 SRC=fd00::6 DST=fd00::1 LEN=104 PROTO=ICMPv6 TYPE=128 CODE=0",
+			)
+			Ω(ok).Should(BeTrue())
+			Ω(denial.String()).Should(Equal("icmpv6 to fd00::1"))
+		})
+
+		It("ignores messages without the prefix", func() {
+			_, ok := network_manager.ParseDenial(
+				prefix,
+				"w0some-other-id-0 denied: IN=w0some-other-id-0 DST=10.0.0.1 PROTO=TCP DPT=80",
+			)
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Describe("tearing down", func() {
+		Context("when the instance chains exist", func() {
+			BeforeEach(func() {
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "iptables",
+						Args: []string{"-w", "-t", "filter", "-S"},
+					}, func(cmd *exec.Cmd) error {
+						cmd.Stdout.Write([]byte(strings.Join([]string{
+							"-P FORWARD ACCEPT",
+							"-N w-0-forward",
+							"-N w-0-instance-some-id",
+							"-N w-0-instance-some-other-id",
+							"-A w-0-forward -i w0some-id-0 -g w-0-instance-some-id",
+							"-A w-0-forward -i w0other-id-0 -g w-0-instance-some-other-id",
+							"-A w-0-instance-some-id -g w-0-default",
+						}, "\n")))
+						return nil
+					},
+				)
+
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "iptables",
+						Args: []string{"-w", "-t", "nat", "-S"},
+					}, func(cmd *exec.Cmd) error {
+						cmd.Stdout.Write([]byte(strings.Join([]string{
+							"-N w-0-prerouting",
+							"-N w-0-instance-some-id",
+							"-A w-0-prerouting -j w-0-instance-some-id",
+						}, "\n")))
+						return nil
+					},
+				)
+			})
+
+			It("unbinds and deletes them in one batch", func() {
+				err := networkManager.Teardown()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							"-D w-0-forward -i w0some-id-0 -g w-0-instance-some-id",
+							"-F w-0-instance-some-id",
+							"-X w-0-instance-some-id",
+							"COMMIT",
+							"*nat",
+							"-D w-0-prerouting -j w-0-instance-some-id",
+							"-F w-0-instance-some-id",
+							"-X w-0-instance-some-id",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("when the NAT instance chain has the legacy name", func() {
+			BeforeEach(func() {
+				config.IPTables.NAT.InstancePrefix = "w-0-nat-instance-"
+
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "iptables",
+						Args: []string{"-w", "-t", "nat", "-S"},
+					}, func(cmd *exec.Cmd) error {
+						cmd.Stdout.Write([]byte(strings.Join([]string{
+							"-N w-0-prerouting",
+							"-N w-0-instance-some-id",
+							"-A w-0-prerouting -j w-0-instance-some-id",
+						}, "\n")))
+						return nil
+					},
+				)
+			})
+
+			It("unbinds and deletes it too", func() {
+				err := networkManager.Teardown()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							"COMMIT",
+							"*nat",
+							"-D w-0-prerouting -j w-0-instance-some-id",
+							"-F w-0-instance-some-id",
+							"-X w-0-instance-some-id",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("when the accounting chain exists", func() {
+			BeforeEach(func() {
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "iptables",
+						Args: []string{"-w", "-t", "filter", "-S"},
+					}, func(cmd *exec.Cmd) error {
+						cmd.Stdout.Write([]byte(strings.Join([]string{
+							"-N w-0-forward",
+							"-N w-0-acct-some-id",
+							"-N w-0-instance-some-id",
+							"-A w-0-forward -i w0some-id-0 -j w-0-acct-some-id",
+							"-A w-0-forward -i w0some-id-0 -g w-0-instance-some-id",
+							"-A w-0-acct-some-id -j RETURN",
+							"-A w-0-instance-some-id -g w-0-default",
+						}, "\n")))
+						return nil
+					},
+				)
+			})
+
+			It("unbinds and deletes it after the instance chain", func() {
+				err := networkManager.Teardown()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Args: []string{"--noflush"},
+						Stdin: batch(
+							"*filter",
+							"-D w-0-forward -i w0some-id-0 -j w-0-acct-some-id",
+							"-D w-0-forward -i w0some-id-0 -g w-0-instance-some-id",
+							"-F w-0-instance-some-id",
+							"-X w-0-instance-some-id",
+							"-F w-0-acct-some-id",
+							"-X w-0-acct-some-id",
+							"COMMIT",
+							"*nat",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("when the instance chains do not exist", func() {
+			It("does not run a batch", func() {
+				err := networkManager.Teardown()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+					},
+				))
+			})
+		})
+
+		It("does not delete the host interface", func() {
+			err := networkManager.Teardown()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLinks.Deleted).Should(BeEmpty())
+		})
+	})
+
+	Describe("destroying", func() {
+		It("tears down the chains", func() {
+			err := networkManager.Destroy()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables",
+					Args: []string{"-w", "-t", "filter", "-S"},
+				},
+			))
+		})
+
+		It("deletes the host interface", func() {
+			err := networkManager.Destroy()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLinks.Deleted).Should(Equal([]string{"w0some-id-0"}))
+		})
+
+		Context("when deleting the host interface fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeLinks.DeleteError = disaster
+			})
+
+			It("returns the error", func() {
+				err := networkManager.Destroy()
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
+	Describe("mapping ports", func() {
+		It("adds a DNAT rule from the external IP", func() {
+			err := networkManager.NetIn(network_manager.PortMapping{
+				HostPort:      123,
+				ContainerPort: 456,
+				Protocol:      "tcp",
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables-restore",
+					Args: []string{"--noflush"},
+					Stdin: batch(
+						"*nat",
+						"-A w-0-instance-some-id --protocol tcp --destination 1.2.3.4 --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+						"COMMIT",
+					),
+				},
+			))
+		})
+
+		Context("for all protocols", func() {
+			It("maps both tcp and udp in one batch", func() {
+				err := networkManager.NetIn(network_manager.PortMapping{
+					HostPort:      123,
+					ContainerPort: 456,
+					Protocol:      "all",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*nat",
+							"-A w-0-instance-some-id --protocol tcp --destination 1.2.3.4 --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+							"-A w-0-instance-some-id --protocol udp --destination 1.2.3.4 --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("bound to a host IP", func() {
+			It("maps from that address", func() {
+				err := networkManager.NetIn(network_manager.PortMapping{
+					HostIP:        net.ParseIP("5.6.7.8"),
+					HostPort:      123,
+					ContainerPort: 456,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*nat",
+							"-A w-0-instance-some-id --protocol tcp --destination 5.6.7.8 --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("bound to all interfaces", func() {
+			It("maps from any local address", func() {
+				err := networkManager.NetIn(network_manager.PortMapping{
+					HostIP:        net.IPv4zero,
+					HostPort:      123,
+					ContainerPort: 456,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*nat",
+							"-A w-0-instance-some-id --protocol tcp --match addrtype --dst-type LOCAL --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("when there is no external IP", func() {
+			BeforeEach(func() {
+				externalIP = nil
+			})
+
+			It("maps from any local address", func() {
+				err := networkManager.NetIn(network_manager.PortMapping{
+					HostPort:      123,
+					ContainerPort: 456,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*nat",
+							"-A w-0-instance-some-id --protocol tcp --match addrtype --dst-type LOCAL --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("for a range of ports", func() {
+			It("maps each port to its counterpart in one batch", func() {
+				err := networkManager.NetIn(network_manager.PortMapping{
+					HostPort:      123,
+					ContainerPort: 456,
+					PortCount:     3,
+					Protocol:      "tcp",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*nat",
+							"-A w-0-instance-some-id --protocol tcp --destination 1.2.3.4 --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+							"-A w-0-instance-some-id --protocol tcp --destination 1.2.3.4 --destination-port 124 --jump DNAT --to-destination 10.254.0.6:457",
+							"-A w-0-instance-some-id --protocol tcp --destination 1.2.3.4 --destination-port 125 --jump DNAT --to-destination 10.254.0.6:458",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Context("with an IPv6 network", func() {
+			withIPv6()
+
+			Context("when the mapping is bound to a specific IPv4 address", func() {
+				It("does not map IPv6", func() {
+					err := networkManager.NetIn(network_manager.PortMapping{
+						HostIP:        net.ParseIP("5.6.7.8"),
+						HostPort:      123,
+						ContainerPort: 456,
+						Protocol:      "tcp",
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "ip6tables-restore",
+						},
+					))
+				})
+			})
+
+			It("also maps from any local IPv6 address", func() {
+				err := networkManager.NetIn(network_manager.PortMapping{
+					HostPort:      123,
+					ContainerPort: 456,
+					Protocol:      "udp",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+					},
+					fake_command_runner.CommandSpec{
+						Path: "ip6tables-restore",
+						Stdin: batch(
+							"*nat",
+							"-A w-0-instance-some-id --protocol udp --match addrtype --dst-type LOCAL --destination-port 123 --jump DNAT --to-destination [fd00::6]:456",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Describe("removing a mapping", func() {
+			It("deletes the DNAT rule", func() {
+				err := networkManager.RemoveNetIn(network_manager.PortMapping{
+					HostPort:      123,
+					ContainerPort: 456,
+					Protocol:      "tcp",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*nat",
+							"-D w-0-instance-some-id --protocol tcp --destination 1.2.3.4 --destination-port 123 --jump DNAT --to-destination 10.254.0.6:456",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+	})
+
+	Describe("permitting traffic", func() {
+		It("inserts a RETURN rule at the top of the instance chain", func() {
+			err := networkManager.NetOut(network_manager.EgressRule{
+				Networks: []string{"1.2.3.4/22", "5.6.7.8"},
+				Port:     53,
+				Protocol: "udp",
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables-restore",
+					Args: []string{"--noflush"},
+					Stdin: batch(
+						"*filter",
+						"-I w-0-instance-some-id 1 --destination 1.2.3.4/22,5.6.7.8 --protocol udp --destination-port 53 --jump RETURN",
+						"COMMIT",
+					),
+				},
+			))
+		})
+
+		It("matches IP and port ranges", func() {
+			err := networkManager.NetOut(network_manager.EgressRule{
+				IPRange:   "10.0.0.1-10.0.0.9",
+				PortRange: "8000:9000",
+				Protocol:  "tcp",
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeRunner).Should(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "iptables-restore",
+					Stdin: batch(
+						"*filter",
+						"-I w-0-instance-some-id 1 --match iprange --dst-range 10.0.0.1-10.0.0.9 --protocol tcp --match multiport --destination-ports 8000:9000 --jump RETURN",
+						"COMMIT",
+					),
+				},
+			))
+		})
+
+		Context("when nothing is given", func() {
+			It("returns an error", func() {
+				err := networkManager.NetOut(network_manager.EgressRule{Protocol: "all"})
+				Ω(err).Should(HaveOccurred())
+
+				Ω(fakeRunner.ExecutedCommands()).Should(BeEmpty())
+			})
+		})
+
+		Context("when the destination is an IPv6 network", func() {
+			Context("and the container has no IPv6 network", func() {
+				It("returns ErrNoIPv6Network", func() {
+					err := networkManager.NetOut(network_manager.EgressRule{
+						Networks: []string{"fd00:1::/64"},
+						Protocol: "all",
+					})
+					Ω(err).Should(Equal(network_manager.ErrNoIPv6Network))
+				})
+			})
+
+			Context("and the container has an IPv6 network", func() {
+				withIPv6()
+
+				It("only adds an IPv6 rule", func() {
+					err := networkManager.NetOut(network_manager.EgressRule{
+						Networks: []string{"fd00:1::/64"},
+						Protocol: "all",
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeRunner).Should(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "ip6tables-restore",
+							Stdin: batch(
+								"*filter",
+								"-I w-0-instance-some-id 1 --destination fd00:1::/64 --jump RETURN",
+								"COMMIT",
+							),
+						},
+					))
+
+					Ω(fakeRunner).ShouldNot(HaveExecutedSerially(
+						fake_command_runner.CommandSpec{
+							Path: "iptables-restore",
+						},
+					))
+				})
+			})
+		})
+
+		Context("when only a protocol is given", func() {
+			withIPv6()
+
+			It("adds the rule for both families, using icmpv6 for IPv6", func() {
+				err := networkManager.NetOut(network_manager.EgressRule{
+					Protocol: "icmp",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*filter",
+							"-I w-0-instance-some-id 1 --protocol icmp --jump RETURN",
+							"COMMIT",
+						),
+					},
+					fake_command_runner.CommandSpec{
+						Path: "ip6tables-restore",
+						Stdin: batch(
+							"*filter",
+							"-I w-0-instance-some-id 1 --protocol icmpv6 --jump RETURN",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+
+		Describe("revoking a rule", func() {
+			It("deletes the RETURN rule", func() {
+				err := networkManager.RemoveNetOut(network_manager.EgressRule{
+					Networks: []string{"1.2.3.4/22"},
+					Protocol: "all",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeRunner).Should(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "iptables-restore",
+						Stdin: batch(
+							"*filter",
+							"-D w-0-instance-some-id --destination 1.2.3.4/22 --jump RETURN",
+							"COMMIT",
+						),
+					},
+				))
+			})
+		})
+	})
+})
@@ -0,0 +1,51 @@
+package network_manager
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// where the kernel exposes interfaces' counters
+var SysClassNetPath = "/sys/class/net"
+
+// InterfaceStat is the traffic counters of the host end of a container's
+// veth pair. Traffic the host end receives (Rx) was sent by the container,
+// and vice versa.
+type InterfaceStat struct {
+	RxBytes   uint64
+	RxPackets uint64
+	RxDropped uint64
+
+	TxBytes   uint64
+	TxPackets uint64
+	TxDropped uint64
+}
+
+func (m *ContainerNetworkManager) Stat() (InterfaceStat, error) {
+	stat := InterfaceStat{}
+
+	counters := map[string]*uint64{
+		"rx_bytes":   &stat.RxBytes,
+		"rx_packets": &stat.RxPackets,
+		"rx_dropped": &stat.RxDropped,
+		"tx_bytes":   &stat.TxBytes,
+		"tx_packets": &stat.TxPackets,
+		"tx_dropped": &stat.TxDropped,
+	}
+
+	for name, counter := range counters {
+		contents, err := ioutil.ReadFile(path.Join(SysClassNetPath, m.hostIface, "statistics", name))
+		if err != nil {
+			return InterfaceStat{}, err
+		}
+
+		*counter, err = strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+		if err != nil {
+			return InterfaceStat{}, err
+		}
+	}
+
+	return stat, nil
+}
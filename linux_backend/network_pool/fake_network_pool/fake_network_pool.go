@@ -1,6 +1,7 @@
 package fake_network_pool
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network"
@@ -11,6 +12,7 @@ type FakeNetworkPool struct {
 	nextNetwork net.IP
 
 	InitialPoolSize int
+	SubnetPrefix    int
 
 	AcquireError error
 	RemoveError  error
@@ -24,6 +26,8 @@ func New(ipNet *net.IPNet) *FakeNetworkPool {
 		ipNet: ipNet,
 
 		nextNetwork: ipNet.IP,
+
+		SubnetPrefix: 30,
 	}
 }
 
@@ -36,15 +40,16 @@ func (p *FakeNetworkPool) Acquire() (*network.Network, error) {
 		return nil, p.AcquireError
 	}
 
-	_, ipNet, err := net.ParseCIDR(p.nextNetwork.String() + "/30")
+	_, ipNet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", p.nextNetwork, p.SubnetPrefix))
 	if err != nil {
 		return nil, err
 	}
 
-	inc(p.nextNetwork)
-	inc(p.nextNetwork)
-	inc(p.nextNetwork)
-	inc(p.nextNetwork)
+	_, bits := ipNet.Mask.Size()
+
+	for i := 0; i < 1<<uint(bits-p.SubnetPrefix); i++ {
+		inc(p.nextNetwork)
+	}
 
 	return network.New(ipNet), nil
 }
@@ -67,6 +72,10 @@ func (p *FakeNetworkPool) Network() *net.IPNet {
 	return p.ipNet
 }
 
+func (p *FakeNetworkPool) SubnetPrefixLength() int {
+	return p.SubnetPrefix
+}
+
 func inc(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -2,9 +2,11 @@ package network_pool
 
 import (
 	"fmt"
+	"math/big"
 	"net"
-	"sync"
+	"time"
 
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/allocator"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network"
 )
 
@@ -13,15 +15,17 @@ type NetworkPool interface {
 	Release(*network.Network)
 	Remove(*network.Network) error
 	Network() *net.IPNet
+	SubnetPrefixLength() int
 	InitialSize() int
 }
 
 type RealNetworkPool struct {
-	ipNet *net.IPNet
+	ipNet        *net.IPNet
+	subnetPrefix int
 
-	pool            []*network.Network
-	poolMutex       *sync.Mutex
-	initialPoolSize int
+	// the pool's subnets are numbered from firstSubnet
+	firstSubnet net.IP
+	allocator   *allocator.Allocator
 }
 
 type PoolExhaustedError struct{}
@@ -38,62 +42,51 @@ func (e NetworkTakenError) Error() string {
 	return fmt.Sprintf("network already acquired: %s", e.Network.String())
 }
 
-func New(ipNet *net.IPNet) *RealNetworkPool {
-	pool := []*network.Network{}
+type NetworkOutOfRangeError struct {
+	Network *network.Network
+}
 
-	_, startNet, err := net.ParseCIDR(ipNet.IP.String() + "/30")
-	if err != nil {
-		panic(err)
-	}
+func (e NetworkOutOfRangeError) Error() string {
+	return fmt.Sprintf("network outside of pool range: %s", e.Network.String())
+}
+
+func New(ipNet *net.IPNet, subnetPrefix int, quarantine time.Duration) *RealNetworkPool {
+	poolPrefix, bits := ipNet.Mask.Size()
 
-	for subnet := startNet; ipNet.Contains(subnet.IP); subnet = nextSubnet(subnet) {
-		pool = append(pool, network.New(subnet))
+	size := uint32(1)
+	if subnetPrefix > poolPrefix {
+		size = 1 << uint(subnetPrefix-poolPrefix)
 	}
 
 	return &RealNetworkPool{
-		ipNet: ipNet,
+		ipNet:        ipNet,
+		subnetPrefix: subnetPrefix,
 
-		pool:            pool,
-		poolMutex:       new(sync.Mutex),
-		initialPoolSize: len(pool),
+		firstSubnet: normalizeIP(ipNet.IP.Mask(net.CIDRMask(subnetPrefix, bits))),
+		allocator:   allocator.New(size, quarantine),
 	}
 }
 
 func (p *RealNetworkPool) Acquire() (*network.Network, error) {
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	if len(p.pool) == 0 {
+	index, ok := p.allocator.Acquire()
+	if !ok {
 		return nil, PoolExhaustedError{}
 	}
 
-	acquired := p.pool[0]
-	p.pool = p.pool[1:]
-
-	return acquired, nil
+	return p.subnet(index), nil
 }
 
+// Remove takes a specific network out of the pool. The network may span
+// several of the pool's subnets, in which case all of them must be free.
 func (p *RealNetworkPool) Remove(network *network.Network) error {
-	idx := 0
-	found := false
-
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	for i, existingNetwork := range p.pool {
-		if existingNetwork.String() == network.String() {
-			idx = i
-			found = true
-			break
-		}
+	if !p.contains(network) {
+		return NetworkOutOfRangeError{network}
 	}
 
-	if !found {
+	if !p.allocator.Claim(p.indexOf(network.IP()), p.subnetCount(network)) {
 		return NetworkTakenError{network}
 	}
 
-	p.pool = append(p.pool[:idx], p.pool[idx+1:]...)
-
 	return nil
 }
 
@@ -102,41 +95,74 @@ func (p *RealNetworkPool) Release(network *network.Network) {
 		return
 	}
 
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
+	first := p.indexOf(network.IP())
 
-	p.pool = append(p.pool, network)
+	for i := uint32(0); i < p.subnetCount(network); i++ {
+		p.allocator.Release(first + i)
+	}
 }
 
 func (p *RealNetworkPool) InitialSize() int {
-	return p.initialPoolSize
+	return int(p.allocator.Size())
 }
 
 func (p *RealNetworkPool) Network() *net.IPNet {
 	return p.ipNet
 }
 
-func nextSubnet(ipNet *net.IPNet) *net.IPNet {
-	next := net.ParseIP(ipNet.IP.String())
+func (p *RealNetworkPool) SubnetPrefixLength() int {
+	return p.subnetPrefix
+}
+
+func (p *RealNetworkPool) contains(network *network.Network) bool {
+	poolPrefix, _ := p.ipNet.Mask.Size()
 
-	inc(next)
-	inc(next)
-	inc(next)
-	inc(next)
+	return p.ipNet.Contains(network.IP()) &&
+		network.PrefixLength() >= poolPrefix &&
+		network.PrefixLength() <= p.subnetPrefix
+}
 
-	_, nextNet, err := net.ParseCIDR(next.String() + "/30")
-	if err != nil {
-		panic(err)
+// subnetCount is the number of the pool's subnets a network consists of
+func (p *RealNetworkPool) subnetCount(block *network.Network) uint32 {
+	if block.PrefixLength() >= p.subnetPrefix {
+		return 1
 	}
 
-	return nextNet
+	return 1 << uint(p.subnetPrefix-block.PrefixLength())
+}
+
+// subnet returns the pool's subnet with the given index
+func (p *RealNetworkPool) subnet(index uint32) *network.Network {
+	_, bits := p.ipNet.Mask.Size()
+
+	offset := new(big.Int).Lsh(big.NewInt(int64(index)), uint(bits-p.subnetPrefix))
+	sum := new(big.Int).Add(new(big.Int).SetBytes(p.firstSubnet), offset).Bytes()
+
+	ip := make(net.IP, len(p.firstSubnet))
+	copy(ip[len(ip)-len(sum):], sum)
+
+	return network.New(&net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(p.subnetPrefix, bits),
+	})
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
+// indexOf returns the index of the pool's subnet containing ip
+func (p *RealNetworkPool) indexOf(ip net.IP) uint32 {
+	_, bits := p.ipNet.Mask.Size()
+
+	offset := new(big.Int).Sub(
+		new(big.Int).SetBytes(normalizeIP(ip)),
+		new(big.Int).SetBytes(p.firstSubnet),
+	)
+
+	return uint32(offset.Rsh(offset, uint(bits-p.subnetPrefix)).Uint64())
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
 	}
+
+	return ip.To16()
 }
@@ -2,6 +2,7 @@ package network_pool_test
 
 import (
 	"net"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -17,7 +18,7 @@ var _ = Describe("Network Pool", func() {
 		_, ipNet, err := net.ParseCIDR("10.254.0.0/22")
 		Ω(err).ShouldNot(HaveOccurred())
 
-		pool = network_pool.New(ipNet)
+		pool = network_pool.New(ipNet, 30, 0)
 	})
 
 	Describe("acquiring", func() {
@@ -64,6 +65,57 @@ var _ = Describe("Network Pool", func() {
 			Ω(err).Should(HaveOccurred())
 		})
 
+		Context("when the network spans several subnets", func() {
+			It("removes all of them from the pool", func() {
+				_, ipNet, err := net.ParseCIDR("10.254.0.0/28")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = pool.Remove(network.New(ipNet))
+				Ω(err).ShouldNot(HaveOccurred())
+
+				for i := 0; i < (256 - 4); i++ {
+					network, err := pool.Acquire()
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(ipNet.Contains(network.IP())).Should(BeFalse())
+				}
+
+				_, err = pool.Acquire()
+				Ω(err).Should(HaveOccurred())
+			})
+
+			Context("and one of them is already acquired", func() {
+				It("returns a NetworkTakenError and removes none of them", func() {
+					_, err := pool.Acquire()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, ipNet, err := net.ParseCIDR("10.254.0.0/28")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					block := network.New(ipNet)
+
+					err = pool.Remove(block)
+					Ω(err).Should(Equal(network_pool.NetworkTakenError{block}))
+
+					for i := 0; i < (256 - 1); i++ {
+						_, err := pool.Acquire()
+						Ω(err).ShouldNot(HaveOccurred())
+					}
+				})
+			})
+		})
+
+		Context("when the network is outside of the pool's range", func() {
+			It("returns a NetworkOutOfRangeError", func() {
+				_, ipNet, err := net.ParseCIDR("10.255.0.0/30")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				outOfRange := network.New(ipNet)
+
+				err = pool.Remove(outOfRange)
+				Ω(err).Should(Equal(network_pool.NetworkOutOfRangeError{outOfRange}))
+			})
+		})
+
 		Context("when the resource is already acquired", func() {
 			It("returns a PortTakenError", func() {
 				network, err := pool.Acquire()
@@ -92,12 +144,55 @@ var _ = Describe("Network Pool", func() {
 			Ω(last).Should(Equal(first))
 		})
 
+		Context("when the released network spans several subnets", func() {
+			It("places each of them back in the pool", func() {
+				_, ipNet, err := net.ParseCIDR("10.254.0.0/28")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				block := network.New(ipNet)
+
+				err = pool.Remove(block)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				pool.Release(block)
+
+				for i := 0; i < 256; i++ {
+					_, err := pool.Acquire()
+					Ω(err).ShouldNot(HaveOccurred())
+				}
+			})
+		})
+
+		Context("with a quarantine period", func() {
+			BeforeEach(func() {
+				_, ipNet, err := net.ParseCIDR("10.254.0.0/30")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				pool = network_pool.New(ipNet, 30, 100*time.Millisecond)
+			})
+
+			It("does not hand the network out again until it has passed", func() {
+				network, err := pool.Acquire()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				pool.Release(network)
+
+				_, err = pool.Acquire()
+				Ω(err).Should(Equal(network_pool.PoolExhaustedError{}))
+
+				Eventually(func() error {
+					_, err := pool.Acquire()
+					return err
+				}).ShouldNot(HaveOccurred())
+			})
+		})
+
 		Context("when the released network is out of the range", func() {
 			It("does not add it to the pool", func() {
 				_, smallIPNet, err := net.ParseCIDR("10.255.0.0/32")
 				Ω(err).ShouldNot(HaveOccurred())
 
-				kiddiePool := network_pool.New(smallIPNet)
+				kiddiePool := network_pool.New(smallIPNet, 30, 0)
 
 				_, err = kiddiePool.Acquire()
 				Ω(err).ShouldNot(HaveOccurred())
@@ -116,6 +211,54 @@ var _ = Describe("Network Pool", func() {
 		})
 	})
 
+	Context("when constructed with a larger subnet size", func() {
+		BeforeEach(func() {
+			_, ipNet, err := net.ParseCIDR("10.254.0.0/22")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			pool = network_pool.New(ipNet, 28, 0)
+		})
+
+		It("carves the pool into subnets of that size", func() {
+			network1, err := pool.Acquire()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(network1.String()).Should(Equal("10.254.0.0/28"))
+			Ω(network1.HostIP().String()).Should(Equal("10.254.0.1"))
+			Ω(network1.ContainerIP().String()).Should(Equal("10.254.0.2"))
+			Ω(network1.LastUsableIP().String()).Should(Equal("10.254.0.14"))
+
+			network2, err := pool.Acquire()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(network2.String()).Should(Equal("10.254.0.16/28"))
+
+			Ω(pool.InitialSize()).Should(Equal(64))
+			Ω(pool.SubnetPrefixLength()).Should(Equal(28))
+		})
+	})
+
+	Context("when constructed with an IPv6 network", func() {
+		BeforeEach(func() {
+			_, ipNet, err := net.ParseCIDR("fd00:10:254::/120")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			pool = network_pool.New(ipNet, 126, 0)
+		})
+
+		It("carves the pool into IPv6 subnets", func() {
+			network1, err := pool.Acquire()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(network1.String()).Should(Equal("fd00:10:254::/126"))
+			Ω(network1.HostIP().String()).Should(Equal("fd00:10:254::1"))
+			Ω(network1.ContainerIP().String()).Should(Equal("fd00:10:254::2"))
+
+			network2, err := pool.Acquire()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(network2.String()).Should(Equal("fd00:10:254::4/126"))
+
+			Ω(pool.InitialSize()).Should(Equal(64))
+		})
+	})
+
 	Describe("InitialSize", func() {
 		It("returns the count of maximum available networks", func() {
 			Ω(pool.InitialSize()).Should(Equal(256))
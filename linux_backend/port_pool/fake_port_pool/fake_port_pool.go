@@ -28,6 +28,17 @@ func (p *FakePortPool) Acquire() (uint32, error) {
 	return port, nil
 }
 
+func (p *FakePortPool) AcquireRange(count uint32) (uint32, error) {
+	if p.AcquireError != nil {
+		return 0, p.AcquireError
+	}
+
+	port := p.nextPort
+	p.nextPort += count
+
+	return port, nil
+}
+
 func (p *FakePortPool) Remove(port uint32) error {
 	if p.RemoveError != nil {
 		return p.RemoveError
@@ -0,0 +1,127 @@
+package port_pool
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// where the kernel exposes the range it picks ephemeral ports from
+var LocalPortRangePath = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// where the kernel lists sockets, with their local ports
+var SocketTablePaths = []string{
+	"/proc/net/tcp",
+	"/proc/net/tcp6",
+	"/proc/net/udp",
+	"/proc/net/udp6",
+}
+
+// EphemeralRange returns the first and last ports of the kernel's ephemeral
+// port range.
+func EphemeralRange() (uint32, uint32, error) {
+	contents, err := ioutil.ReadFile(LocalPortRangePath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(string(contents))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("malformed local port range: %q", string(contents))
+	}
+
+	first, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	last, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint32(first), uint32(last), nil
+}
+
+// Overlaps is whether size ports from start overlap first through last.
+func Overlaps(start, size, first, last uint32) bool {
+	return size > 0 && start <= last && start+size-1 >= first
+}
+
+// DefaultStart picks the start of a pool of size ports outside first through
+// last: just above them, or if they reach 65535, just below them, keeping
+// clear of the privileged ports. It returns false if neither fits.
+func DefaultStart(size, first, last uint32) (uint32, bool) {
+	if last < 65535 {
+		return last + 1, true
+	}
+
+	if first >= 1024+size {
+		return first - size, true
+	}
+
+	return 0, false
+}
+
+// BoundPorts returns the local ports of the host's sockets, e.g. listening
+// servers. Socket tables that do not exist, e.g. without IPv6, are skipped.
+func BoundPorts() (map[uint32]bool, error) {
+	ports := map[uint32]bool{}
+
+	for _, tablePath := range SocketTablePaths {
+		table, err := os.Open(tablePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		err = readSocketTable(table, ports)
+		table.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ports, nil
+}
+
+// readSocketTable reads lines like
+//
+//	sl  local_address rem_address   st ...
+//	 0: 0100007F:1F90 00000000:0000 0A ...
+//
+// where the local port is the hex after the colon
+func readSocketTable(table *os.File, ports map[uint32]bool) error {
+	scanner := bufio.NewScanner(table)
+
+	// skip the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		colon := strings.LastIndex(fields[1], ":")
+		if colon == -1 {
+			continue
+		}
+
+		port, err := strconv.ParseUint(fields[1][colon+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+
+		ports[uint32(port)] = true
+	}
+
+	return scanner.Err()
+}
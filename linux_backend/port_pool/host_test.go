@@ -0,0 +1,139 @@
+package port_pool_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/port_pool"
+)
+
+var _ = Describe("The host's ports", func() {
+	var procDir string
+
+	var originalLocalPortRangePath string
+	var originalSocketTablePaths []string
+
+	BeforeEach(func() {
+		var err error
+
+		procDir, err = ioutil.TempDir("", "proc")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		originalLocalPortRangePath = port_pool.LocalPortRangePath
+		originalSocketTablePaths = port_pool.SocketTablePaths
+
+		port_pool.LocalPortRangePath = path.Join(procDir, "ip_local_port_range")
+		port_pool.SocketTablePaths = []string{
+			path.Join(procDir, "tcp"),
+			path.Join(procDir, "tcp6"),
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(procDir)
+
+		port_pool.LocalPortRangePath = originalLocalPortRangePath
+		port_pool.SocketTablePaths = originalSocketTablePaths
+	})
+
+	Describe("the ephemeral range", func() {
+		It("is read from the kernel", func() {
+			err := ioutil.WriteFile(port_pool.LocalPortRangePath, []byte("32768\t60999\n"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			first, last, err := port_pool.EphemeralRange()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(first).Should(Equal(uint32(32768)))
+			Ω(last).Should(Equal(uint32(60999)))
+		})
+
+		Context("when it is malformed", func() {
+			It("returns an error", func() {
+				err := ioutil.WriteFile(port_pool.LocalPortRangePath, []byte("32768\n"), 0644)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, _, err = port_pool.EphemeralRange()
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+
+		Context("when it cannot be read", func() {
+			It("returns an error", func() {
+				_, _, err := port_pool.EphemeralRange()
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("overlapping", func() {
+		It("is whether any of the ports are in the range", func() {
+			Ω(port_pool.Overlaps(61000, 5000, 32768, 60999)).Should(BeFalse())
+			Ω(port_pool.Overlaps(60999, 5000, 32768, 60999)).Should(BeTrue())
+			Ω(port_pool.Overlaps(30000, 2768, 32768, 60999)).Should(BeFalse())
+			Ω(port_pool.Overlaps(30000, 2769, 32768, 60999)).Should(BeTrue())
+			Ω(port_pool.Overlaps(40000, 0, 32768, 60999)).Should(BeFalse())
+		})
+	})
+
+	Describe("the default start", func() {
+		It("is just above the range", func() {
+			start, ok := port_pool.DefaultStart(5000, 32768, 60999)
+			Ω(ok).Should(BeTrue())
+			Ω(start).Should(Equal(uint32(61000)))
+		})
+
+		Context("when the range ends at 65535", func() {
+			It("is just below the range", func() {
+				start, ok := port_pool.DefaultStart(5000, 32768, 65535)
+				Ω(ok).Should(BeTrue())
+				Ω(start).Should(Equal(uint32(27768)))
+			})
+
+			Context("and there is no room below it", func() {
+				It("is not found", func() {
+					_, ok := port_pool.DefaultStart(5000, 1024, 65535)
+					Ω(ok).Should(BeFalse())
+				})
+			})
+		})
+	})
+
+	Describe("bound ports", func() {
+		It("are the local ports of the host's sockets", func() {
+			err := ioutil.WriteFile(path.Join(procDir, "tcp"), []byte(
+				"  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"+
+					"   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0\n"+
+					"   1: 00000000:EE49 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 100 0 0 10 0\n",
+			), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = ioutil.WriteFile(path.Join(procDir, "tcp6"), []byte(
+				"  sl  local_address                         remote_address                        st\n"+
+					"   0: 00000000000000000000000000000000:0016 00000000000000000000000000000000:0000 0A\n",
+			), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			ports, err := port_pool.BoundPorts()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(ports).Should(Equal(map[uint32]bool{
+				8080:  true,
+				61001: true,
+				22:    true,
+			}))
+		})
+
+		Context("when a socket table does not exist", func() {
+			It("skips it", func() {
+				ports, err := port_pool.BoundPorts()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(ports).Should(BeEmpty())
+			})
+		})
+	})
+})
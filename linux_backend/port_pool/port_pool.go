@@ -2,15 +2,16 @@ package port_pool
 
 import (
 	"fmt"
-	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/allocator"
 )
 
 type PortPool struct {
 	start uint32
 	size  uint32
 
-	pool      []uint32
-	poolMutex sync.Mutex
+	allocator *allocator.Allocator
 }
 
 type PoolExhaustedError struct{}
@@ -27,57 +28,40 @@ func (e PortTakenError) Error() string {
 	return fmt.Sprintf("port already acquired: %d", e.Port)
 }
 
-func New(start, size uint32) *PortPool {
-	pool := []uint32{}
-
-	for i := start; i < start+size; i++ {
-		pool = append(pool, i)
-	}
-
+func New(start, size uint32, quarantine time.Duration) *PortPool {
 	return &PortPool{
 		start: start,
 		size:  size,
 
-		pool: pool,
+		allocator: allocator.New(size, quarantine),
 	}
 }
 
 func (p *PortPool) Acquire() (uint32, error) {
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	if len(p.pool) == 0 {
+	offset, ok := p.allocator.Acquire()
+	if !ok {
 		return 0, PoolExhaustedError{}
 	}
 
-	port := p.pool[0]
+	return p.start + offset, nil
+}
 
-	p.pool = p.pool[1:]
+// AcquireRange acquires count consecutive ports, returning the first. Either
+// all of them are acquired or none are.
+func (p *PortPool) AcquireRange(count uint32) (uint32, error) {
+	offset, ok := p.allocator.AcquireRun(count)
+	if !ok {
+		return 0, PoolExhaustedError{}
+	}
 
-	return port, nil
+	return p.start + offset, nil
 }
 
 func (p *PortPool) Remove(port uint32) error {
-	idx := 0
-	found := false
-
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	for i, existingPort := range p.pool {
-		if existingPort == port {
-			idx = i
-			found = true
-			break
-		}
-	}
-
-	if !found {
+	if port < p.start || port >= p.start+p.size || !p.allocator.Claim(port-p.start, 1) {
 		return PortTakenError{port}
 	}
 
-	p.pool = append(p.pool[:idx], p.pool[idx+1:]...)
-
 	return nil
 }
 
@@ -86,14 +70,5 @@ func (p *PortPool) Release(port uint32) {
 		return
 	}
 
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	for _, existingPort := range p.pool {
-		if existingPort == port {
-			return
-		}
-	}
-
-	p.pool = append(p.pool, port)
+	p.allocator.Release(port - p.start)
 }
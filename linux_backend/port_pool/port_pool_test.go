@@ -1,6 +1,8 @@
 package port_pool_test
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -10,7 +12,7 @@ import (
 var _ = Describe("Port pool", func() {
 	Describe("acquiring", func() {
 		It("returns the next available port from the pool", func() {
-			pool := port_pool.New(10000, 5)
+			pool := port_pool.New(10000, 5, 0)
 
 			port1, err := pool.Acquire()
 			Ω(err).ShouldNot(HaveOccurred())
@@ -24,7 +26,7 @@ var _ = Describe("Port pool", func() {
 
 		Context("when the pool is exhausted", func() {
 			It("returns an error", func() {
-				pool := port_pool.New(10000, 5)
+				pool := port_pool.New(10000, 5, 0)
 
 				for i := 0; i < 5; i++ {
 					_, err := pool.Acquire()
@@ -37,9 +39,56 @@ var _ = Describe("Port pool", func() {
 		})
 	})
 
+	Describe("acquiring a range", func() {
+		It("returns the first of the lowest run of available ports", func() {
+			pool := port_pool.New(10000, 10, 0)
+
+			err := pool.Remove(10002)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			first, err := pool.AcquireRange(3)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(first).Should(Equal(uint32(10003)))
+
+			port, err := pool.Acquire()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(port).Should(Equal(uint32(10000)))
+
+			for _, taken := range []uint32{10003, 10004, 10005} {
+				err := pool.Remove(taken)
+				Ω(err).Should(Equal(port_pool.PortTakenError{taken}))
+			}
+		})
+
+		Context("when no run is long enough", func() {
+			It("returns an error and acquires nothing", func() {
+				pool := port_pool.New(10000, 5, 0)
+
+				err := pool.Remove(10002)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, err = pool.AcquireRange(3)
+				Ω(err).Should(Equal(port_pool.PoolExhaustedError{}))
+
+				first, err := pool.AcquireRange(2)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(first).Should(Equal(uint32(10000)))
+			})
+		})
+
+		Context("when the count is zero", func() {
+			It("returns an error", func() {
+				pool := port_pool.New(10000, 5, 0)
+
+				_, err := pool.AcquireRange(0)
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+	})
+
 	Describe("removing", func() {
 		It("acquires a specific port from the pool", func() {
-			pool := port_pool.New(10000, 2)
+			pool := port_pool.New(10000, 2, 0)
 
 			err := pool.Remove(10000)
 			Ω(err).ShouldNot(HaveOccurred())
@@ -54,7 +103,7 @@ var _ = Describe("Port pool", func() {
 
 		Context("when the resource is already acquired", func() {
 			It("returns a PortTakenError", func() {
-				pool := port_pool.New(10000, 2)
+				pool := port_pool.New(10000, 2, 0)
 
 				port, err := pool.Acquire()
 				Ω(err).ShouldNot(HaveOccurred())
@@ -67,7 +116,7 @@ var _ = Describe("Port pool", func() {
 
 	Describe("releasing", func() {
 		It("places a port back at the end of the pool", func() {
-			pool := port_pool.New(10000, 2)
+			pool := port_pool.New(10000, 2, 0)
 
 			port1, err := pool.Acquire()
 			Ω(err).ShouldNot(HaveOccurred())
@@ -86,7 +135,7 @@ var _ = Describe("Port pool", func() {
 
 		Context("when the released port is out of the range", func() {
 			It("does not add it to the pool", func() {
-				pool := port_pool.New(10000, 0)
+				pool := port_pool.New(10000, 0, 0)
 
 				pool.Release(20000)
 
@@ -95,9 +144,31 @@ var _ = Describe("Port pool", func() {
 			})
 		})
 
+		Context("with a quarantine period", func() {
+			It("does not hand the port out again until it has passed", func() {
+				pool := port_pool.New(10000, 1, 100*time.Millisecond)
+
+				port, err := pool.Acquire()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				pool.Release(port)
+
+				_, err = pool.Acquire()
+				Ω(err).Should(Equal(port_pool.PoolExhaustedError{}))
+
+				err = pool.Remove(port)
+				Ω(err).Should(Equal(port_pool.PortTakenError{port}))
+
+				Eventually(func() error {
+					_, err := pool.Acquire()
+					return err
+				}).ShouldNot(HaveOccurred())
+			})
+		})
+
 		Context("when the released port is already released", func() {
 			It("does not duplicate it", func() {
-				pool := port_pool.New(10000, 2)
+				pool := port_pool.New(10000, 2, 0)
 
 				port1, err := pool.Acquire()
 				Ω(err).ShouldNot(HaveOccurred())
@@ -6,6 +6,7 @@ import (
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker"
 
 	"sync"
+	"syscall"
 )
 
 type FakeLinuxProcess struct {
@@ -30,6 +31,14 @@ type FakeLinuxProcess struct {
 	setTTYReturns struct {
 		result1 error
 	}
+	SignalStub        func(syscall.Signal) error
+	signalMutex       sync.RWMutex
+	signalArgsForCall []struct {
+		arg1 syscall.Signal
+	}
+	signalReturns struct {
+		result1 error
+	}
 	WithTTYStub        func() bool
 	withTTYMutex       sync.RWMutex
 	withTTYArgsForCall []struct{}
@@ -119,6 +128,38 @@ func (fake *FakeLinuxProcess) SetTTYReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeLinuxProcess) Signal(arg1 syscall.Signal) error {
+	fake.signalMutex.Lock()
+	defer fake.signalMutex.Unlock()
+	fake.signalArgsForCall = append(fake.signalArgsForCall, struct {
+		arg1 syscall.Signal
+	}{arg1})
+	if fake.SignalStub != nil {
+		return fake.SignalStub(arg1)
+	} else {
+		return fake.signalReturns.result1
+	}
+}
+
+func (fake *FakeLinuxProcess) SignalCallCount() int {
+	fake.signalMutex.RLock()
+	defer fake.signalMutex.RUnlock()
+	return len(fake.signalArgsForCall)
+}
+
+func (fake *FakeLinuxProcess) SignalArgsForCall(i int) syscall.Signal {
+	fake.signalMutex.RLock()
+	defer fake.signalMutex.RUnlock()
+	return fake.signalArgsForCall[i].arg1
+}
+
+func (fake *FakeLinuxProcess) SignalReturns(result1 error) {
+	fake.SignalStub = nil
+	fake.signalReturns = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeLinuxProcess) WithTTY() bool {
 	fake.withTTYMutex.Lock()
 	defer fake.withTTYMutex.Unlock()
@@ -4,6 +4,7 @@ package fake_process_tracker
 import (
 	"os/exec"
 	"sync"
+	"syscall"
 	"github.com/cloudfoundry-incubator/garden/warden"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker"
 )
@@ -30,12 +31,42 @@ type FakeProcessTracker struct {
 		result1 process_tracker.LinuxProcess
 		result2 error
 	}
+	AttachFromStub        func(uint32, warden.ProcessIO, process_tracker.OutputOffsets) (process_tracker.LinuxProcess, error)
+	attachFromMutex       sync.RWMutex
+	attachFromArgsForCall []struct {
+		arg1 uint32
+		arg2 warden.ProcessIO
+		arg3 process_tracker.OutputOffsets
+	}
+	attachFromReturns struct {
+		result1 process_tracker.LinuxProcess
+		result2 error
+	}
 	RestoreStub        func(processID uint32, tty bool)
 	restoreMutex       sync.RWMutex
 	restoreArgsForCall []struct {
 		processID uint32
 		tty       bool
 	}
+	SignalStub        func(processID uint32, signal syscall.Signal) error
+	signalMutex       sync.RWMutex
+	signalArgsForCall []struct {
+		processID uint32
+		signal    syscall.Signal
+	}
+	signalReturns struct {
+		result1 error
+	}
+	ReadLogsStub        func(processID uint32, tail int) ([]process_tracker.LogChunk, error)
+	readLogsMutex       sync.RWMutex
+	readLogsArgsForCall []struct {
+		processID uint32
+		tail      int
+	}
+	readLogsReturns struct {
+		result1 []process_tracker.LogChunk
+		result2 error
+	}
 	ActiveProcessesStub        func() []process_tracker.LinuxProcess
 	activeProcessesMutex       sync.RWMutex
 	activeProcessesArgsForCall []struct{}
@@ -116,6 +147,41 @@ func (fake *FakeProcessTracker) AttachReturns(result1 process_tracker.LinuxProce
 	}{result1, result2}
 }
 
+func (fake *FakeProcessTracker) AttachFrom(arg1 uint32, arg2 warden.ProcessIO, arg3 process_tracker.OutputOffsets) (process_tracker.LinuxProcess, error) {
+	fake.attachFromMutex.Lock()
+	defer fake.attachFromMutex.Unlock()
+	fake.attachFromArgsForCall = append(fake.attachFromArgsForCall, struct {
+		arg1 uint32
+		arg2 warden.ProcessIO
+		arg3 process_tracker.OutputOffsets
+	}{arg1, arg2, arg3})
+	if fake.AttachFromStub != nil {
+		return fake.AttachFromStub(arg1, arg2, arg3)
+	} else {
+		return fake.attachFromReturns.result1, fake.attachFromReturns.result2
+	}
+}
+
+func (fake *FakeProcessTracker) AttachFromCallCount() int {
+	fake.attachFromMutex.RLock()
+	defer fake.attachFromMutex.RUnlock()
+	return len(fake.attachFromArgsForCall)
+}
+
+func (fake *FakeProcessTracker) AttachFromArgsForCall(i int) (uint32, warden.ProcessIO, process_tracker.OutputOffsets) {
+	fake.attachFromMutex.RLock()
+	defer fake.attachFromMutex.RUnlock()
+	return fake.attachFromArgsForCall[i].arg1, fake.attachFromArgsForCall[i].arg2, fake.attachFromArgsForCall[i].arg3
+}
+
+func (fake *FakeProcessTracker) AttachFromReturns(result1 process_tracker.LinuxProcess, result2 error) {
+	fake.AttachFromStub = nil
+	fake.attachFromReturns = struct {
+		result1 process_tracker.LinuxProcess
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeProcessTracker) Restore(processID uint32, tty bool) {
 	fake.restoreMutex.Lock()
 	defer fake.restoreMutex.Unlock()
@@ -140,6 +206,73 @@ func (fake *FakeProcessTracker) RestoreArgsForCall(i int) (uint32, bool) {
 	return fake.restoreArgsForCall[i].processID, fake.restoreArgsForCall[i].tty
 }
 
+func (fake *FakeProcessTracker) Signal(processID uint32, signal syscall.Signal) error {
+	fake.signalMutex.Lock()
+	defer fake.signalMutex.Unlock()
+	fake.signalArgsForCall = append(fake.signalArgsForCall, struct {
+		processID uint32
+		signal    syscall.Signal
+	}{processID, signal})
+	if fake.SignalStub != nil {
+		return fake.SignalStub(processID, signal)
+	} else {
+		return fake.signalReturns.result1
+	}
+}
+
+func (fake *FakeProcessTracker) SignalCallCount() int {
+	fake.signalMutex.RLock()
+	defer fake.signalMutex.RUnlock()
+	return len(fake.signalArgsForCall)
+}
+
+func (fake *FakeProcessTracker) SignalArgsForCall(i int) (uint32, syscall.Signal) {
+	fake.signalMutex.RLock()
+	defer fake.signalMutex.RUnlock()
+	return fake.signalArgsForCall[i].processID, fake.signalArgsForCall[i].signal
+}
+
+func (fake *FakeProcessTracker) SignalReturns(result1 error) {
+	fake.SignalStub = nil
+	fake.signalReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeProcessTracker) ReadLogs(processID uint32, tail int) ([]process_tracker.LogChunk, error) {
+	fake.readLogsMutex.Lock()
+	defer fake.readLogsMutex.Unlock()
+	fake.readLogsArgsForCall = append(fake.readLogsArgsForCall, struct {
+		processID uint32
+		tail      int
+	}{processID, tail})
+	if fake.ReadLogsStub != nil {
+		return fake.ReadLogsStub(processID, tail)
+	} else {
+		return fake.readLogsReturns.result1, fake.readLogsReturns.result2
+	}
+}
+
+func (fake *FakeProcessTracker) ReadLogsCallCount() int {
+	fake.readLogsMutex.RLock()
+	defer fake.readLogsMutex.RUnlock()
+	return len(fake.readLogsArgsForCall)
+}
+
+func (fake *FakeProcessTracker) ReadLogsArgsForCall(i int) (uint32, int) {
+	fake.readLogsMutex.RLock()
+	defer fake.readLogsMutex.RUnlock()
+	return fake.readLogsArgsForCall[i].processID, fake.readLogsArgsForCall[i].tail
+}
+
+func (fake *FakeProcessTracker) ReadLogsReturns(result1 []process_tracker.LogChunk, result2 error) {
+	fake.ReadLogsStub = nil
+	fake.readLogsReturns = struct {
+		result1 []process_tracker.LogChunk
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeProcessTracker) ActiveProcesses() []process_tracker.LinuxProcess {
 	fake.activeProcessesMutex.Lock()
 	defer fake.activeProcessesMutex.Unlock()
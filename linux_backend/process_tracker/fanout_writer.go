@@ -10,6 +10,14 @@ type fanoutWriter struct {
 	sinks  []io.Writer
 	closed bool
 	sinksL sync.Mutex
+
+	scrollback *scrollback
+}
+
+func newFanoutWriter(scrollbackSize int) *fanoutWriter {
+	return &fanoutWriter{
+		scrollback: newScrollback(scrollbackSize),
+	}
 }
 
 func (w *fanoutWriter) Write(data []byte) (int, error) {
@@ -25,15 +33,24 @@ func (w *fanoutWriter) Write(data []byte) (int, error) {
 		s.Write(data)
 	}
 
+	w.scrollback.Write(data)
+
 	w.sinksL.Unlock()
 
 	return len(data), nil
 }
 
-func (w *fanoutWriter) AddSink(sink io.Writer) {
+// AddSink replays the scrollback from the given offset into the stream to the
+// sink, which then receives everything written after.
+func (w *fanoutWriter) AddSink(sink io.Writer, offset uint64) {
 	w.sinksL.Lock()
 
 	if !w.closed {
+		replay := w.scrollback.From(offset)
+		if len(replay) > 0 {
+			sink.Write(replay)
+		}
+
 		w.sinks = append(w.sinks, sink)
 	}
 
@@ -0,0 +1,145 @@
+package process_tracker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogChunk is a piece of a process's output, as recorded in its log by
+// iodaemon.
+type LogChunk struct {
+	Time time.Time
+
+	// "stdout" or "stderr"
+	Source string
+
+	Data []byte
+}
+
+type NoLogsError struct {
+	ProcessID uint32
+}
+
+func (e NoLogsError) Error() string {
+	return fmt.Sprintf("no logs for process: %d", e.ProcessID)
+}
+
+// ReadLogs returns the process's logged output, oldest first, including that
+// in rotated logs. If tail is positive, only the last tail chunks are
+// returned.
+//
+// Logs are kept after the process exits, so the process need not be tracked.
+// They are replaced once its ID is reused, e.g. after the server restarts.
+func (t *processTracker) ReadLogs(processID uint32, tail int) ([]LogChunk, error) {
+	logPath := path.Join(t.containerPath, "processes", fmt.Sprintf("%d.log", processID))
+
+	paths, err := rotatedLogs(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	paths = append(paths, logPath)
+
+	chunks := []LogChunk{}
+	found := false
+
+	for _, logFile := range paths {
+		file, err := os.Open(logFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// rotated away, or not yet written
+				continue
+			}
+
+			return nil, err
+		}
+
+		found = true
+
+		chunks, err = readLog(file, chunks, tail)
+
+		file.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, NoLogsError{processID}
+	}
+
+	if tail > 0 && len(chunks) > tail {
+		chunks = chunks[len(chunks)-tail:]
+	}
+
+	return chunks, nil
+}
+
+// rotatedLogs finds the rotated logs, e.g. 1.log.2 and 1.log.1, oldest first
+func rotatedLogs(logPath string) ([]string, error) {
+	matches, err := filepath.Glob(logPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	rotations := []int{}
+
+	for _, match := range matches {
+		rotation, err := strconv.Atoi(strings.TrimPrefix(match, logPath+"."))
+		if err != nil {
+			continue
+		}
+
+		rotations = append(rotations, rotation)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(rotations)))
+
+	paths := make([]string, len(rotations))
+	for i, rotation := range rotations {
+		paths[i] = fmt.Sprintf("%s.%d", logPath, rotation)
+	}
+
+	return paths, nil
+}
+
+// readLog appends the log's chunks, keeping no more than about twice tail
+// in memory. An incomplete entry at the end, e.g. from iodaemon being killed
+// mid-write, is ignored.
+func readLog(file *os.File, chunks []LogChunk, tail int) ([]LogChunk, error) {
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return chunks, nil
+		}
+
+		if err != nil {
+			return chunks, err
+		}
+
+		var chunk LogChunk
+
+		err = json.Unmarshal(line, &chunk)
+		if err != nil {
+			continue
+		}
+
+		chunks = append(chunks, chunk)
+
+		if tail > 0 && len(chunks) >= 2*tail {
+			chunks = append([]LogChunk{}, chunks[len(chunks)-tail:]...)
+		}
+	}
+}
@@ -23,11 +23,15 @@ type Process struct {
 
 	containerPath string
 	runner        command_runner.CommandRunner
+	config        Config
 
 	waitingLinks *sync.Mutex
 	runningLink  *sync.Once
 	link         *exec.Cmd
 
+	signals      *os.File
+	signalsMutex *sync.Mutex
+
 	linked   chan struct{}
 	unlinked <-chan struct{}
 
@@ -48,6 +52,7 @@ func NewProcess(
 	withTty bool,
 	containerPath string,
 	runner command_runner.CommandRunner,
+	config Config,
 ) *Process {
 	unlinked := make(chan struct{}, 1)
 	unlinked <- struct{}{}
@@ -58,17 +63,20 @@ func NewProcess(
 
 		containerPath: containerPath,
 		runner:        runner,
+		config:        config,
 
 		waitingLinks: &sync.Mutex{},
 		runningLink:  &sync.Once{},
 		linked:       make(chan struct{}),
 		unlinked:     unlinked,
 
+		signalsMutex: &sync.Mutex{},
+
 		doneL: sync.NewCond(&sync.Mutex{}),
 
 		stdin:  &faninWriter{hasSink: make(chan struct{})},
-		stdout: &fanoutWriter{},
-		stderr: &fanoutWriter{},
+		stdout: newFanoutWriter(config.ScrollbackSize),
+		stderr: newFanoutWriter(config.ScrollbackSize),
 	}
 }
 
@@ -105,6 +113,22 @@ func (p *Process) SetTTY(tty warden.TTYSpec) error {
 	return p.link.Process.Signal(syscall.SIGWINCH)
 }
 
+// Signal sends the signal to the process via the link, which relays it to
+// iodaemon.
+func (p *Process) Signal(signal syscall.Signal) error {
+	<-p.linked
+
+	p.signalsMutex.Lock()
+	defer p.signalsMutex.Unlock()
+
+	if p.signals == nil {
+		return errors.New("process is no longer linked")
+	}
+
+	_, err := fmt.Fprintf(p.signals, "%d\n", signal)
+	return err
+}
+
 func (p *Process) WithTTY() bool {
 	return p.withTty
 }
@@ -135,6 +159,14 @@ func (p *Process) Spawn(cmd *exec.Cmd, tty *warden.TTYSpec) (ready, active chan
 		}
 	}
 
+	if p.config.LogSize > 0 {
+		bashFlags = append(
+			bashFlags,
+			fmt.Sprintf("-logSize=%d", p.config.LogSize),
+			fmt.Sprintf("-logFiles=%d", p.config.LogFiles),
+		)
+	}
+
 	bashFlags = append(bashFlags, "spawn", processSock, cmd.Path)
 
 	spawn := &exec.Cmd{
@@ -200,17 +232,19 @@ func (p *Process) Unlink() error {
 	return p.runner.Signal(p.link, os.Interrupt)
 }
 
-func (p *Process) Attach(processIO warden.ProcessIO) {
+// Attach streams the process's input and output to and from processIO. Output
+// still held in the scrollback is replayed first, starting from the offsets.
+func (p *Process) Attach(processIO warden.ProcessIO, offsets OutputOffsets) {
 	if processIO.Stdin != nil {
 		p.stdin.AddSource(processIO.Stdin)
 	}
 
 	if processIO.Stdout != nil {
-		p.stdout.AddSink(processIO.Stdout)
+		p.stdout.AddSink(processIO.Stdout, offsets.Stdout)
 	}
 
 	if processIO.Stderr != nil {
-		p.stderr.AddSink(processIO.Stderr)
+		p.stderr.AddSink(processIO.Stderr, offsets.Stderr)
 	}
 }
 
@@ -246,33 +280,51 @@ func (p *Process) runLinker() {
 		}
 	}
 
+	signalsR, signalsW, err := os.Pipe()
+	if err != nil {
+		p.completed(-1, err)
+		return
+	}
+
 	p.stdin.AddSink(inW)
 
 	p.link = &exec.Cmd{
 		Path: linkPath,
 		Args: []string{
 			fmt.Sprintf("-tty=%v", p.withTty),
+			"-signals",
 			"link",
 			processSock,
 		},
-		Stdin:  inR,
-		Stdout: p.stdout,
-		Stderr: p.stderr,
+		Stdin:      inR,
+		Stdout:     p.stdout,
+		Stderr:     p.stderr,
+		ExtraFiles: []*os.File{signalsR},
 	}
 
 	err = p.runner.Start(p.link)
 	if err != nil {
+		signalsR.Close()
+		signalsW.Close()
 		p.completed(-1, err)
 		return
 	}
 
-	// close our copy of the process's end of the pipe now that it's spawned
+	// close our copy of the process's end of the pipes now that it's spawned
 	inR.Close()
+	signalsR.Close()
+
+	p.signals = signalsW
 
 	close(p.linked)
 
 	p.runner.Wait(p.link)
 
+	p.signalsMutex.Lock()
+	p.signals.Close()
+	p.signals = nil
+	p.signalsMutex.Unlock()
+
 	// if the process is explicitly .Unlinked, block forever; the fact that
 	// iomux-link exited should not bubble up to the caller as the linked
 	// process didn't actually exit.
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os/exec"
 	"sync"
+	"syscall"
 
 	"github.com/cloudfoundry-incubator/garden/warden"
 	"github.com/cloudfoundry/gunk/command_runner"
@@ -12,19 +13,45 @@ import (
 type ProcessTracker interface {
 	Run(*exec.Cmd, warden.ProcessIO, *warden.TTYSpec) (LinuxProcess, error)
 	Attach(uint32, warden.ProcessIO) (LinuxProcess, error)
+	AttachFrom(uint32, warden.ProcessIO, OutputOffsets) (LinuxProcess, error)
 	Restore(processID uint32, tty bool)
+	Signal(processID uint32, signal syscall.Signal) error
+	ReadLogs(processID uint32, tail int) ([]LogChunk, error)
 	ActiveProcesses() []LinuxProcess
 	UnlinkAll()
 }
 
 type LinuxProcess interface {
 	warden.Process
+	Signal(syscall.Signal) error
 	WithTTY() bool
 }
 
+// Config configures how each tracked process's output is handled.
+type Config struct {
+	// bytes of each of stdout and stderr kept for replaying to clients that
+	// attach later
+	ScrollbackSize int
+
+	// size at which each process's output log is rotated, or 0 for output
+	// not to be logged
+	LogSize int64
+
+	// number of rotated logs kept for each process
+	LogFiles int
+}
+
+// OutputOffsets are byte offsets into a process's stdout and stderr from
+// which to replay output when attaching.
+type OutputOffsets struct {
+	Stdout uint64
+	Stderr uint64
+}
+
 type processTracker struct {
 	containerPath string
 	runner        command_runner.CommandRunner
+	config        Config
 
 	processes      map[uint32]*Process
 	nextProcessID  uint32
@@ -39,10 +66,11 @@ func (e UnknownProcessError) Error() string {
 	return fmt.Sprintf("unknown process: %d", e.ProcessID)
 }
 
-func New(containerPath string, runner command_runner.CommandRunner) ProcessTracker {
+func New(containerPath string, runner command_runner.CommandRunner, config Config) ProcessTracker {
 	return &processTracker{
 		containerPath: containerPath,
 		runner:        runner,
+		config:        config,
 
 		processes:      make(map[uint32]*Process),
 		processesMutex: new(sync.RWMutex),
@@ -57,7 +85,7 @@ func (t *processTracker) Run(cmd *exec.Cmd, processIO warden.ProcessIO, tty *war
 	processID := t.nextProcessID
 	t.nextProcessID++
 
-	process := NewProcess(processID, tty != nil, t.containerPath, t.runner)
+	process := NewProcess(processID, tty != nil, t.containerPath, t.runner, t.config)
 
 	t.processes[processID] = process
 
@@ -70,7 +98,7 @@ func (t *processTracker) Run(cmd *exec.Cmd, processIO warden.ProcessIO, tty *war
 		return nil, err
 	}
 
-	process.Attach(processIO)
+	process.Attach(processIO, OutputOffsets{})
 
 	go t.link(processID)
 
@@ -82,7 +110,15 @@ func (t *processTracker) Run(cmd *exec.Cmd, processIO warden.ProcessIO, tty *war
 	return process, nil
 }
 
+// Attach attaches to the process, replaying all of its output still held in
+// the scrollback.
 func (t *processTracker) Attach(processID uint32, processIO warden.ProcessIO) (LinuxProcess, error) {
+	return t.AttachFrom(processID, processIO, OutputOffsets{})
+}
+
+// AttachFrom attaches to the process, replaying its output from the offsets,
+// e.g. the number of bytes a reconnecting client had already received.
+func (t *processTracker) AttachFrom(processID uint32, processIO warden.ProcessIO, offsets OutputOffsets) (LinuxProcess, error) {
 	t.processesMutex.RLock()
 	process, ok := t.processes[processID]
 	t.processesMutex.RUnlock()
@@ -91,7 +127,7 @@ func (t *processTracker) Attach(processID uint32, processIO warden.ProcessIO) (L
 		return nil, UnknownProcessError{processID}
 	}
 
-	process.Attach(processIO)
+	process.Attach(processIO, offsets)
 
 	go t.link(processID)
 
@@ -101,7 +137,7 @@ func (t *processTracker) Attach(processID uint32, processIO warden.ProcessIO) (L
 func (t *processTracker) Restore(processID uint32, tty bool) {
 	t.processesMutex.Lock()
 
-	process := NewProcess(processID, tty, t.containerPath, t.runner)
+	process := NewProcess(processID, tty, t.containerPath, t.runner, t.config)
 
 	t.processes[processID] = process
 
@@ -114,6 +150,18 @@ func (t *processTracker) Restore(processID uint32, tty bool) {
 	t.processesMutex.Unlock()
 }
 
+func (t *processTracker) Signal(processID uint32, signal syscall.Signal) error {
+	t.processesMutex.RLock()
+	process, ok := t.processes[processID]
+	t.processesMutex.RUnlock()
+
+	if !ok {
+		return UnknownProcessError{processID}
+	}
+
+	return process.Signal(signal)
+}
+
 func (t *processTracker) ActiveProcesses() []LinuxProcess {
 	t.processesMutex.RLock()
 	defer t.processesMutex.RUnlock()
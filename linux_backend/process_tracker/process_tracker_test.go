@@ -1,13 +1,16 @@
 package process_tracker_test
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -56,7 +59,7 @@ func setupSuccessfulSpawn() {
 var _ = Describe("Running processes", func() {
 	BeforeEach(func() {
 		fakeRunner = fake_command_runner.New()
-		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner)
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{})
 	})
 
 	It("runs the command asynchronously via iodaemon spawn", func() {
@@ -88,6 +91,7 @@ var _ = Describe("Running processes", func() {
 			Path: binPath("iodaemon"),
 			Args: []string{
 				"-tty=false",
+				"-signals",
 				"link",
 				tmpdir + "/depot/some-id/processes/1.sock",
 			},
@@ -145,6 +149,7 @@ var _ = Describe("Running processes", func() {
 				Path: binPath("iodaemon"),
 				Args: []string{
 					"-tty=false",
+					"-signals",
 					"link",
 					tmpdir + "/depot/some-id/processes/1.sock",
 				},
@@ -183,6 +188,7 @@ var _ = Describe("Running processes", func() {
 				Path: binPath("iodaemon"),
 				Args: []string{
 					"-tty=false",
+					"-signals",
 					"link",
 					tmpdir + "/depot/some-id/processes/1.sock",
 				},
@@ -243,6 +249,7 @@ var _ = Describe("Running processes", func() {
 					Path: binPath("iodaemon"),
 					Args: []string{
 						"-tty=true",
+						"-signals",
 						"link",
 						fmt.Sprintf(tmpdir+"/depot/some-id/processes/%d.sock", process.ID()),
 					},
@@ -287,6 +294,7 @@ var _ = Describe("Running processes", func() {
 						Path: binPath("iodaemon"),
 						Args: []string{
 							"-tty=true",
+							"-signals",
 							"link",
 							fmt.Sprintf(tmpdir+"/depot/some-id/processes/%d.sock", process.ID()),
 						},
@@ -296,6 +304,39 @@ var _ = Describe("Running processes", func() {
 		})
 	})
 
+	Context("with output logging configured", func() {
+		BeforeEach(func() {
+			processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{
+				LogSize:  1024,
+				LogFiles: 3,
+			})
+		})
+
+		It("spawns with -logSize and -logFiles", func() {
+			setupSuccessfulSpawn()
+
+			_, err := processTracker.Run(&exec.Cmd{Path: "/bin/bash", Args: []string{"-l"}}, warden.ProcessIO{}, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(fakeRunner).Should(HaveBackgrounded(
+				fake_command_runner.CommandSpec{
+					Path: "bash",
+					Args: []string{
+						"-c",
+						binPath("iodaemon") + ` "$@" &`,
+						binPath("iodaemon"),
+						"-logSize=1024",
+						"-logFiles=3",
+						"spawn",
+						tmpdir + "/depot/some-id/processes/1.sock",
+						"/bin/bash",
+						"-l",
+					},
+				},
+			))
+		})
+	})
+
 	Context("when spawning fails", func() {
 		disaster := errors.New("oh no!")
 
@@ -319,7 +360,7 @@ var _ = Describe("Running processes", func() {
 var _ = Describe("Restoring processes", func() {
 	BeforeEach(func() {
 		fakeRunner = fake_command_runner.New()
-		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner)
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{})
 	})
 
 	It("makes the next process ID be higher than the highest restored ID", func() {
@@ -358,13 +399,14 @@ var _ = Describe("Restoring processes", func() {
 var _ = Describe("Attaching to running processes", func() {
 	BeforeEach(func() {
 		fakeRunner = fake_command_runner.New()
-		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner)
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{})
 
 		fakeRunner.WhenRunning(
 			fake_command_runner.CommandSpec{
 				Path: binPath("iodaemon"),
 				Args: []string{
 					"-tty=false",
+					"-signals",
 					"link",
 					tmpdir + "/depot/some-id/processes/1.sock",
 				},
@@ -420,6 +462,7 @@ var _ = Describe("Attaching to running processes", func() {
 					Path: binPath("iodaemon"),
 					Args: []string{
 						"-tty=false",
+						"-signals",
 						"link",
 						tmpdir + "/depot/some-id/processes/1.sock",
 					},
@@ -436,6 +479,7 @@ var _ = Describe("Attaching to running processes", func() {
 					Path: binPath("iodaemon"),
 					Args: []string{
 						"-tty=false",
+						"-signals",
 						"link",
 						tmpdir + "/depot/some-id/processes/1.sock",
 					},
@@ -461,7 +505,7 @@ var _ = Describe("Attaching to running processes", func() {
 var _ = Describe("Unlinking active processes", func() {
 	BeforeEach(func() {
 		fakeRunner = fake_command_runner.New()
-		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner)
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{})
 	})
 
 	It("sends SIGINT to in-flight iodaemon links", func() {
@@ -496,6 +540,7 @@ var _ = Describe("Unlinking active processes", func() {
 				Path: tmpdir + "/depot/some-id/bin/iodaemon",
 				Args: []string{
 					"-tty=false",
+					"-signals",
 					"link",
 					tmpdir + "/depot/some-id/processes/1.sock",
 				},
@@ -508,6 +553,7 @@ var _ = Describe("Unlinking active processes", func() {
 				Path: tmpdir + "/depot/some-id/bin/iodaemon",
 				Args: []string{
 					"-tty=false",
+					"-signals",
 					"link",
 					tmpdir + "/depot/some-id/processes/2.sock",
 				},
@@ -517,10 +563,321 @@ var _ = Describe("Unlinking active processes", func() {
 	})
 })
 
+var _ = Describe("Replaying output to late attachers", func() {
+	var exited chan struct{}
+
+	BeforeEach(func() {
+		fakeRunner = fake_command_runner.New()
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{
+			ScrollbackSize: 10,
+		})
+
+		exited = make(chan struct{})
+		linkExited := exited
+
+		written := make(chan struct{})
+
+		linkSpec := fake_command_runner.CommandSpec{
+			Path: binPath("iodaemon"),
+		}
+
+		fakeRunner.WhenRunning(linkSpec, func(cmd *exec.Cmd) error {
+			cmd.Stdout.Write([]byte("hello\n"))
+			cmd.Stdout.Write([]byte("world\n"))
+			cmd.Stderr.Write([]byte("oops\n"))
+			close(written)
+			return nil
+		})
+
+		fakeRunner.WhenWaitingFor(linkSpec, func(cmd *exec.Cmd) error {
+			<-linkExited
+			return nil
+		})
+
+		setupSuccessfulSpawn()
+
+		_, err := processTracker.Run(exec.Command("xxx"), warden.ProcessIO{}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Eventually(written).Should(BeClosed())
+	})
+
+	AfterEach(func() {
+		close(exited)
+	})
+
+	It("replays the most recent output, up to the scrollback size", func() {
+		stdout := gbytes.NewBuffer()
+		stderr := gbytes.NewBuffer()
+
+		_, err := processTracker.Attach(1, warden.ProcessIO{
+			Stdout: stdout,
+			Stderr: stderr,
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(string(stdout.Contents())).Should(Equal("llo\nworld\n"))
+		Ω(string(stderr.Contents())).Should(Equal("oops\n"))
+	})
+
+	Context("when attaching from offsets", func() {
+		It("replays each stream from its offset", func() {
+			stdout := gbytes.NewBuffer()
+			stderr := gbytes.NewBuffer()
+
+			_, err := processTracker.AttachFrom(1, warden.ProcessIO{
+				Stdout: stdout,
+				Stderr: stderr,
+			}, process_tracker.OutputOffsets{
+				Stdout: 8,
+				Stderr: 2,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(string(stdout.Contents())).Should(Equal("rld\n"))
+			Ω(string(stderr.Contents())).Should(Equal("ps\n"))
+		})
+
+		Context("and an offset has fallen out of the scrollback", func() {
+			It("replays everything kept", func() {
+				stdout := gbytes.NewBuffer()
+
+				_, err := processTracker.AttachFrom(1, warden.ProcessIO{
+					Stdout: stdout,
+				}, process_tracker.OutputOffsets{
+					Stdout: 1,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(string(stdout.Contents())).Should(Equal("llo\nworld\n"))
+			})
+		})
+
+		Context("and an offset is past the end of the output", func() {
+			It("replays nothing", func() {
+				stdout := gbytes.NewBuffer()
+
+				_, err := processTracker.AttachFrom(1, warden.ProcessIO{
+					Stdout: stdout,
+				}, process_tracker.OutputOffsets{
+					Stdout: 100,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(stdout.Contents()).Should(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the process is unknown", func() {
+		It("returns an UnknownProcessError", func() {
+			_, err := processTracker.AttachFrom(42, warden.ProcessIO{}, process_tracker.OutputOffsets{})
+			Ω(err).Should(Equal(process_tracker.UnknownProcessError{42}))
+		})
+	})
+})
+
+var _ = Describe("Signalling processes", func() {
+	var signals chan *bufio.Reader
+	var exited chan struct{}
+
+	BeforeEach(func() {
+		fakeRunner = fake_command_runner.New()
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{})
+
+		signals = make(chan *bufio.Reader, 1)
+		exited = make(chan struct{})
+
+		// the link outlives the spec, so don't share the variables with it
+		linkSignals := signals
+		linkExited := exited
+
+		linkSpec := fake_command_runner.CommandSpec{
+			Path: binPath("iodaemon"),
+			Args: []string{
+				"-tty=false",
+				"-signals",
+				"link",
+				tmpdir + "/depot/some-id/processes/1.sock",
+			},
+		}
+
+		fakeRunner.WhenRunning(linkSpec, func(cmd *exec.Cmd) error {
+			Ω(cmd.ExtraFiles).Should(HaveLen(1))
+
+			// the tracker closes its copy once the link has started
+			fd, err := syscall.Dup(int(cmd.ExtraFiles[0].Fd()))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			linkSignals <- bufio.NewReader(os.NewFile(uintptr(fd), "signals"))
+
+			return nil
+		})
+
+		fakeRunner.WhenWaitingFor(linkSpec, func(cmd *exec.Cmd) error {
+			<-linkExited
+			return nil
+		})
+	})
+
+	It("relays the signal to iodaemon link on fd 3", func() {
+		setupSuccessfulSpawn()
+
+		process, err := processTracker.Run(exec.Command("xxx"), warden.ProcessIO{}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = processTracker.Signal(process.ID(), syscall.SIGTERM)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = process.(*process_tracker.Process).Signal(syscall.SIGUSR1)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var reader *bufio.Reader
+		Eventually(signals).Should(Receive(&reader))
+
+		line, err := reader.ReadString('\n')
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(line).Should(Equal(fmt.Sprintf("%d\n", syscall.SIGTERM)))
+
+		line, err = reader.ReadString('\n')
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(line).Should(Equal(fmt.Sprintf("%d\n", syscall.SIGUSR1)))
+
+		close(exited)
+	})
+
+	Context("when the link has exited", func() {
+		It("returns an error", func() {
+			setupSuccessfulSpawn()
+
+			process, err := processTracker.Run(exec.Command("xxx"), warden.ProcessIO{}, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			close(exited)
+
+			_, err = process.Wait()
+			Ω(err).Should(HaveOccurred())
+
+			err = process.(*process_tracker.Process).Signal(syscall.SIGTERM)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("when the process is unknown", func() {
+		It("returns an UnknownProcessError", func() {
+			err := processTracker.Signal(42, syscall.SIGTERM)
+			Ω(err).Should(Equal(process_tracker.UnknownProcessError{42}))
+		})
+	})
+})
+
+var _ = Describe("Reading process logs", func() {
+	var processesPath string
+
+	writeLog := func(name string, chunks ...process_tracker.LogChunk) {
+		file, err := os.Create(path.Join(processesPath, name))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer file.Close()
+
+		encoder := json.NewEncoder(file)
+
+		for _, chunk := range chunks {
+			err := encoder.Encode(chunk)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	}
+
+	chunk := func(source string, data string) process_tracker.LogChunk {
+		return process_tracker.LogChunk{
+			Time:   time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC),
+			Source: source,
+			Data:   []byte(data),
+		}
+	}
+
+	BeforeEach(func() {
+		fakeRunner = fake_command_runner.New()
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{})
+
+		processesPath = tmpdir + "/depot/some-id/processes"
+
+		err := os.MkdirAll(processesPath, 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("when the process's output has been logged and rotated", func() {
+		BeforeEach(func() {
+			writeLog("1.log.10", chunk("stdout", "one"))
+			writeLog("1.log.2", chunk("stdout", "two"), chunk("stderr", "three"))
+			writeLog("1.log.1", chunk("stdout", "four"))
+			writeLog("1.log", chunk("stderr", "five"), chunk("stdout", "six"))
+			writeLog("2.log", chunk("stdout", "another process"))
+		})
+
+		It("returns every chunk, oldest first", func() {
+			chunks, err := processTracker.ReadLogs(1, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(chunks).Should(Equal([]process_tracker.LogChunk{
+				chunk("stdout", "one"),
+				chunk("stdout", "two"),
+				chunk("stderr", "three"),
+				chunk("stdout", "four"),
+				chunk("stderr", "five"),
+				chunk("stdout", "six"),
+			}))
+		})
+
+		Context("with a tail", func() {
+			It("returns only the last chunks", func() {
+				chunks, err := processTracker.ReadLogs(1, 3)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(chunks).Should(Equal([]process_tracker.LogChunk{
+					chunk("stdout", "four"),
+					chunk("stderr", "five"),
+					chunk("stdout", "six"),
+				}))
+			})
+		})
+	})
+
+	Context("when the log ends with an incomplete entry", func() {
+		BeforeEach(func() {
+			writeLog("1.log", chunk("stdout", "complete"))
+
+			file, err := os.OpenFile(path.Join(processesPath, "1.log"), os.O_WRONLY|os.O_APPEND, 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = file.Write([]byte(`{"Time":"2014-07-01T12:00:00Z","Sou`))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			file.Close()
+		})
+
+		It("ignores it", func() {
+			chunks, err := processTracker.ReadLogs(1, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(chunks).Should(Equal([]process_tracker.LogChunk{
+				chunk("stdout", "complete"),
+			}))
+		})
+	})
+
+	Context("when the process has no logs", func() {
+		It("returns a NoLogsError", func() {
+			_, err := processTracker.ReadLogs(1, 0)
+			Ω(err).Should(Equal(process_tracker.NoLogsError{1}))
+		})
+	})
+})
+
 var _ = Describe("Listing active process IDs", func() {
 	BeforeEach(func() {
 		fakeRunner = fake_command_runner.New()
-		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner)
+		processTracker = process_tracker.New(tmpdir+"/depot/some-id", fakeRunner, process_tracker.Config{})
 	})
 
 	It("includes running process IDs", func() {
@@ -533,6 +890,7 @@ var _ = Describe("Listing active process IDs", func() {
 				Path: binPath("iodaemon"),
 				Args: []string{
 					"-tty=false",
+					"-signals",
 					"link",
 					tmpdir + "/depot/some-id/processes/1.sock",
 				},
@@ -548,6 +906,7 @@ var _ = Describe("Listing active process IDs", func() {
 				Path: binPath("iodaemon"),
 				Args: []string{
 					"-tty=false",
+					"-signals",
 					"link",
 					tmpdir + "/depot/some-id/processes/2.sock",
 				},
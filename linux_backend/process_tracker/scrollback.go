@@ -0,0 +1,63 @@
+package process_tracker
+
+// scrollback keeps the most recent bytes written to a stream, up to its
+// capacity, along with how many were written in total, so that output can be
+// replayed from a given offset into the stream.
+type scrollback struct {
+	capacity int
+
+	// grows up to capacity, after which the oldest byte is at start
+	data  []byte
+	start int
+
+	written uint64
+}
+
+func newScrollback(capacity int) *scrollback {
+	return &scrollback{capacity: capacity}
+}
+
+func (s *scrollback) Write(p []byte) {
+	s.written += uint64(len(p))
+
+	if len(p) > s.capacity {
+		p = p[len(p)-s.capacity:]
+	}
+
+	if room := s.capacity - len(s.data); room > 0 {
+		n := len(p)
+		if n > room {
+			n = room
+		}
+
+		s.data = append(s.data, p[:n]...)
+		p = p[n:]
+	}
+
+	// full; overwrite the oldest bytes
+	for len(p) > 0 {
+		n := copy(s.data[s.start:], p)
+		p = p[n:]
+		s.start = (s.start + n) % len(s.data)
+	}
+}
+
+// From returns the bytes kept from the given offset onward. If the offset
+// has already fallen out of the scrollback, everything kept is returned.
+func (s *scrollback) From(offset uint64) []byte {
+	kept := make([]byte, 0, len(s.data))
+	kept = append(kept, s.data[s.start:]...)
+	kept = append(kept, s.data[:s.start]...)
+
+	first := s.written - uint64(len(kept))
+
+	if offset <= first {
+		return kept
+	}
+
+	if offset >= s.written {
+		return nil
+	}
+
+	return kept[offset-first:]
+}
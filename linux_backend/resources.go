@@ -7,9 +7,10 @@ import (
 )
 
 type Resources struct {
-	UID     uint32
-	Network *network.Network
-	Ports   []uint32
+	UID         uint32
+	Network     *network.Network
+	IPv6Network *network.Network
+	Ports       []uint32
 
 	portsLock *sync.Mutex
 }
@@ -17,12 +18,14 @@ type Resources struct {
 func NewResources(
 	uid uint32,
 	network *network.Network,
+	ipv6Network *network.Network,
 	ports []uint32,
 ) *Resources {
 	return &Resources{
-		UID:     uid,
-		Network: network,
-		Ports:   ports,
+		UID:         uid,
+		Network:     network,
+		IPv6Network: ipv6Network,
+		Ports:       ports,
 
 		portsLock: new(sync.Mutex),
 	}
@@ -34,3 +37,17 @@ func (r *Resources) AddPort(port uint32) {
 
 	r.Ports = append(r.Ports, port)
 }
+
+func (r *Resources) RemovePort(port uint32) bool {
+	r.portsLock.Lock()
+	defer r.portsLock.Unlock()
+
+	for i, p := range r.Ports {
+		if p == port {
+			r.Ports = append(r.Ports[:i], r.Ports[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -9,10 +9,21 @@ cd $(dirname $0)
 
 source ./etc/config
 
-./net.sh teardown
-
 cgroup_path="${WARDEN_CGROUP_PATH}"
 
+# Remove the container's class from the uplink, if its bandwidth was shaped
+# there
+if [ -f ./etc/uplink_class ]
+then
+  source ./etc/uplink_class
+
+  iptables -w -t mangle -D PREROUTING -i ${network_host_iface} --jump MARK --set-mark ${uplink_class_id} 2> /dev/null || true
+  tc filter del dev ${uplink_iface} parent 1: protocol all prio 1 handle ${uplink_class_id} fw 2> /dev/null || true
+  tc class del dev ${uplink_iface} classid 1:$(printf "%x" ${uplink_class_id}) 2> /dev/null || true
+
+  rm -f ./etc/uplink_class
+fi
+
 if [ -f ./run/wshd.pid ]
 then
   pid=$(cat ./run/wshd.pid)
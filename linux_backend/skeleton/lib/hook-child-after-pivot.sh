@@ -24,11 +24,16 @@ hostname $id
 ip address add 127.0.0.1/8 dev lo
 ip link set lo up
 
-ip address add $network_container_ip/30 dev $network_container_iface
+ip address add $network_container_ip/$network_prefix_length dev $network_container_iface
 ip link set $network_container_iface mtu $container_iface_mtu up
 
 ip route add default via $network_host_ip dev $network_container_iface
 
+if [ -n "${network_container_ipv6:-}" ]; then
+  ip -6 address add $network_container_ipv6/$network_ipv6_prefix_length dev $network_container_iface nodad
+  ip -6 route add default via $network_host_ipv6 dev $network_container_iface
+fi
+
 if [ -e /etc/seed ]; then
   . /etc/seed
 fi
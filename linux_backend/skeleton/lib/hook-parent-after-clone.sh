@@ -67,11 +67,7 @@ done
 
 echo $PID > ./run/wshd.pid
 
-ip link add name $network_host_iface type veth peer name $network_container_iface
-ip link set $network_host_iface netns 1
+# The veth pair is created and the host end configured before wshd starts
 ip link set $network_container_iface netns $PID
 
-ip address add $network_host_ip/30 dev $network_host_iface
-ip link set $network_host_iface up
-
 exit 0
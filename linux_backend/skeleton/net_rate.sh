@@ -9,15 +9,14 @@ cd $(dirname "${0}")
 
 source ./etc/config
 
-if [ -z "${RATE:-}" ]; then
-  echo "Please specify RATE..." 1>&2
-  exit 1
-fi
+MODE=${MODE:-tbf}
 
-if [ -z "${BURST:-}" ]; then
-  echo "Please specify BURST..." 1>&2
-  exit  1
-fi
+for var in INGRESS_RATE INGRESS_BURST EGRESS_RATE EGRESS_BURST; do
+  if [ -z "${!var:-}" ]; then
+    echo "Please specify ${var}..." 1>&2
+    exit 1
+  fi
+done
 
 # clear rule if exist
 # delete root egress tc qdisc
@@ -30,10 +29,34 @@ tc qdisc del dev ${network_host_iface} ingress 2> /dev/null || true
 # rate is the bandwidth
 # burst is the burst size
 # latency is the maxium time the packet wait to enqueue while no token left
-tc qdisc add dev ${network_host_iface} root tbf rate ${RATE}bit burst ${BURST} latency 25ms
-
-# set outbound(w-<cid>-1 -> w-<cid>-0 -> eth0 -> outside)  rule
-tc qdisc add dev ${network_host_iface} ingress handle ffff:
-
-# use u32 filter with target(0.0.0.0) mask (0) to filter all the ingress packets
-tc filter add dev ${network_host_iface} parent ffff: protocol ip prio 1 u32 match ip src 0.0.0.0/0 police rate ${RATE}bit burst ${BURST} drop flowid :1
+tc qdisc add dev ${network_host_iface} root tbf rate ${INGRESS_RATE}bit burst ${INGRESS_BURST} latency 25ms
+
+if [ "${MODE}" == "htb" ]; then
+  if [ -z "${EGRESS_CEIL:-}" ] || [ -z "${UPLINK_IFACE:-}" ] || [ -z "${CLASS_ID:-}" ]; then
+    echo "Please specify EGRESS_CEIL, UPLINK_IFACE and CLASS_ID..." 1>&2
+    exit 1
+  fi
+
+  class_id=$(printf "%x" ${CLASS_ID})
+
+  # mark outbound(w-<cid>-1 -> w-<cid>-0 -> eth0 -> outside) packets, so that
+  # they can be classified on the uplink after they have been SNATed
+  iptables -w -t mangle -D PREROUTING -i ${network_host_iface} --jump MARK --set-mark ${CLASS_ID} 2> /dev/null || true
+  iptables -w -t mangle -A PREROUTING -i ${network_host_iface} --jump MARK --set-mark ${CLASS_ID}
+
+  # guarantee rate, and borrow from the uplink's other classes up to ceil
+  tc class replace dev ${UPLINK_IFACE} parent 1:1 classid 1:${class_id} htb rate ${EGRESS_RATE}bit ceil ${EGRESS_CEIL}bit burst ${EGRESS_BURST}
+  tc filter replace dev ${UPLINK_IFACE} parent 1: protocol all prio 1 handle ${CLASS_ID} fw flowid 1:${class_id}
+
+  # remember the class so that destroy.sh can remove it
+  cat > ./etc/uplink_class <<-EOS
+uplink_iface=${UPLINK_IFACE}
+uplink_class_id=${CLASS_ID}
+EOS
+else
+  # set outbound(w-<cid>-1 -> w-<cid>-0 -> eth0 -> outside)  rule
+  tc qdisc add dev ${network_host_iface} ingress handle ffff:
+
+  # use u32 filter with target(0.0.0.0) mask (0) to filter all the ingress packets
+  tc filter add dev ${network_host_iface} parent ffff: protocol ip prio 1 u32 match ip src 0.0.0.0/0 police rate ${EGRESS_RATE}bit burst ${EGRESS_BURST} drop flowid :1
+fi
@@ -13,10 +13,17 @@ max_id_len=$(expr 16 - ${#iface_name_prefix} - 2)
 iface_name=$(tail -c ${max_id_len} <<< ${id})
 id=${id:-test}
 network_host_ip=${network_host_ip:-10.0.0.1}
-network_host_iface="${iface_name_prefix}${iface_name}-0"
+network_host_iface=${network_host_iface:-${iface_name_prefix}${iface_name}-0}
 network_container_ip=${network_container_ip:-10.0.0.2}
-network_container_iface="${iface_name_prefix}${iface_name}-1"
+network_container_iface=${network_container_iface:-${iface_name_prefix}${iface_name}-1}
+network_prefix_length=${network_prefix_length:-30}
+network_host_ipv6=${network_host_ipv6:-}
+network_container_ipv6=${network_container_ipv6:-}
+network_ipv6_prefix_length=${network_ipv6_prefix_length:-}
 user_uid=${user_uid:-10000}
+dns_nameservers=${dns_nameservers:-}
+dns_search=${dns_search:-}
+dns_hosts=${dns_hosts:-}
 rootfs_path=$(readlink -f $rootfs_path)
 
 # Write configuration
@@ -26,6 +33,10 @@ network_host_ip=$network_host_ip
 network_host_iface=$network_host_iface
 network_container_ip=$network_container_ip
 network_container_iface=$network_container_iface
+network_prefix_length=$network_prefix_length
+network_host_ipv6=$network_host_ipv6
+network_container_ipv6=$network_container_ipv6
+network_ipv6_prefix_length=$network_ipv6_prefix_length
 user_uid=$user_uid
 rootfs_path=$rootfs_path
 EOS
@@ -74,13 +85,36 @@ cat > $rootfs_path/etc/hosts <<-EOS
 $network_container_ip $id
 EOS
 
-# By default, inherit the nameserver from the host container.
+if [ -n "$network_container_ipv6" ]
+then
+  cat >> $rootfs_path/etc/hosts <<-EOS
+::1 localhost
+$network_container_ipv6 $id
+EOS
+fi
+
+if [ -n "$dns_hosts" ]
+then
+  echo "$dns_hosts" >> $rootfs_path/etc/hosts
+fi
+
+# Use the configured nameservers, if any.
+#
+# Otherwise, inherit the nameserver from the host container.
 #
 # Exception: When the host's nameserver is set to localhost (127.0.0.1), it is
 # assumed to be running its own DNS server and listening on all interfaces.
 # In this case, the warden container must use the network_host_ip address
 # as the nameserver.
-if [[ "$(cat /etc/resolv.conf)" == "nameserver 127.0.0.1" ]]
+if [ -n "$dns_nameservers" ]
+then
+  rm -f $rootfs_path/etc/resolv.conf
+
+  for nameserver in $dns_nameservers
+  do
+    echo "nameserver $nameserver" >> $rootfs_path/etc/resolv.conf
+  done
+elif [[ "$(cat /etc/resolv.conf)" == "nameserver 127.0.0.1" ]]
 then
   cat > $rootfs_path/etc/resolv.conf <<-EOS
 nameserver $network_host_ip
@@ -89,6 +123,12 @@ else
   cp /etc/resolv.conf $rootfs_path/etc/
 fi
 
+if [ -n "$dns_search" ]
+then
+  sed -i '/^\(search\|domain\) /d' $rootfs_path/etc/resolv.conf
+  echo "search $dns_search" >> $rootfs_path/etc/resolv.conf
+fi
+
 # Add vcap user if not already present
 $(which chroot) $rootfs_path env -i /bin/bash -l <<-EOS
 if ! id vcap > /dev/null 2>&1
@@ -15,6 +15,4 @@ then
   exit 1
 fi
 
-./net.sh setup
-
 ./bin/wshd --run ./run --lib ./lib --root $rootfs_path --title "wshd: $id"
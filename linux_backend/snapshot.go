@@ -5,7 +5,9 @@ import (
 
 	"github.com/cloudfoundry-incubator/garden/warden"
 
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
 )
 
 type ContainerSnapshot struct {
@@ -14,6 +16,9 @@ type ContainerSnapshot struct {
 
 	GraceTime time.Duration
 
+	DNS DNSConfig
+	MTU uint32
+
 	State  string
 	Events []string
 
@@ -26,20 +31,28 @@ type ContainerSnapshot struct {
 	NetIns  []NetInSpec
 	NetOuts []NetOutSpec
 
+	Accounting map[string]network_manager.Traffic
+
 	Properties warden.Properties
 }
 
 type LimitsSnapshot struct {
-	Memory    *warden.MemoryLimits
-	Disk      *warden.DiskLimits
-	Bandwidth *warden.BandwidthLimits
-	CPU       *warden.CPULimits
+	Memory *warden.MemoryLimits
+	Disk   *warden.DiskLimits
+
+	// Bandwidth is only read, from snapshots taken before limits could
+	// differ by direction; BandwidthByDirection replaces it.
+	Bandwidth            *warden.BandwidthLimits
+	BandwidthByDirection *bandwidth_manager.Limits
+
+	CPU *warden.CPULimits
 }
 
 type ResourcesSnapshot struct {
-	UID     uint32
-	Network *network.Network
-	Ports   []uint32
+	UID         uint32
+	Network     *network.Network
+	IPv6Network *network.Network
+	Ports       []uint32
 }
 
 type ProcessSnapshot struct {
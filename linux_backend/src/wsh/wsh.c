@@ -7,6 +7,7 @@
 #include <stdlib.h>
 #include <string.h>
 #include <sys/ioctl.h>
+#include <sys/socket.h>
 #include <termios.h>
 #include <unistd.h>
 
@@ -254,9 +255,34 @@ void tty_winsz(void) {
   tty_swinsz();
 }
 
+static int signal_fd;
+
+void signal__forward(int sig) {
+  int errno_ = errno;
+
+  /* Nothing to be done if the daemon is no longer listening */
+  send(signal_fd, &sig, sizeof(sig), MSG_NOSIGNAL);
+
+  errno = errno_;
+}
+
+/* Forward signals that would otherwise end wsh to the process */
+void signal_forward(int fd) {
+  int signals[] = { SIGHUP, SIGINT, SIGQUIT, SIGUSR1, SIGUSR2, SIGALRM, SIGTERM };
+  size_t i;
+  sighandler_t s;
+
+  signal_fd = fd;
+
+  for (i = 0; i < sizeof(signals)/sizeof(signals[0]); i++) {
+    s = signal(signals[i], signal__forward);
+    assert(s != SIG_ERR);
+  }
+}
+
 void loop_interactive(int fd) {
   msg_response_t res;
-  int fds[2];
+  int fds[3];
   size_t fdslen = sizeof(fds)/sizeof(fds[0]);
   int rv;
 
@@ -274,6 +300,8 @@ void loop_interactive(int fd) {
   tty_raw();
   tty_winsz();
 
+  signal_forward(fds[2]);
+
   pump_t p;
   pump_pair_t pp[2];
 
@@ -286,7 +314,7 @@ void loop_interactive(int fd) {
 
 void loop_noninteractive(int fd) {
   msg_response_t res;
-  int fds[4];
+  int fds[5];
   size_t fdslen = sizeof(fds)/sizeof(fds[0]);
   int rv;
 
@@ -298,6 +326,8 @@ void loop_noninteractive(int fd) {
 
   assert(rv == sizeof(res));
 
+  signal_forward(fds[4]);
+
   pump_t p;
   pump_pair_t pp[3];
 
@@ -49,10 +49,11 @@ struct wshd_s {
   barrier_t barrier_parent;
   barrier_t barrier_child;
 
-  /* Map pids to exit status fds */
+  /* Map pids to exit status fds, and to fds that signals for them arrive on */
   struct {
     pid_t pid;
     int fd;
+    int signal_fd;
   } *pid_to_fd;
   size_t pid_to_fd_len;
 };
@@ -156,7 +157,7 @@ void assert_directory(const char *path) {
   }
 }
 
-void child_pid_to_fd_add(wshd_t *w, pid_t pid, int fd) {
+void child_pid_to_fd_add(wshd_t *w, pid_t pid, int fd, int signal_fd) {
   int len = w->pid_to_fd_len;
 
   /* Store a copy */
@@ -166,11 +167,20 @@ void child_pid_to_fd_add(wshd_t *w, pid_t pid, int fd) {
     abort();
   }
 
+  signal_fd = dup(signal_fd);
+  if (signal_fd == -1) {
+    perror("dup");
+    abort();
+  }
+
+  fcntl_mix_cloexec(signal_fd);
+
   w->pid_to_fd = realloc(w->pid_to_fd, (len + 1) * sizeof(w->pid_to_fd[0]));
   assert(w->pid_to_fd != NULL);
 
   w->pid_to_fd[len].pid = pid;
   w->pid_to_fd[len].fd = fd;
+  w->pid_to_fd[len].signal_fd = signal_fd;
   w->pid_to_fd_len++;
 }
 
@@ -183,6 +193,11 @@ int child_pid_to_fd_remove(wshd_t *w, pid_t pid) {
     if (w->pid_to_fd[i].pid == pid) {
       fd = w->pid_to_fd[i].fd;
 
+      /* No more signals can be delivered */
+      if (w->pid_to_fd[i].signal_fd > -1) {
+        close(w->pid_to_fd[i].signal_fd);
+      }
+
       /* Move tail if there is one */
       if ((i + 1) < len) {
         memmove(&w->pid_to_fd[i], &w->pid_to_fd[i+1], (len - i - 1) * sizeof(w->pid_to_fd[0]));
@@ -352,15 +367,15 @@ error:
 
 int child_handle_interactive(int fd, wshd_t *w, msg_request_t *req) {
   int i, j;
-  int p[2][2];
-  int p_[2];
+  int p[3][2];
+  int p_[3];
   int rv;
   msg_response_t res;
 
   msg_response_init(&res);
 
   /* Initialize so that the error handler can do its job */
-  for (i = 0; i < 2; i++) {
+  for (i = 0; i < 3; i++) {
     p[i][0] = -1;
     p[i][1] = -1;
     p_[i] = -1;
@@ -375,6 +390,15 @@ int child_handle_interactive(int fd, wshd_t *w, msg_request_t *req) {
   fcntl_mix_cloexec(p[1][0]);
   fcntl_mix_cloexec(p[1][1]);
 
+  rv = socketpair(AF_UNIX, SOCK_STREAM, 0, p[2]);
+  if (rv == -1) {
+    perror("socketpair");
+    abort();
+  }
+
+  fcntl_mix_cloexec(p[2][0]);
+  fcntl_mix_cloexec(p[2][1]);
+
   rv = openpty(&p[0][0], &p[0][1], NULL);
   if (rv < 0) {
     perror("openpty");
@@ -387,8 +411,9 @@ int child_handle_interactive(int fd, wshd_t *w, msg_request_t *req) {
   /* Descriptors to send to client */
   p_[0] = p[0][0];
   p_[1] = p[1][0];
+  p_[2] = p[2][1];
 
-  rv = un_send_fds(fd, (char *)&res, sizeof(res), p_, 2);
+  rv = un_send_fds(fd, (char *)&res, sizeof(res), p_, 3);
   if (rv == -1) {
     goto err;
   }
@@ -396,10 +421,10 @@ int child_handle_interactive(int fd, wshd_t *w, msg_request_t *req) {
   rv = child_fork(req, p[0][1], p[0][1], p[0][1]);
   assert(rv > 0);
 
-  child_pid_to_fd_add(w, rv, p[1][1]);
+  child_pid_to_fd_add(w, rv, p[1][1], p[2][0]);
 
 err:
-  for (i = 0; i < 2; i++) {
+  for (i = 0; i < 3; i++) {
     for (j = 0; j < 2; j++) {
       if (p[i][j] > -1) {
         close(p[i][j]);
@@ -418,15 +443,15 @@ err:
 
 int child_handle_noninteractive(int fd, wshd_t *w, msg_request_t *req) {
   int i, j;
-  int p[4][2];
-  int p_[4];
+  int p[5][2];
+  int p_[5];
   int rv;
   msg_response_t res;
 
   msg_response_init(&res);
 
   /* Initialize so that the error handler can do its job */
-  for (i = 0; i < 4; i++) {
+  for (i = 0; i < 5; i++) {
     p[i][0] = -1;
     p[i][1] = -1;
     p_[i] = -1;
@@ -443,13 +468,23 @@ int child_handle_noninteractive(int fd, wshd_t *w, msg_request_t *req) {
     fcntl_mix_cloexec(p[i][1]);
   }
 
+  rv = socketpair(AF_UNIX, SOCK_STREAM, 0, p[4]);
+  if (rv == -1) {
+    perror("socketpair");
+    abort();
+  }
+
+  fcntl_mix_cloexec(p[4][0]);
+  fcntl_mix_cloexec(p[4][1]);
+
   /* Descriptors to send to client */
   p_[0] = p[0][1];
   p_[1] = p[1][0];
   p_[2] = p[2][0];
   p_[3] = p[3][0];
+  p_[4] = p[4][1];
 
-  rv = un_send_fds(fd, (char *)&res, sizeof(res), p_, 4);
+  rv = un_send_fds(fd, (char *)&res, sizeof(res), p_, 5);
   if (rv == -1) {
     goto err;
   }
@@ -457,10 +492,10 @@ int child_handle_noninteractive(int fd, wshd_t *w, msg_request_t *req) {
   rv = child_fork(req, p[0][0], p[1][1], p[2][1]);
   assert(rv > 0);
 
-  child_pid_to_fd_add(w, rv, p[3][1]);
+  child_pid_to_fd_add(w, rv, p[3][1], p[4][0]);
 
 err:
-  for (i = 0; i < 4; i++) {
+  for (i = 0; i < 5; i++) {
     for (j = 0; j < 2; j++) {
       if (p[i][j] > -1) {
         close(p[i][j]);
@@ -547,6 +582,29 @@ void child_handle_sigchld(wshd_t *w) {
   }
 }
 
+/* Deliver signals sent by clients to their processes */
+void child_forward_signals(wshd_t *w, fd_set *fds) {
+  int i, rv, signum;
+
+  for (i = 0; i < w->pid_to_fd_len; i++) {
+    if (w->pid_to_fd[i].signal_fd == -1 || !FD_ISSET(w->pid_to_fd[i].signal_fd, fds)) {
+      continue;
+    }
+
+    do {
+      rv = read(w->pid_to_fd[i].signal_fd, &signum, sizeof(signum));
+    } while (rv == -1 && errno == EINTR);
+
+    if (rv == sizeof(signum)) {
+      kill(w->pid_to_fd[i].pid, signum);
+    } else {
+      /* Client went away */
+      close(w->pid_to_fd[i].signal_fd);
+      w->pid_to_fd[i].signal_fd = -1;
+    }
+  }
+}
+
 int child_signalfd(void) {
   sigset_t mask;
   int rv;
@@ -582,11 +640,18 @@ int child_loop(wshd_t *w) {
 
   for (;;) {
     fd_set fds;
+    int i;
 
     FD_ZERO(&fds);
     FD_SET(w->fd, &fds);
     FD_SET(sfd, &fds);
 
+    for (i = 0; i < w->pid_to_fd_len; i++) {
+      if (w->pid_to_fd[i].signal_fd > -1) {
+        FD_SET(w->pid_to_fd[i].signal_fd, &fds);
+      }
+    }
+
     do {
       rv = select(FD_SETSIZE, &fds, NULL, NULL, NULL);
     } while (rv == -1 && errno == EINTR);
@@ -596,6 +661,9 @@ int child_loop(wshd_t *w) {
       abort();
     }
 
+    /* Before accepting or reaping, which change the pid to fd map */
+    child_forward_signals(w, &fds);
+
     if (FD_ISSET(w->fd, &fds)) {
       child_accept(w);
     }
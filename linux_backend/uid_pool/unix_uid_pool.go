@@ -2,16 +2,16 @@ package uid_pool
 
 import (
 	"fmt"
-	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/allocator"
 )
 
 type UnixUIDPool struct {
 	start uint32
 	size  uint32
 
-	pool            []uint32
-	poolMutex       *sync.Mutex
-	initialPoolSize int
+	allocator *allocator.Allocator
 }
 
 type PoolExhaustedError struct{}
@@ -28,63 +28,33 @@ func (e UIDTakenError) Error() string {
 	return fmt.Sprintf("uid already acquired: %d", e.UID)
 }
 
-func New(start, size uint32) *UnixUIDPool {
-	pool := []uint32{}
-
-	for i := start; i < start+size; i++ {
-		pool = append(pool, i)
-	}
-
+func New(start, size uint32, quarantine time.Duration) *UnixUIDPool {
 	return &UnixUIDPool{
 		start: start,
 		size:  size,
 
-		pool:            pool,
-		poolMutex:       new(sync.Mutex),
-		initialPoolSize: len(pool),
+		allocator: allocator.New(size, quarantine),
 	}
 }
 
 func (p *UnixUIDPool) InitialSize() int {
-	return p.initialPoolSize
+	return int(p.size)
 }
 
 func (p *UnixUIDPool) Acquire() (uint32, error) {
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	if len(p.pool) == 0 {
+	offset, ok := p.allocator.Acquire()
+	if !ok {
 		return 0, PoolExhaustedError{}
 	}
 
-	uid := p.pool[0]
-
-	p.pool = p.pool[1:]
-
-	return uid, nil
+	return p.start + offset, nil
 }
 
 func (p *UnixUIDPool) Remove(uid uint32) error {
-	idx := 0
-	found := false
-
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	for i, existingUID := range p.pool {
-		if existingUID == uid {
-			idx = i
-			found = true
-			break
-		}
-	}
-
-	if !found {
+	if uid < p.start || uid >= p.start+p.size || !p.allocator.Claim(uid-p.start, 1) {
 		return UIDTakenError{uid}
 	}
 
-	p.pool = append(p.pool[:idx], p.pool[idx+1:]...)
-
 	return nil
 }
 
@@ -93,8 +63,5 @@ func (p *UnixUIDPool) Release(uid uint32) {
 		return
 	}
 
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-
-	p.pool = append(p.pool, uid)
+	p.allocator.Release(uid - p.start)
 }
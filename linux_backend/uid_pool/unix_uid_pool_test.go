@@ -10,7 +10,7 @@ import (
 var _ = Describe("Unix UID pool", func() {
 	Describe("acquiring", func() {
 		It("returns the next available UID from the pool", func() {
-			pool := uid_pool.New(10000, 5)
+			pool := uid_pool.New(10000, 5, 0)
 
 			uid1, err := pool.Acquire()
 			Ω(err).ShouldNot(HaveOccurred())
@@ -24,7 +24,7 @@ var _ = Describe("Unix UID pool", func() {
 
 		Context("when the pool is exhausted", func() {
 			It("returns an error", func() {
-				pool := uid_pool.New(10000, 5)
+				pool := uid_pool.New(10000, 5, 0)
 
 				for i := 0; i < 5; i++ {
 					_, err := pool.Acquire()
@@ -39,7 +39,7 @@ var _ = Describe("Unix UID pool", func() {
 
 	Describe("removing", func() {
 		It("acquires a specific UID from the pool", func() {
-			pool := uid_pool.New(10000, 2)
+			pool := uid_pool.New(10000, 2, 0)
 
 			err := pool.Remove(10000)
 			Ω(err).ShouldNot(HaveOccurred())
@@ -54,7 +54,7 @@ var _ = Describe("Unix UID pool", func() {
 
 		Context("when the resource is already acquired", func() {
 			It("returns a UIDTakenError", func() {
-				pool := uid_pool.New(10000, 2)
+				pool := uid_pool.New(10000, 2, 0)
 
 				uid, err := pool.Acquire()
 				Ω(err).ShouldNot(HaveOccurred())
@@ -67,7 +67,7 @@ var _ = Describe("Unix UID pool", func() {
 
 	Describe("releasing", func() {
 		It("places a uid back at the end of the pool", func() {
-			pool := uid_pool.New(10000, 2)
+			pool := uid_pool.New(10000, 2, 0)
 
 			uid1, err := pool.Acquire()
 			Ω(err).ShouldNot(HaveOccurred())
@@ -86,7 +86,7 @@ var _ = Describe("Unix UID pool", func() {
 
 		Context("when the released uid is out of the range", func() {
 			It("does not add it to the pool", func() {
-				pool := uid_pool.New(10000, 0)
+				pool := uid_pool.New(10000, 0, 0)
 
 				pool.Release(20000)
 
@@ -6,9 +6,11 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path"
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/daemon/graphdriver"
 	_ "github.com/docker/docker/daemon/graphdriver/aufs"
@@ -18,11 +20,14 @@ import (
 
 	"github.com/cloudfoundry-incubator/garden/server"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/container_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/container_pool/repository_fetcher"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/container_pool/rootfs_provider"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/network_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/port_pool"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/process_tracker"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/quota_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/uid_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/sysconfig"
@@ -45,7 +50,7 @@ var listenAddr = flag.String(
 var snapshotsPath = flag.String(
 	"snapshots",
 	"",
-	"directory in which to store container state to persist through restarts",
+	"directory in which to store container state to persist through restarts; also enables the state journal in the depot, which keeps containers through crashes",
 )
 
 var binPath = flag.String(
@@ -93,13 +98,31 @@ var debug = flag.Bool(
 var networkPool = flag.String(
 	"networkPool",
 	"10.254.0.0/22",
-	"network pool CIDR for containers; each container will get a /30",
+	"network pool CIDR for containers; each container will get a subnet of -networkPoolSubnetPrefix",
+)
+
+var networkPoolSubnetPrefix = flag.Int(
+	"networkPoolSubnetPrefix",
+	30,
+	"prefix length of the subnet each container gets from the network pool",
+)
+
+var ipv6NetworkPool = flag.String(
+	"ipv6NetworkPool",
+	"",
+	"optional IPv6 network pool CIDR for containers; each container will additionally get a subnet of -ipv6NetworkPoolSubnetPrefix",
+)
+
+var ipv6NetworkPoolSubnetPrefix = flag.Int(
+	"ipv6NetworkPoolSubnetPrefix",
+	126,
+	"prefix length of the subnet each container gets from the IPv6 network pool",
 )
 
 var portPoolStart = flag.Uint(
 	"portPoolStart",
-	61001,
-	"start of ephemeral port range used for mapped container ports",
+	0,
+	"start of port range used for mapped container ports (defaults to just above the kernel's ephemeral port range, or just below it if it ends at 65535)",
 )
 
 var portPoolSize = flag.Uint(
@@ -108,6 +131,18 @@ var portPoolSize = flag.Uint(
 	"size of port pool used for mapped container ports",
 )
 
+var strictPortPool = flag.Bool(
+	"strictPortPool",
+	false,
+	"refuse to start if the port pool overlaps the kernel's ephemeral port range, rather than warn",
+)
+
+var poolQuarantine = flag.Duration(
+	"poolQuarantine",
+	0,
+	"time for which released UIDs, networks and ports are held back before reuse, e.g. to let conntrack entries expire",
+)
+
 var uidPoolStart = flag.Uint(
 	"uidPoolStart",
 	10000,
@@ -126,12 +161,90 @@ var denyNetworks = flag.String(
 	"CIDR blocks representing IPs to blacklist",
 )
 
+var denyAction = flag.String(
+	"denyAction",
+	"drop",
+	"what to do with traffic to -denyNetworks: drop, or reject with a TCP reset or ICMP port unreachable",
+)
+
+var externalIP = flag.String(
+	"externalIP",
+	"",
+	"IP address that mapped host ports are reached on (defaults to the source address of the default route, or any local address if there is none)",
+)
+
 var allowNetworks = flag.String(
 	"allowNetworks",
 	"",
 	"CIDR blocks representing IPs to whitelist",
 )
 
+var dnsServers = flag.String(
+	"dnsServers",
+	"",
+	"comma-separated nameservers for containers (defaults to the host's)",
+)
+
+var dnsSearch = flag.String(
+	"dnsSearch",
+	"",
+	"comma-separated search domains for containers",
+)
+
+var extraHosts = flag.String(
+	"extraHosts",
+	"",
+	"comma-separated hostname:ip entries to add to containers' /etc/hosts",
+)
+
+var mtu = flag.Uint(
+	"mtu",
+	0,
+	"MTU of containers' interfaces (defaults to the MTU of the host's outbound interface)",
+)
+
+var bandwidthMode = flag.String(
+	"bandwidthMode",
+	"tbf",
+	"how to shape containers' bandwidth: tbf caps each direction; htb guarantees each container's egress rate on the uplink and lets it borrow what others do not use",
+)
+
+var uplinkInterface = flag.String(
+	"uplinkInterface",
+	"",
+	"interface that containers' egress is shaped on in htb mode (defaults to the interface with the external IP)",
+)
+
+var uplinkRate = flag.Uint64(
+	"uplinkRate",
+	0,
+	"rate of the uplink in bytes per second, shared by containers in htb mode",
+)
+
+var accountingBuckets = flag.String(
+	"accountingBuckets",
+	"",
+	"semicolon-separated name=cidr,... buckets to account containers' outbound traffic in (defaults to -allowNetworks and -denyNetworks); other traffic is accounted as \"other\"",
+)
+
+var processScrollback = flag.Int(
+	"processScrollback",
+	64*1024,
+	"bytes of each process's stdout and stderr kept for replaying to clients that attach later",
+)
+
+var processLogSize = flag.Int64(
+	"processLogSize",
+	0,
+	"size in bytes at which each process's output log in the depot is rotated (0 disables logging process output)",
+)
+
+var processLogFiles = flag.Int(
+	"processLogFiles",
+	5,
+	"number of rotated output logs to keep for each process",
+)
+
 var graphRoot = flag.String(
 	"graph",
 	"/var/lib/warden-docker-graph",
@@ -174,17 +287,125 @@ func main() {
 		log.Fatalln("must specify -rootfs with linux backend")
 	}
 
-	uidPool := uid_pool.New(uint32(*uidPoolStart), uint32(*uidPoolSize))
+	uidPool := uid_pool.New(uint32(*uidPoolStart), uint32(*uidPoolSize), *poolQuarantine)
 
 	_, ipNet, err := net.ParseCIDR(*networkPool)
 	if err != nil {
 		log.Fatalln("error parsing CIDR:", err)
 	}
 
-	networkPool := network_pool.New(ipNet)
+	poolPrefix, _ := ipNet.Mask.Size()
+	if *networkPoolSubnetPrefix > 30 || *networkPoolSubnetPrefix < poolPrefix {
+		log.Fatalln("-networkPoolSubnetPrefix must be between", poolPrefix, "and 30")
+	}
+
+	networkPool := network_pool.New(ipNet, *networkPoolSubnetPrefix, *poolQuarantine)
+
+	var ipv6Pool network_pool.NetworkPool
+	if *ipv6NetworkPool != "" {
+		_, ipv6Net, err := net.ParseCIDR(*ipv6NetworkPool)
+		if err != nil || ipv6Net.IP.To4() != nil {
+			log.Fatalln("error parsing IPv6 CIDR:", *ipv6NetworkPool, err)
+		}
+
+		ipv6PoolPrefix, _ := ipv6Net.Mask.Size()
+		if *ipv6NetworkPoolSubnetPrefix > 126 || *ipv6NetworkPoolSubnetPrefix < ipv6PoolPrefix {
+			log.Fatalln("-ipv6NetworkPoolSubnetPrefix must be between", ipv6PoolPrefix, "and 126")
+		}
+
+		// every subnet is tracked individually, so keep the pool to a sane size
+		if *ipv6NetworkPoolSubnetPrefix-ipv6PoolPrefix > 16 {
+			log.Fatalln("-ipv6NetworkPool must not contain more than 65536 subnets")
+		}
+
+		ipv6Pool = network_pool.New(ipv6Net, *ipv6NetworkPoolSubnetPrefix, *poolQuarantine)
+	}
+
+	portPool := newPortPool(uint32(*portPoolStart), uint32(*portPoolSize), *poolQuarantine)
 
-	// TODO: use /proc/sys/net/ipv4/ip_local_port_range by default (end + 1)
-	portPool := port_pool.New(uint32(*portPoolStart), uint32(*portPoolSize))
+	err = network_manager.DenyAction(*denyAction).Validate()
+	if err != nil {
+		log.Fatalln("-denyAction:", err)
+	}
+
+	dnsConfig := linux_backend.DNSConfig{
+		Nameservers: linux_backend.SplitList(*dnsServers),
+		Search:      linux_backend.SplitList(*dnsSearch),
+	}
+
+	dnsConfig.ExtraHosts, err = linux_backend.ParseHostEntries(linux_backend.SplitList(*extraHosts))
+	if err != nil {
+		log.Fatalln("-extraHosts:", err)
+	}
+
+	err = dnsConfig.Validate()
+	if err != nil {
+		log.Fatalln("invalid DNS configuration:", err)
+	}
+
+	var hostIP net.IP
+	if *externalIP != "" {
+		hostIP = net.ParseIP(*externalIP)
+		if hostIP == nil {
+			log.Fatalln("invalid external IP:", *externalIP)
+		}
+	} else {
+		hostIP, err = network_manager.ExternalIP()
+		if err != nil {
+			log.Println("WARNING: error determining external IP; mapping host ports on all local addresses:", err)
+			hostIP = nil
+		}
+	}
+
+	// 68 is the minimum MTU for IPv4
+	if *mtu != 0 && (*mtu < 68 || *mtu > 65535) {
+		log.Fatalln("-mtu must be between 68 and 65535:", *mtu)
+	}
+
+	containerMTU := uint32(*mtu)
+	if containerMTU == 0 {
+		containerMTU = outboundMTU(hostIP)
+	}
+
+	bandwidthConfig := bandwidth_manager.Config{
+		Mode:            bandwidth_manager.Mode(*bandwidthMode),
+		UplinkInterface: *uplinkInterface,
+		UplinkRate:      *uplinkRate,
+	}
+
+	if bandwidthConfig.Mode == bandwidth_manager.ModeHTB {
+		if bandwidthConfig.UplinkInterface == "" {
+			if hostIP == nil {
+				log.Fatalln("-bandwidthMode=htb requires -uplinkInterface when the external IP cannot be determined")
+			}
+
+			uplink, err := network_manager.InterfaceWithIP(hostIP)
+			if err != nil {
+				log.Fatalln("error determining uplink interface:", err)
+			}
+
+			bandwidthConfig.UplinkInterface = uplink.Name
+		}
+
+		// container UIDs are used as the uplink's class IDs
+		if *uidPoolStart+*uidPoolSize > 0xffff {
+			log.Fatalln("-bandwidthMode=htb requires UIDs below 65535")
+		}
+	}
+
+	err = bandwidthConfig.Validate()
+	if err != nil {
+		log.Fatalln("invalid bandwidth configuration:", err)
+	}
+
+	buckets, err := network_manager.ParseAccountingBuckets(*accountingBuckets)
+	if err != nil {
+		log.Fatalln("-accountingBuckets:", err)
+	}
+
+	if *processScrollback < 0 {
+		log.Fatalln("-processScrollback must not be negative")
+	}
 
 	config := sysconfig.NewConfig(*tag)
 
@@ -232,16 +453,36 @@ func main() {
 		rootFSProviders,
 		uidPool,
 		networkPool,
+		ipv6Pool,
 		portPool,
 		strings.Split(*denyNetworks, ","),
 		strings.Split(*allowNetworks, ","),
+		network_manager.DenyAction(*denyAction),
+		hostIP,
+		dnsConfig,
+		containerMTU,
+		bandwidthConfig,
+		buckets,
+		process_tracker.Config{
+			ScrollbackSize: *processScrollback,
+			LogSize:        *processLogSize,
+			LogFiles:       *processLogFiles,
+		},
 		runner,
+		network_manager.NewNetlinkLinks(),
 		quotaManager,
 	)
 
 	systemInfo := system_info.NewProvider(*depotPath)
 
-	backend := linux_backend.New(pool, systemInfo, *snapshotsPath)
+	// containers are only kept through restarts if asked; the journal then
+	// keeps them through the server being killed, too
+	journalPath := ""
+	if *snapshotsPath != "" {
+		journalPath = path.Join(*depotPath, "state.journal")
+	}
+
+	backend := linux_backend.New(pool, systemInfo, *snapshotsPath, journalPath)
 
 	log.Println("setting up backend")
 
@@ -274,3 +515,80 @@ func main() {
 
 	select {}
 }
+
+// newPortPool creates the pool of ports for mapping to containers, outside
+// the kernel's ephemeral range by default, so that the host's outbound
+// connections do not take them. Ports already bound on the host are
+// excluded.
+func newPortPool(start, size uint32, quarantine time.Duration) *port_pool.PortPool {
+	ephemeralFirst, ephemeralLast, err := port_pool.EphemeralRange()
+	if err != nil {
+		log.Println("error determining ephemeral port range:", err)
+	}
+
+	if start == 0 {
+		if err != nil {
+			start = 61001
+			log.Println("defaulting port pool start to", start)
+		} else {
+			var ok bool
+
+			start, ok = port_pool.DefaultStart(size, ephemeralFirst, ephemeralLast)
+			if !ok {
+				start = 61001
+				log.Println("WARNING: no room for the port pool outside the ephemeral port range; defaulting its start to", start)
+			}
+		}
+	}
+
+	if start > 65535 {
+		log.Fatalln("-portPoolStart must be at most 65535")
+	}
+
+	if start+size > 65536 {
+		size = 65536 - start
+		log.Println("port pool truncated to", size, "ports to end at 65535")
+	}
+
+	if err == nil && port_pool.Overlaps(start, size, ephemeralFirst, ephemeralLast) {
+		if *strictPortPool {
+			log.Fatalln("port pool overlaps the ephemeral port range:", ephemeralFirst, "-", ephemeralLast)
+		}
+
+		log.Println("WARNING: port pool overlaps the ephemeral port range:", ephemeralFirst, "-", ephemeralLast)
+	}
+
+	portPool := port_pool.New(start, size, quarantine)
+
+	boundPorts, err := port_pool.BoundPorts()
+	if err != nil {
+		log.Fatalln("error determining bound ports:", err)
+	}
+
+	for port := range boundPorts {
+		if port >= start && port < start+size {
+			log.Println("excluding bound port from port pool:", port)
+			portPool.Remove(port)
+		}
+	}
+
+	return portPool
+}
+
+// outboundMTU is the MTU of the interface with the host's external IP, which
+// traffic to the outside world leaves from, or 1500 if it cannot be
+// determined
+func outboundMTU(hostIP net.IP) uint32 {
+	if hostIP == nil {
+		log.Println("no external IP; defaulting MTU to 1500")
+		return 1500
+	}
+
+	mtu, err := network_manager.InterfaceMTU(hostIP)
+	if err != nil {
+		log.Println("error determining outbound interface's MTU, defaulting to 1500:", err)
+		return 1500
+	}
+
+	return mtu
+}
@@ -14,9 +14,11 @@ type IPTablesConfig struct {
 }
 
 type IPTablesFilterConfig struct {
-	ForwardChain   string
-	DefaultChain   string
-	InstancePrefix string
+	ForwardChain     string
+	DefaultChain     string
+	InstancePrefix   string
+	GroupPrefix      string
+	AccountingPrefix string
 }
 
 type IPTablesNATConfig struct {
@@ -33,9 +35,11 @@ func NewConfig(tag string) Config {
 
 		IPTables: IPTablesConfig{
 			Filter: IPTablesFilterConfig{
-				ForwardChain:   fmt.Sprintf("w-%s-forward", tag),
-				DefaultChain:   fmt.Sprintf("w-%s-default", tag),
-				InstancePrefix: fmt.Sprintf("w-%s-instance-", tag),
+				ForwardChain:     fmt.Sprintf("w-%s-forward", tag),
+				DefaultChain:     fmt.Sprintf("w-%s-default", tag),
+				InstancePrefix:   fmt.Sprintf("w-%s-instance-", tag),
+				GroupPrefix:      fmt.Sprintf("w-%s-group-", tag),
+				AccountingPrefix: fmt.Sprintf("w-%s-acct-", tag),
 			},
 			NAT: IPTablesNATConfig{
 				PreroutingChain:  fmt.Sprintf("w-%s-prerouting", tag),
@@ -55,6 +59,8 @@ func (config Config) Environ() []string {
 		"WARDEN_IPTABLES_FILTER_FORWARD_CHAIN=" + config.IPTables.Filter.ForwardChain,
 		"WARDEN_IPTABLES_FILTER_DEFAULT_CHAIN=" + config.IPTables.Filter.DefaultChain,
 		"WARDEN_IPTABLES_FILTER_INSTANCE_PREFIX=" + config.IPTables.Filter.InstancePrefix,
+		"WARDEN_IPTABLES_FILTER_GROUP_PREFIX=" + config.IPTables.Filter.GroupPrefix,
+		"WARDEN_IPTABLES_FILTER_ACCOUNTING_PREFIX=" + config.IPTables.Filter.AccountingPrefix,
 
 		"WARDEN_IPTABLES_NAT_PREROUTING_CHAIN=" + config.IPTables.NAT.PreroutingChain,
 		"WARDEN_IPTABLES_NAT_POSTROUTING_CHAIN=" + config.IPTables.NAT.PostroutingChain,